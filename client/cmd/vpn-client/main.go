@@ -2,14 +2,22 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"log"
+	"net/url"
 	"os"
+	"os/signal"
+	"runtime"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"selfhostgameaccel/client/core/api"
+	"selfhostgameaccel/client/core/tun"
+	"selfhostgameaccel/client/core/tunnel"
 	"selfhostgameaccel/server/protocol"
 )
 
@@ -37,13 +45,24 @@ func main() {
 	case "register":
 		username := envOr("USERNAME", "gamer")
 		password := envOr("PASSWORD", "password123")
-		deviceID := envOr("DEVICE_ID", "device-1")
-		resp, err := client.Register(ctx, protocol.RegisterRequest{Username: username, Password: password, DeviceID: deviceID})
+		resp, err := client.Register(ctx, protocol.RegisterRequest{
+			Username:   username,
+			Password:   password,
+			DeviceID:   os.Getenv("DEVICE_ID"),
+			DeviceName: os.Getenv("DEVICE_NAME"),
+			Platform:   runtime.GOOS,
+		})
 		exit(resp, err)
 	case "login":
 		username := envOr("USERNAME", "gamer")
 		password := envOr("PASSWORD", "password123")
-		resp, err := client.Login(ctx, protocol.LoginRequest{Username: username, Password: password})
+		resp, err := client.Login(ctx, protocol.LoginRequest{
+			Username:   username,
+			Password:   password,
+			DeviceID:   os.Getenv("DEVICE_ID"),
+			DeviceName: os.Getenv("DEVICE_NAME"),
+			Platform:   runtime.GOOS,
+		})
 		exit(resp, err)
 	case "create-room":
 		name := envOr("ROOM_NAME", "coop")
@@ -51,7 +70,126 @@ func main() {
 		if session == "" {
 			log.Fatalf("SESSION_TOKEN env var must be set")
 		}
-		resp, err := client.CreateRoom(ctx, protocol.CreateRoomRequest{Name: name, PreferredTransport: protocol.TransportUDP, MTU: 1350, SessionToken: session})
+		req := protocol.CreateRoomRequest{
+			Name:               name,
+			PreferredTransport: protocol.TransportUDP,
+			MTU:                1350,
+			Password:           os.Getenv("ROOM_PASSWORD"),
+			InviteOnly:         os.Getenv("INVITE_ONLY") != "",
+			MaxMembers:         envInt("MAX_MEMBERS"),
+			Waitlist:           os.Getenv("WAITLIST") != "",
+			IdleTimeoutSec:     envInt("IDLE_TIMEOUT_SECONDS"),
+			SessionToken:       session,
+		}
+		resp, err := client.CreateRoom(ctx, req)
+		exit(resp, err)
+	case "list-rooms":
+		session := envOr("SESSION_TOKEN", "")
+		if session == "" {
+			log.Fatalf("SESSION_TOKEN env var must be set")
+		}
+		resp, err := client.ListRooms(ctx, protocol.ListRoomsRequest{SessionToken: session})
+		exit(resp, err)
+	case "room":
+		if len(args) < 2 {
+			log.Fatalf("room requires room id argument")
+		}
+		session := envOr("SESSION_TOKEN", "")
+		if session == "" {
+			log.Fatalf("SESSION_TOKEN env var must be set")
+		}
+		resp, err := client.GetRoom(ctx, protocol.GetRoomRequest{RoomID: args[1], SessionToken: session})
+		exit(resp, err)
+	case "update-room":
+		if len(args) < 2 {
+			log.Fatalf("update-room requires room id argument")
+		}
+		session := envOr("SESSION_TOKEN", "")
+		if session == "" {
+			log.Fatalf("SESSION_TOKEN env var must be set")
+		}
+		req := protocol.UpdateRoomRequest{
+			RoomID:               args[1],
+			Name:                 os.Getenv("ROOM_NAME"),
+			PreferredTransport:   protocol.Transport(os.Getenv("TRANSPORT")),
+			MTU:                  envInt("MTU"),
+			KeepaliveIntervalSec: envInt("KEEPALIVE_SECONDS"),
+			Password:             os.Getenv("ROOM_PASSWORD"),
+			SessionToken:         session,
+		}
+		if v := os.Getenv("INVITE_ONLY"); v != "" {
+			inviteOnly := v != "0"
+			req.InviteOnly = &inviteOnly
+		}
+		if os.Getenv("MAX_MEMBERS") != "" {
+			maxMembers := envInt("MAX_MEMBERS")
+			req.MaxMembers = &maxMembers
+		}
+		if v := os.Getenv("WAITLIST"); v != "" {
+			waitlist := v != "0"
+			req.Waitlist = &waitlist
+		}
+		if os.Getenv("IDLE_TIMEOUT_SECONDS") != "" {
+			idle := envInt("IDLE_TIMEOUT_SECONDS")
+			req.IdleTimeoutSec = &idle
+		}
+		resp, err := client.UpdateRoom(ctx, req)
+		exit(resp, err)
+	case "delete-room":
+		if len(args) < 2 {
+			log.Fatalf("delete-room requires room id argument")
+		}
+		session := envOr("SESSION_TOKEN", "")
+		if session == "" {
+			log.Fatalf("SESSION_TOKEN env var must be set")
+		}
+		resp, err := client.DeleteRoom(ctx, protocol.DeleteRoomRequest{RoomID: args[1], SessionToken: session})
+		exit(resp, err)
+	case "room-role":
+		if len(args) < 3 {
+			log.Fatalf("room-role requires room id and role (owner, moderator, member) arguments")
+		}
+		target := envOr("TARGET_USER", "")
+		session := envOr("SESSION_TOKEN", "")
+		if target == "" || session == "" {
+			log.Fatalf("TARGET_USER and SESSION_TOKEN env vars must be set")
+		}
+		resp, err := client.UpdateRoomRole(ctx, protocol.RoomRoleUpdateRequest{RoomID: args[1], TargetUser: target, Role: protocol.RoomRole(args[2]), SessionToken: session})
+		exit(resp, err)
+	case "invite":
+		if len(args) < 2 {
+			log.Fatalf("invite requires room id argument")
+		}
+		session := envOr("SESSION_TOKEN", "")
+		if session == "" {
+			log.Fatalf("SESSION_TOKEN env var must be set")
+		}
+		resp, err := client.CreateInvite(ctx, protocol.CreateInviteRequest{RoomID: args[1], TTLSeconds: envInt("INVITE_TTL_SECONDS"), MaxUses: envInt("INVITE_MAX_USES"), SessionToken: session})
+		exit(resp, err)
+	case "kick":
+		if len(args) < 3 {
+			log.Fatalf("kick requires room id and device id arguments")
+		}
+		session := envOr("SESSION_TOKEN", "")
+		if session == "" {
+			log.Fatalf("SESSION_TOKEN env var must be set")
+		}
+		resp, err := client.KickMember(ctx, protocol.KickMemberRequest{RoomID: args[1], DeviceID: args[2], Username: os.Getenv("TARGET_USER"), SessionToken: session})
+		exit(resp, err)
+	case "ban", "unban":
+		if len(args) < 2 {
+			log.Fatalf("%s requires room id argument", args[0])
+		}
+		session := envOr("SESSION_TOKEN", "")
+		target, device := os.Getenv("TARGET_USER"), os.Getenv("TARGET_DEVICE")
+		if session == "" || (target == "" && device == "") {
+			log.Fatalf("SESSION_TOKEN and TARGET_USER or TARGET_DEVICE env vars must be set")
+		}
+		if strings.ToLower(args[0]) == "unban" {
+			resp, err := client.Unban(ctx, protocol.UnbanRequest{RoomID: args[1], Username: target, DeviceID: device, SessionToken: session})
+			exit(resp, err)
+		}
+		resp, err := client.Ban(ctx, protocol.BanRequest{RoomID: args[1], Username: target, DeviceID: device, DurationSeconds: envInt("BAN_SECONDS"), SessionToken: session})
 		exit(resp, err)
 	case "join-room":
 		if len(args) < 2 {
@@ -61,7 +199,25 @@ func main() {
 		if session == "" {
 			log.Fatalf("SESSION_TOKEN env var must be set")
 		}
-		resp, err := client.JoinRoom(ctx, protocol.JoinRoomRequest{RoomID: args[1], DeviceID: envOr("DEVICE_ID", "device-1"), SessionToken: session})
+		req := protocol.JoinRoomRequest{
+			RoomID:       args[1],
+			DeviceID:     deviceID(),
+			SessionToken: session,
+			RotateKey:    os.Getenv("ROTATE_KEY") != "",
+			Password:     os.Getenv("ROOM_PASSWORD"),
+			InviteCode:   os.Getenv("INVITE_CODE"),
+		}
+		resp, err := client.JoinRoom(ctx, req)
+		exit(resp, err)
+	case "leave-room":
+		if len(args) < 2 {
+			log.Fatalf("leave-room requires room id argument")
+		}
+		session := envOr("SESSION_TOKEN", "")
+		if session == "" {
+			log.Fatalf("SESSION_TOKEN env var must be set")
+		}
+		resp, err := client.LeaveRoom(ctx, protocol.LeaveRoomRequest{RoomID: args[1], DeviceID: deviceID(), SessionToken: session})
 		exit(resp, err)
 	case "keepalive":
 		resp, err := client.Keepalive(ctx, protocol.Keepalive{Sequence: 1})
@@ -70,9 +226,33 @@ func main() {
 		if len(args) < 2 {
 			log.Fatalf("bootstrap requires room id argument")
 		}
-		offer := protocol.TunnelOffer{RoomID: args[1], Transport: protocol.TransportUDP, CipherSuite: protocol.CipherSuiteAES256GCM, EphemeralKey: "client-ephemeral"}
+		session := envOr("SESSION_TOKEN", "")
+		if session == "" {
+			log.Fatalf("SESSION_TOKEN env var must be set")
+		}
+		ephemeral, err := protocol.GenerateEphemeralKey()
+		if err != nil {
+			log.Fatalf("ephemeral key: %v", err)
+		}
+		offer := protocol.TunnelOffer{
+			RoomID:       args[1],
+			DeviceID:     deviceID(),
+			SessionToken: session,
+			Transport:    protocol.TransportUDP,
+			CipherSuite:  protocol.CipherSuiteAES256GCM,
+			EphemeralKey: protocol.EncodeEphemeralKey(ephemeral.PublicKey()),
+		}
 		resp, err := client.BootstrapTunnel(ctx, offer)
 		exit(resp, err)
+	case "connect":
+		if len(args) < 2 {
+			log.Fatalf("connect requires room id argument")
+		}
+		session := envOr("SESSION_TOKEN", "")
+		if session == "" {
+			log.Fatalf("SESSION_TOKEN env var must be set")
+		}
+		connect(ctx, client, *serverAddr, *skipVerify, args[1], deviceID(), session)
 	case "grant-admin":
 		target := envOr("TARGET_USER", "")
 		session := envOr("SESSION_TOKEN", "")
@@ -89,6 +269,63 @@ func main() {
 		}
 		resp, err := client.UpdateAdminRole(ctx, protocol.AdminRoleUpdateRequest{SessionToken: session, TargetUser: target, Grant: false})
 		exit(resp, err)
+	case "logout":
+		session := envOr("SESSION_TOKEN", "")
+		if session == "" {
+			log.Fatalf("SESSION_TOKEN env var must be set")
+		}
+		resp, err := client.Logout(ctx, protocol.LogoutRequest{SessionToken: session})
+		exit(resp, err)
+	case "revoke-sessions":
+		session := envOr("SESSION_TOKEN", "")
+		if session == "" {
+			log.Fatalf("SESSION_TOKEN env var must be set")
+		}
+		resp, err := client.RevokeSessions(ctx, protocol.RevokeSessionsRequest{SessionToken: session, TargetUser: os.Getenv("TARGET_USER")})
+		exit(resp, err)
+	case "lockouts":
+		session := envOr("SESSION_TOKEN", "")
+		if session == "" {
+			log.Fatalf("SESSION_TOKEN env var must be set")
+		}
+		resp, err := client.ListLockouts(ctx, protocol.ListLockoutsRequest{SessionToken: session})
+		exit(resp, err)
+	case "unlock-user":
+		target := envOr("TARGET_USER", "")
+		session := envOr("SESSION_TOKEN", "")
+		if target == "" || session == "" {
+			log.Fatalf("TARGET_USER and SESSION_TOKEN env vars must be set")
+		}
+		resp, err := client.ClearLockout(ctx, protocol.ClearLockoutRequest{SessionToken: session, TargetUser: target})
+		exit(resp, err)
+	case "devices":
+		session := envOr("SESSION_TOKEN", "")
+		if session == "" {
+			log.Fatalf("SESSION_TOKEN env var must be set")
+		}
+		resp, err := client.ListDevices(ctx, protocol.ListDevicesRequest{SessionToken: session})
+		exit(resp, err)
+	case "rename-device":
+		if len(args) < 2 {
+			log.Fatalf("rename-device requires device id argument")
+		}
+		session := envOr("SESSION_TOKEN", "")
+		name := envOr("DEVICE_NAME", "")
+		if session == "" || name == "" {
+			log.Fatalf("SESSION_TOKEN and DEVICE_NAME env vars must be set")
+		}
+		resp, err := client.RenameDevice(ctx, protocol.RenameDeviceRequest{SessionToken: session, DeviceID: args[1], Name: name})
+		exit(resp, err)
+	case "revoke-device":
+		if len(args) < 2 {
+			log.Fatalf("revoke-device requires device id argument")
+		}
+		session := envOr("SESSION_TOKEN", "")
+		if session == "" {
+			log.Fatalf("SESSION_TOKEN env var must be set")
+		}
+		resp, err := client.RevokeDevice(ctx, protocol.RevokeDeviceRequest{SessionToken: session, DeviceID: args[1]})
+		exit(resp, err)
 	default:
 		usage()
 	}
@@ -98,14 +335,122 @@ func usage() {
 	fmt.Println("vpn-client usage:")
 	fmt.Println("  vpn-client [flags] <command> [args]")
 	fmt.Println("Commands:")
-	fmt.Println("  register                # create a new user via USERNAME/PASSWORD/DEVICE_ID")
-	fmt.Println("  login                   # authenticate using USERNAME/PASSWORD env vars")
-	fmt.Println("  create-room             # create room named ROOM_NAME (env) using SESSION_TOKEN")
-	fmt.Println("  join-room <room-id>     # join with SESSION_TOKEN env and DEVICE_ID")
+	fmt.Println("  register                # create a new user via USERNAME/PASSWORD, enrolling DEVICE_ID (new device if unset; DEVICE_NAME optional)")
+	fmt.Println("  login                   # authenticate using USERNAME/PASSWORD env vars, enrolling DEVICE_ID (new device if unset)")
+	fmt.Println("  create-room             # create room named ROOM_NAME (env) using SESSION_TOKEN (ROOM_PASSWORD, INVITE_ONLY=1, MAX_MEMBERS, WAITLIST=1, IDLE_TIMEOUT_SECONDS optional)")
+	fmt.Println("  list-rooms              # list rooms visible with SESSION_TOKEN")
+	fmt.Println("  room <room-id>          # show a room and its member roster")
+	fmt.Println("  update-room <room-id>   # apply ROOM_NAME, TRANSPORT, MTU, KEEPALIVE_SECONDS, ROOM_PASSWORD, INVITE_ONLY, MAX_MEMBERS, WAITLIST, IDLE_TIMEOUT_SECONDS (env, unset = unchanged)")
+	fmt.Println("  delete-room <room-id>   # delete the room and disconnect its members")
+	fmt.Println("  room-role <room-id> <role> # give TARGET_USER a room role (owner transfers ownership)")
+	fmt.Println("  invite <room-id>        # create an invite code (INVITE_TTL_SECONDS, INVITE_MAX_USES env)")
+	fmt.Println("  kick <room-id> <device> # remove a device from the room (it may rejoin; TARGET_USER picks the account if several share the id)")
+	fmt.Println("  ban <room-id>           # ban TARGET_USER, or with TARGET_DEVICE one of their devices (BAN_SECONDS, unset = until lifted)")
+	fmt.Println("  unban <room-id>         # lift the ban on TARGET_USER and/or TARGET_DEVICE")
+	fmt.Println("  join-room <room-id>     # join with SESSION_TOKEN env and DEVICE_ID (ROOM_PASSWORD or INVITE_CODE for protected rooms, ROTATE_KEY=1 for a new session key)")
+	fmt.Println("  leave-room <room-id>    # leave and release DEVICE_ID's address")
 	fmt.Println("  keepalive               # send a keepalive ping")
-	fmt.Println("  bootstrap <room-id>     # request tunnel parameters")
+	fmt.Println("  bootstrap <room-id>     # exchange tunnel keys for DEVICE_ID using SESSION_TOKEN")
+	fmt.Println("  connect <room-id>       # join, bootstrap and run the tunnel until interrupted")
 	fmt.Println("  grant-admin             # promote TARGET_USER using SESSION_TOKEN")
 	fmt.Println("  revoke-admin            # demote TARGET_USER using SESSION_TOKEN")
+	fmt.Println("  logout                  # end SESSION_TOKEN")
+	fmt.Println("  revoke-sessions         # end every session of TARGET_USER (default: yourself)")
+	fmt.Println("  lockouts                # list accounts locked after failed logins (admin)")
+	fmt.Println("  unlock-user             # clear TARGET_USER's lockout and failed logins (admin)")
+	fmt.Println("  devices                 # list your enrolled devices")
+	fmt.Println("  rename-device <device>  # rename a device to DEVICE_NAME")
+	fmt.Println("  revoke-device <device>  # revoke a device's refresh token and drop its tunnels")
+}
+
+// connect brings the tunnel up for roomID and keeps it running until SIGINT/SIGTERM.
+func connect(ctx context.Context, client *api.Client, serverAddr string, skipVerify bool, roomID, deviceID, session string) {
+	serverURL, err := url.Parse(serverAddr)
+	if err != nil {
+		log.Fatalf("parse server url: %v", err)
+	}
+	join, err := client.JoinRoom(ctx, protocol.JoinRoomRequest{
+		RoomID:       roomID,
+		DeviceID:     deviceID,
+		SessionToken: session,
+		Password:     os.Getenv("ROOM_PASSWORD"),
+		InviteCode:   os.Getenv("INVITE_CODE"),
+	})
+	if err != nil {
+		log.Fatalf("join room: %v", err)
+	}
+	if join.Waitlisted {
+		log.Fatalf("room is full: waiting at position %d, connect again once admitted", join.WaitlistPosition)
+	}
+	ephemeral, err := protocol.GenerateEphemeralKey()
+	if err != nil {
+		log.Fatalf("ephemeral key: %v", err)
+	}
+	answer, err := client.BootstrapTunnel(ctx, protocol.TunnelOffer{
+		RoomID:       roomID,
+		DeviceID:     deviceID,
+		SessionToken: session,
+		Transport:    join.Transport,
+		CipherSuite:  protocol.CipherSuiteAES256GCM,
+		EphemeralKey: protocol.EncodeEphemeralKey(ephemeral.PublicKey()),
+	})
+	if err != nil {
+		log.Fatalf("bootstrap: %v", err)
+	}
+	// Servers that predate per-room MTUs leave it unset; Open then uses tun.DefaultMTU.
+	dev, err := tun.Open(envOr("TUN_NAME", ""), join.MTU)
+	if err != nil {
+		log.Fatalf("open tun: %v", err)
+	}
+	engine, err := tunnel.New(tunnel.Config{
+		Host:      serverURL.Hostname(),
+		Join:      join,
+		Answer:    answer,
+		Ephemeral: ephemeral,
+		Device:    dev,
+		TLSConfig: &tls.Config{ServerName: serverURL.Hostname(), InsecureSkipVerify: skipVerify},
+		OnStatus: func(s tunnel.Status) {
+			if s.Err != nil {
+				log.Printf("tunnel %s: %v", s.State, s.Err)
+				return
+			}
+			log.Printf("tunnel %s via %s (%s in %s)", s.State, s.Transport, s.VirtualIP, s.Subnet)
+		},
+	})
+	if err != nil {
+		dev.Close()
+		log.Fatalf("tunnel: %v", err)
+	}
+	if err := engine.Start(ctx); err != nil {
+		log.Fatalf("start tunnel: %v", err)
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+	engine.Stop()
+}
+
+// envInt reads an optional integer setting; unset means zero.
+func envInt(key string) int {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return 0
+	}
+	v, err := strconv.Atoi(raw)
+	if err != nil {
+		log.Fatalf("%s must be an integer: %v", key, err)
+	}
+	return v
+}
+
+// deviceID returns DEVICE_ID, which must name a device enrolled by register or login; both
+// print the ID they enrolled.
+func deviceID() string {
+	id := os.Getenv("DEVICE_ID")
+	if id == "" {
+		log.Fatalf("DEVICE_ID env var must be set to the device_id returned by register or login")
+	}
+	return id
 }
 
 func envOr(key, fallback string) string {
@@ -10,11 +10,41 @@ import (
 	"net/http"
 	"net/url"
 	"path"
+	"strconv"
+	"strings"
 	"time"
 
 	"selfhostgameaccel/server/protocol"
 )
 
+// Error is returned for responses with an error status. Code carries the server's
+// machine-readable reason when it sends one, such as protocol.ErrorCodeRoomFull.
+type Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+	// RetryAfter is set from the Retry-After header of throttled (429) responses.
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("server returned %d: %s (retry in %s)", e.StatusCode, e.Message, e.RetryAfter)
+	}
+	return fmt.Sprintf("server returned %d: %s", e.StatusCode, e.Message)
+}
+
+func newError(status int, body []byte) *Error {
+	var payload struct {
+		Error string `json:"error"`
+		Code  string `json:"code"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil || payload.Error == "" {
+		return &Error{StatusCode: status, Message: strings.TrimSpace(string(body))}
+	}
+	return &Error{StatusCode: status, Code: payload.Code, Message: payload.Error}
+}
+
 // Client wraps HTTP operations against the control-plane API using the shared protocol types.
 type Client struct {
 	baseURL    *url.URL
@@ -64,7 +94,11 @@ func (c *Client) doJSON(ctx context.Context, p string, reqBody any, respBody any
 
 	if resp.StatusCode >= 400 {
 		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("server returned %d: %s", resp.StatusCode, string(body))
+		apiErr := newError(resp.StatusCode, body)
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			apiErr.RetryAfter = time.Duration(seconds) * time.Second
+		}
+		return apiErr
 	}
 
 	if respBody != nil {
@@ -93,18 +127,120 @@ func (c *Client) Refresh(ctx context.Context, req protocol.RefreshTokenRequest)
 	return resp, err
 }
 
+func (c *Client) Logout(ctx context.Context, req protocol.LogoutRequest) (protocol.LogoutResponse, error) {
+	var resp protocol.LogoutResponse
+	err := c.doJSON(ctx, "/auth/logout", req, &resp)
+	return resp, err
+}
+
+func (c *Client) RevokeSessions(ctx context.Context, req protocol.RevokeSessionsRequest) (protocol.RevokeSessionsResponse, error) {
+	var resp protocol.RevokeSessionsResponse
+	err := c.doJSON(ctx, "/admin/sessions/revoke", req, &resp)
+	return resp, err
+}
+
+func (c *Client) ListLockouts(ctx context.Context, req protocol.ListLockoutsRequest) (protocol.ListLockoutsResponse, error) {
+	var resp protocol.ListLockoutsResponse
+	err := c.doJSON(ctx, "/admin/lockouts", req, &resp)
+	return resp, err
+}
+
+func (c *Client) ClearLockout(ctx context.Context, req protocol.ClearLockoutRequest) (protocol.ClearLockoutResponse, error) {
+	var resp protocol.ClearLockoutResponse
+	err := c.doJSON(ctx, "/admin/lockouts/clear", req, &resp)
+	return resp, err
+}
+
+func (c *Client) ListDevices(ctx context.Context, req protocol.ListDevicesRequest) (protocol.ListDevicesResponse, error) {
+	var resp protocol.ListDevicesResponse
+	err := c.doJSON(ctx, "/devices/list", req, &resp)
+	return resp, err
+}
+
+func (c *Client) RenameDevice(ctx context.Context, req protocol.RenameDeviceRequest) (protocol.DeviceInfo, error) {
+	var resp protocol.DeviceInfo
+	err := c.doJSON(ctx, "/devices/rename", req, &resp)
+	return resp, err
+}
+
+func (c *Client) RevokeDevice(ctx context.Context, req protocol.RevokeDeviceRequest) (protocol.RevokeDeviceResponse, error) {
+	var resp protocol.RevokeDeviceResponse
+	err := c.doJSON(ctx, "/devices/revoke", req, &resp)
+	return resp, err
+}
+
 func (c *Client) CreateRoom(ctx context.Context, req protocol.CreateRoomRequest) (protocol.CreateRoomResponse, error) {
 	var resp protocol.CreateRoomResponse
 	err := c.doJSON(ctx, "/rooms", req, &resp)
 	return resp, err
 }
 
+func (c *Client) ListRooms(ctx context.Context, req protocol.ListRoomsRequest) (protocol.ListRoomsResponse, error) {
+	var resp protocol.ListRoomsResponse
+	err := c.doJSON(ctx, "/rooms/list", req, &resp)
+	return resp, err
+}
+
+func (c *Client) GetRoom(ctx context.Context, req protocol.GetRoomRequest) (protocol.RoomDetail, error) {
+	var resp protocol.RoomDetail
+	err := c.doJSON(ctx, "/rooms/get", req, &resp)
+	return resp, err
+}
+
+func (c *Client) UpdateRoom(ctx context.Context, req protocol.UpdateRoomRequest) (protocol.RoomDetail, error) {
+	var resp protocol.RoomDetail
+	err := c.doJSON(ctx, "/rooms/update", req, &resp)
+	return resp, err
+}
+
+func (c *Client) DeleteRoom(ctx context.Context, req protocol.DeleteRoomRequest) (protocol.DeleteRoomResponse, error) {
+	var resp protocol.DeleteRoomResponse
+	err := c.doJSON(ctx, "/rooms/delete", req, &resp)
+	return resp, err
+}
+
+func (c *Client) UpdateRoomRole(ctx context.Context, req protocol.RoomRoleUpdateRequest) (protocol.RoomRoleUpdateResponse, error) {
+	var resp protocol.RoomRoleUpdateResponse
+	err := c.doJSON(ctx, "/rooms/role", req, &resp)
+	return resp, err
+}
+
+func (c *Client) CreateInvite(ctx context.Context, req protocol.CreateInviteRequest) (protocol.CreateInviteResponse, error) {
+	var resp protocol.CreateInviteResponse
+	err := c.doJSON(ctx, "/rooms/invite", req, &resp)
+	return resp, err
+}
+
+func (c *Client) KickMember(ctx context.Context, req protocol.KickMemberRequest) (protocol.KickMemberResponse, error) {
+	var resp protocol.KickMemberResponse
+	err := c.doJSON(ctx, "/rooms/kick", req, &resp)
+	return resp, err
+}
+
+func (c *Client) Ban(ctx context.Context, req protocol.BanRequest) (protocol.BanResponse, error) {
+	var resp protocol.BanResponse
+	err := c.doJSON(ctx, "/rooms/ban", req, &resp)
+	return resp, err
+}
+
+func (c *Client) Unban(ctx context.Context, req protocol.UnbanRequest) (protocol.BanResponse, error) {
+	var resp protocol.BanResponse
+	err := c.doJSON(ctx, "/rooms/unban", req, &resp)
+	return resp, err
+}
+
 func (c *Client) JoinRoom(ctx context.Context, req protocol.JoinRoomRequest) (protocol.JoinRoomResponse, error) {
 	var resp protocol.JoinRoomResponse
 	err := c.doJSON(ctx, "/rooms/join", req, &resp)
 	return resp, err
 }
 
+func (c *Client) LeaveRoom(ctx context.Context, req protocol.LeaveRoomRequest) (protocol.LeaveRoomResponse, error) {
+	var resp protocol.LeaveRoomResponse
+	err := c.doJSON(ctx, "/rooms/leave", req, &resp)
+	return resp, err
+}
+
 func (c *Client) Keepalive(ctx context.Context, req protocol.Keepalive) (protocol.KeepaliveAck, error) {
 	var resp protocol.KeepaliveAck
 	err := c.doJSON(ctx, "/rooms/keepalive", req, &resp)
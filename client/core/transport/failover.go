@@ -0,0 +1,342 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"selfhostgameaccel/server/protocol"
+	"selfhostgameaccel/server/protocol/datachannel"
+	"selfhostgameaccel/server/protocol/frame"
+)
+
+const (
+	DefaultProbeTimeout  = 3 * time.Second
+	DefaultRetryInterval = 30 * time.Second
+)
+
+// ErrNoTransport is returned by Connect and Recover when neither path answers a probe.
+var ErrNoTransport = errors.New("transport: neither udp nor tcp reached the server")
+
+// Keepalive builds sealed ping frames and recognises sealed pongs so a path can be probed
+// end to end, including the data-channel keys.
+type Keepalive interface {
+	Ping() ([]byte, error)
+	IsPong(raw []byte) bool
+}
+
+// NewKeepalive returns a Keepalive that seals pings with the client's data-channel keys.
+// The sealer is shared with the caller so ping and data packet IDs never collide.
+func NewKeepalive(keys datachannel.Keys, sealer *datachannel.Sealer) (Keepalive, error) {
+	opener, err := datachannel.NewOpener(keys.Suite, keys.Receive(datachannel.RoleClient))
+	if err != nil {
+		return nil, err
+	}
+	return &sealedKeepalive{sealer: sealer, opener: opener}, nil
+}
+
+type sealedKeepalive struct {
+	sealer *datachannel.Sealer
+	opener *datachannel.Opener
+}
+
+func (k *sealedKeepalive) Ping() ([]byte, error) {
+	return k.sealer.Seal(frame.PingPayload())
+}
+
+func (k *sealedKeepalive) IsPong(raw []byte) bool {
+	pkt, err := frame.ParseData(raw)
+	if err != nil {
+		return false
+	}
+	payload, err := k.opener.Open(pkt)
+	return err == nil && frame.IsPong(payload)
+}
+
+// FailoverConfig describes the endpoints from a UDP bootstrap answer and how to probe them.
+type FailoverConfig struct {
+	Host      string
+	Answer    protocol.TunnelAnswer
+	TLSConfig *tls.Config
+	Keepalive Keepalive
+
+	// ProbeTimeout is how long to wait for a pong before declaring a path dead.
+	ProbeTimeout time.Duration
+	// RetryInterval is how often UDP is re-probed while the tunnel runs over TCP.
+	RetryInterval time.Duration
+	// OnSwitch, when set, is called with the newly active transport after every change.
+	OnSwitch func(protocol.Transport)
+}
+
+// Failover is a Conn that prefers UDP and falls back to TCP when no pong comes back over UDP.
+// While on TCP it keeps re-probing UDP and migrates back as soon as UDP answers; Recover moves
+// a session off a path that went silent after Connect. Swaps are invisible to callers: Send and Receive always use the active path.
+type Failover struct {
+	cfg FailoverConfig
+
+	mu           sync.Mutex
+	active       Conn
+	generation   uint64
+	readDeadline time.Time
+	closed       bool
+	// retrying is set once Connect has started the UDP retry loop, which closes done on exit.
+	retrying bool
+	stop     chan struct{}
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+// NewFailover applies the default probe timeout and retry interval; call Connect to start it.
+func NewFailover(cfg FailoverConfig) *Failover {
+	if cfg.ProbeTimeout <= 0 {
+		cfg.ProbeTimeout = DefaultProbeTimeout
+	}
+	if cfg.RetryInterval <= 0 {
+		cfg.RetryInterval = DefaultRetryInterval
+	}
+	return &Failover{cfg: cfg, stop: make(chan struct{}), done: make(chan struct{})}
+}
+
+// Connect probes UDP, falls back to TCP if needed and starts re-probing UDP in the background.
+func (f *Failover) Connect(ctx context.Context) error {
+	conn, err := f.probeUDP(ctx)
+	if err != nil {
+		conn, err = f.probeTCP(ctx)
+	}
+	if err != nil {
+		f.finish()
+		return fmt.Errorf("%w: %v", ErrNoTransport, err)
+	}
+	if !f.swap(conn) {
+		f.finish()
+		return net.ErrClosed
+	}
+	f.mu.Lock()
+	f.retrying = true
+	f.mu.Unlock()
+	go f.retryUDP()
+	return nil
+}
+
+// finish marks the background work as over, so Close does not wait for it.
+func (f *Failover) finish() {
+	f.doneOnce.Do(func() { close(f.done) })
+}
+
+// Recover re-establishes the tunnel after the active path stopped answering: it probes UDP
+// and then TCP again, just like Connect, and swaps in whichever answers first.
+func (f *Failover) Recover(ctx context.Context) error {
+	conn, err := f.probeUDP(ctx)
+	if err != nil {
+		conn, err = f.probeTCP(ctx)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrNoTransport, err)
+	}
+	if !f.swap(conn) {
+		return net.ErrClosed
+	}
+	return nil
+}
+
+func (f *Failover) probeUDP(ctx context.Context) (Conn, error) {
+	if f.cfg.Answer.DataPort == 0 {
+		return nil, errors.New("no udp port advertised")
+	}
+	conn, err := DialUDP(ctx, net.JoinHostPort(f.cfg.Host, strconv.Itoa(f.cfg.Answer.DataPort)))
+	if err != nil {
+		return nil, err
+	}
+	if err := f.probe(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (f *Failover) probeTCP(ctx context.Context) (Conn, error) {
+	if f.cfg.Answer.FallbackPort == 0 {
+		return nil, errors.New("no tcp fallback advertised")
+	}
+	tcpAnswer := f.cfg.Answer
+	tcpAnswer.Transport = protocol.TransportTCP
+	tcpAnswer.DataPort = f.cfg.Answer.FallbackPort
+	dialCtx, cancel := context.WithTimeout(ctx, f.cfg.ProbeTimeout)
+	defer cancel()
+	conn, err := Dial(dialCtx, f.cfg.Host, tcpAnswer, f.cfg.TLSConfig)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.probe(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// probe sends a ping and waits for the pong, discarding anything else that arrives meanwhile.
+func (f *Failover) probe(conn Conn) error {
+	ping, err := f.cfg.Keepalive.Ping()
+	if err != nil {
+		return err
+	}
+	if err := conn.Send(ping); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(f.cfg.ProbeTimeout)
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		return err
+	}
+	defer conn.SetReadDeadline(time.Time{})
+	for {
+		raw, err := conn.Receive()
+		if err != nil {
+			return err
+		}
+		if f.cfg.Keepalive.IsPong(raw) {
+			return nil
+		}
+	}
+}
+
+func (f *Failover) retryUDP() {
+	defer f.finish()
+	ticker := time.NewTicker(f.cfg.RetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.stop:
+			return
+		case <-ticker.C:
+		}
+		if f.Transport() == protocol.TransportUDP {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), f.cfg.ProbeTimeout)
+		conn, err := f.probeUDP(ctx)
+		cancel()
+		if err != nil {
+			// The probe ping may have moved the server's return path to UDP; a ping over the
+			// active path moves it back.
+			if ping, err := f.cfg.Keepalive.Ping(); err == nil {
+				_ = f.Send(ping)
+			}
+			continue
+		}
+		if !f.swap(conn) {
+			return
+		}
+	}
+}
+
+// swap installs conn as the active path and closes the previous one. It returns false when
+// the Failover was closed in the meantime.
+func (f *Failover) swap(conn Conn) bool {
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		conn.Close()
+		return false
+	}
+	previous := f.active
+	f.active = conn
+	f.generation++
+	_ = conn.SetReadDeadline(f.readDeadline)
+	onSwitch := f.cfg.OnSwitch
+	f.mu.Unlock()
+
+	if previous != nil {
+		previous.Close()
+	}
+	if onSwitch != nil {
+		onSwitch(conn.Transport())
+	}
+	return true
+}
+
+func (f *Failover) current() (Conn, uint64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return nil, 0, net.ErrClosed
+	}
+	if f.active == nil {
+		return nil, 0, errors.New("transport: not connected")
+	}
+	return f.active, f.generation, nil
+}
+
+func (f *Failover) Send(frame []byte) error {
+	conn, _, err := f.current()
+	if err != nil {
+		return err
+	}
+	return conn.Send(frame)
+}
+
+// Receive reads from the active path, moving on to the new path when a swap closes the old one.
+func (f *Failover) Receive() ([]byte, error) {
+	for {
+		conn, generation, err := f.current()
+		if err != nil {
+			return nil, err
+		}
+		raw, err := conn.Receive()
+		if err == nil {
+			return raw, nil
+		}
+		f.mu.Lock()
+		swapped := !f.closed && f.generation != generation
+		f.mu.Unlock()
+		if !swapped {
+			return nil, err
+		}
+	}
+}
+
+func (f *Failover) SetReadDeadline(t time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.readDeadline = t
+	if f.active == nil {
+		return nil
+	}
+	return f.active.SetReadDeadline(t)
+}
+
+// Transport reports the active transport, or an empty value before Connect succeeds.
+func (f *Failover) Transport() protocol.Transport {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.active == nil {
+		return ""
+	}
+	return f.active.Transport()
+}
+
+func (f *Failover) Close() error {
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return nil
+	}
+	f.closed = true
+	active := f.active
+	retrying := f.retrying
+	f.mu.Unlock()
+
+	close(f.stop)
+	if !retrying {
+		f.finish()
+	}
+	<-f.done
+	if active != nil {
+		return active.Close()
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"selfhostgameaccel/server/protocol"
+	"selfhostgameaccel/server/protocol/datachannel"
+)
+
+// udpRelay forwards datagrams between one client and the server's UDP data plane and can be
+// told to drop everything, standing in for a network that blocks UDP.
+type udpRelay struct {
+	conn     net.PacketConn
+	upstream net.Conn
+	client   atomic.Value
+	blocked  atomic.Bool
+}
+
+func startUDPRelay(t *testing.T, target int) *udpRelay {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen relay: %v", err)
+	}
+	upstream, err := net.Dial("udp", net.JoinHostPort("127.0.0.1", strconv.Itoa(target)))
+	if err != nil {
+		t.Fatalf("dial upstream: %v", err)
+	}
+	r := &udpRelay{conn: conn, upstream: upstream}
+	t.Cleanup(func() {
+		conn.Close()
+		upstream.Close()
+	})
+	go func() {
+		buf := make([]byte, maxDatagram)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			r.client.Store(addr)
+			if !r.blocked.Load() {
+				_, _ = upstream.Write(buf[:n])
+			}
+		}
+	}()
+	go func() {
+		buf := make([]byte, maxDatagram)
+		for {
+			n, err := upstream.Read(buf)
+			if err != nil {
+				return
+			}
+			addr, ok := r.client.Load().(net.Addr)
+			if ok && !r.blocked.Load() {
+				_, _ = conn.WriteTo(buf[:n], addr)
+			}
+		}
+	}()
+	return r
+}
+
+func (r *udpRelay) port() int {
+	return r.conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func newTestFailover(t *testing.T, server *testServer, relay *udpRelay, switches chan<- protocol.Transport) *Failover {
+	t.Helper()
+	join, answer, keys := server.bootstrap(t, protocol.TransportUDP)
+	if answer.FallbackPort == 0 || !answer.DataTLS {
+		t.Fatalf("udp answer should advertise a tls tcp fallback: %+v", answer)
+	}
+	sealer, err := datachannel.NewSealer(keys.Suite, keys.Send(datachannel.RoleClient), join.PeerID, 0)
+	if err != nil {
+		t.Fatalf("sealer: %v", err)
+	}
+	keepalive, err := NewKeepalive(keys, sealer)
+	if err != nil {
+		t.Fatalf("keepalive: %v", err)
+	}
+	answer.DataPort = relay.port()
+	f := NewFailover(FailoverConfig{
+		Host:          "127.0.0.1",
+		Answer:        answer,
+		TLSConfig:     server.clientTLS,
+		Keepalive:     keepalive,
+		ProbeTimeout:  300 * time.Millisecond,
+		RetryInterval: 100 * time.Millisecond,
+		OnSwitch:      func(tr protocol.Transport) { switches <- tr },
+	})
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func expectSwitch(t *testing.T, switches <-chan protocol.Transport, want protocol.Transport) {
+	t.Helper()
+	select {
+	case got := <-switches:
+		if got != want {
+			t.Fatalf("switched to %s, want %s", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no switch to %s", want)
+	}
+}
+
+// expectPong pings through f and waits for the pong on whatever path is active.
+func expectPong(t *testing.T, f *Failover) {
+	t.Helper()
+	keepalive := f.cfg.Keepalive
+	ping, err := keepalive.Ping()
+	if err != nil {
+		t.Fatalf("ping: %v", err)
+	}
+	if err := f.Send(ping); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	_ = f.SetReadDeadline(time.Now().Add(2 * time.Second))
+	defer f.SetReadDeadline(time.Time{})
+	for {
+		raw, err := f.Receive()
+		if err != nil {
+			t.Fatalf("receive: %v", err)
+		}
+		if keepalive.IsPong(raw) {
+			return
+		}
+	}
+}
+
+func TestFailoverPrefersUDP(t *testing.T) {
+	server := startServer(t)
+	switches := make(chan protocol.Transport, 4)
+	relay := startUDPRelay(t, server.udpPort)
+	f := newTestFailover(t, server, relay, switches)
+
+	if err := f.Connect(context.Background()); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	expectSwitch(t, switches, protocol.TransportUDP)
+	if f.Transport() != protocol.TransportUDP {
+		t.Fatalf("active transport %s", f.Transport())
+	}
+	expectPong(t, f)
+}
+
+func TestFailoverFallsBackToTCPAndMigratesBack(t *testing.T) {
+	server := startServer(t)
+	switches := make(chan protocol.Transport, 4)
+	relay := startUDPRelay(t, server.udpPort)
+	relay.blocked.Store(true)
+	f := newTestFailover(t, server, relay, switches)
+
+	if err := f.Connect(context.Background()); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	expectSwitch(t, switches, protocol.TransportTCP)
+	expectPong(t, f)
+
+	relay.blocked.Store(false)
+	expectSwitch(t, switches, protocol.TransportUDP)
+	if f.Transport() != protocol.TransportUDP {
+		t.Fatalf("active transport %s", f.Transport())
+	}
+	expectPong(t, f)
+}
+
+func TestFailoverReportsUnreachableServer(t *testing.T) {
+	server := startServer(t)
+	switches := make(chan protocol.Transport, 4)
+	relay := startUDPRelay(t, server.udpPort)
+	relay.blocked.Store(true)
+	f := newTestFailover(t, server, relay, switches)
+	f.cfg.Answer.FallbackPort = 0
+
+	if err := f.Connect(context.Background()); !errors.Is(err, ErrNoTransport) {
+		t.Fatalf("expected ErrNoTransport, got %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+}
+
+func TestFailoverClosesWithoutConnecting(t *testing.T) {
+	f := NewFailover(FailoverConfig{Host: "127.0.0.1"})
+	closed := make(chan error, 1)
+	go func() { closed <- f.Close() }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatalf("close: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("close blocked on a failover that never connected")
+	}
+	if err := f.Connect(context.Background()); err == nil {
+		t.Fatal("connect after close should fail")
+	}
+}
@@ -0,0 +1,142 @@
+// Package transport dials the data channel negotiated during tunnel bootstrap and moves
+// encoded frames over UDP datagrams or a length-prefixed TCP (optionally TLS) stream.
+package transport
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"selfhostgameaccel/server/protocol"
+	"selfhostgameaccel/server/protocol/frame"
+)
+
+// maxDatagram bounds a single received UDP frame.
+const maxDatagram = 65535
+
+// Conn carries encoded data-channel frames between the client and the server.
+type Conn interface {
+	Send(frame []byte) error
+	// Receive blocks until a frame arrives, the read deadline passes or the conn is closed.
+	Receive() ([]byte, error)
+	SetReadDeadline(t time.Time) error
+	Transport() protocol.Transport
+	Close() error
+}
+
+// Dial connects to host using the transport, port and TLS setting from answer. tlsConfig is
+// only consulted when the server asks for TLS; when nil, the server certificate is verified
+// against the system roots for host.
+func Dial(ctx context.Context, host string, answer protocol.TunnelAnswer, tlsConfig *tls.Config) (Conn, error) {
+	if answer.DataPort == 0 {
+		return nil, errors.New("transport: server did not advertise a data port")
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(answer.DataPort))
+	switch protocol.NormalizeTransport(answer.Transport) {
+	case protocol.TransportUDP:
+		return DialUDP(ctx, addr)
+	case protocol.TransportTCP:
+		if !answer.DataTLS {
+			return DialTCP(ctx, addr, nil)
+		}
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+		}
+		return DialTCP(ctx, addr, tlsConfig)
+	default:
+		return nil, fmt.Errorf("transport: unsupported transport %q", answer.Transport)
+	}
+}
+
+// DialUDP opens a datagram data channel to addr.
+func DialUDP(ctx context.Context, addr string) (Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("transport: dial udp: %w", err)
+	}
+	return &udpConn{conn: conn}, nil
+}
+
+// DialTCP opens a stream data channel to addr, wrapped in TLS when tlsConfig is non-nil.
+func DialTCP(ctx context.Context, addr string, tlsConfig *tls.Config) (Conn, error) {
+	var (
+		conn net.Conn
+		err  error
+	)
+	if tlsConfig != nil {
+		d := tls.Dialer{Config: tlsConfig}
+		conn, err = d.DialContext(ctx, "tcp", addr)
+	} else {
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("transport: dial tcp: %w", err)
+	}
+	return &streamConn{conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+type udpConn struct {
+	conn net.Conn
+}
+
+func (u *udpConn) Send(frame []byte) error {
+	_, err := u.conn.Write(frame)
+	return err
+}
+
+func (u *udpConn) Receive() ([]byte, error) {
+	buf := make([]byte, maxDatagram)
+	n, err := u.conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+func (u *udpConn) SetReadDeadline(t time.Time) error {
+	return u.conn.SetReadDeadline(t)
+}
+
+func (u *udpConn) Transport() protocol.Transport {
+	return protocol.TransportUDP
+}
+
+func (u *udpConn) Close() error {
+	return u.conn.Close()
+}
+
+type streamConn struct {
+	writeMu sync.Mutex
+	conn    net.Conn
+	reader  *bufio.Reader
+}
+
+func (s *streamConn) Send(packet []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return frame.WriteStream(s.conn, packet)
+}
+
+func (s *streamConn) Receive() ([]byte, error) {
+	return frame.ReadStream(s.reader)
+}
+
+func (s *streamConn) SetReadDeadline(t time.Time) error {
+	return s.conn.SetReadDeadline(t)
+}
+
+func (s *streamConn) Transport() protocol.Transport {
+	return protocol.TransportTCP
+}
+
+func (s *streamConn) Close() error {
+	return s.conn.Close()
+}
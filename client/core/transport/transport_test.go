@@ -0,0 +1,161 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"selfhostgameaccel/client/core/api"
+	"selfhostgameaccel/server/dataplane"
+	"selfhostgameaccel/server/protocol"
+	"selfhostgameaccel/server/protocol/datachannel"
+	"selfhostgameaccel/server/protocol/frame"
+)
+
+type testServer struct {
+	api       *api.Client
+	clientTLS *tls.Config
+	udpPort   int
+}
+
+// startServer runs a control plane plus UDP and TLS-over-TCP data planes on loopback.
+func startServer(t *testing.T) *testServer {
+	t.Helper()
+	server := protocol.NewServer()
+	serverTLS, clientTLS, err := protocol.GenerateTLSConfigs()
+	if err != nil {
+		t.Fatalf("tls: %v", err)
+	}
+	gateway := dataplane.NewGateway(server)
+
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen udp: %v", err)
+	}
+	udp := dataplane.NewUDPListener(packetConn, gateway)
+	go udp.Serve()
+	t.Cleanup(func() { udp.Close() })
+	udpPort := packetConn.LocalAddr().(*net.UDPAddr).Port
+	server.SetDataPlanePort(protocol.TransportUDP, udpPort)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen tcp: %v", err)
+	}
+	server.SetDataPlanePort(protocol.TransportTCP, ln.Addr().(*net.TCPAddr).Port)
+	server.SetDataPlaneTLS(true)
+	tcp := dataplane.NewTCPListener(tls.NewListener(ln, serverTLS), gateway)
+	go tcp.Serve()
+	t.Cleanup(func() { tcp.Close() })
+
+	ts := httptest.NewUnstartedServer(server.Handler())
+	ts.TLS = serverTLS
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+	httpClient := ts.Client()
+	httpClient.Transport.(*http.Transport).TLSClientConfig = clientTLS
+	client, err := api.New(ts.URL, httpClient)
+	if err != nil {
+		t.Fatalf("api client: %v", err)
+	}
+	return &testServer{api: client, clientTLS: clientTLS, udpPort: udpPort}
+}
+
+// bootstrap logs in, joins a fresh room and negotiates the given transport, returning the
+// answer together with the client's data-channel keys.
+func (s *testServer) bootstrap(t *testing.T, transport protocol.Transport) (protocol.JoinRoomResponse, protocol.TunnelAnswer, datachannel.Keys) {
+	t.Helper()
+	ctx := context.Background()
+	login, err := s.api.Login(ctx, protocol.LoginRequest{Username: "gamer", Password: "password123", DeviceID: "pc"})
+	if err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	room, err := s.api.CreateRoom(ctx, protocol.CreateRoomRequest{Name: "lan", SessionToken: login.SessionToken})
+	if err != nil {
+		t.Fatalf("create room: %v", err)
+	}
+	join, err := s.api.JoinRoom(ctx, protocol.JoinRoomRequest{RoomID: room.RoomID, DeviceID: "pc", SessionToken: login.SessionToken})
+	if err != nil {
+		t.Fatalf("join: %v", err)
+	}
+	ephemeral, err := protocol.GenerateEphemeralKey()
+	if err != nil {
+		t.Fatalf("ephemeral: %v", err)
+	}
+	answer, err := s.api.BootstrapTunnel(ctx, protocol.TunnelOffer{
+		RoomID:       room.RoomID,
+		DeviceID:     "pc",
+		SessionToken: login.SessionToken,
+		Transport:    transport,
+		EphemeralKey: protocol.EncodeEphemeralKey(ephemeral.PublicKey()),
+	})
+	if err != nil {
+		t.Fatalf("bootstrap: %v", err)
+	}
+	keys, err := datachannel.ClientKeys(join, answer, ephemeral)
+	if err != nil {
+		t.Fatalf("derive: %v", err)
+	}
+	return join, answer, keys
+}
+
+func TestDialNegotiatedTransportAndPing(t *testing.T) {
+	server := startServer(t)
+	for _, transport := range []protocol.Transport{protocol.TransportUDP, protocol.TransportTCP} {
+		t.Run(string(transport), func(t *testing.T) {
+			join, answer, keys := server.bootstrap(t, transport)
+			if answer.Transport != transport {
+				t.Fatalf("negotiated %s, want %s", answer.Transport, transport)
+			}
+			// UDP answers carry data_tls too since it describes their TCP fallback.
+			if !answer.DataTLS {
+				t.Fatalf("expected data_tls for %s", transport)
+			}
+			if (answer.FallbackPort != 0) != (transport == protocol.TransportUDP) {
+				t.Fatalf("unexpected fallback_port=%d for %s", answer.FallbackPort, transport)
+			}
+
+			conn, err := Dial(context.Background(), "127.0.0.1", answer, server.clientTLS)
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			defer conn.Close()
+			if conn.Transport() != transport {
+				t.Fatalf("conn reports %s", conn.Transport())
+			}
+
+			sealer, _ := datachannel.NewSealer(keys.Suite, keys.Send(datachannel.RoleClient), join.PeerID, 0)
+			opener, _ := datachannel.NewOpener(keys.Suite, keys.Receive(datachannel.RoleClient))
+			ping, _ := sealer.Seal(frame.PingPayload())
+			if err := conn.Send(ping); err != nil {
+				t.Fatalf("send: %v", err)
+			}
+			_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			raw, err := conn.Receive()
+			if err != nil {
+				t.Fatalf("receive: %v", err)
+			}
+			pkt, err := frame.ParseData(raw)
+			if err != nil {
+				t.Fatalf("parse: %v", err)
+			}
+			payload, err := opener.Open(pkt)
+			if err != nil || !frame.IsPong(payload) {
+				t.Fatalf("expected pong, got %x (%v)", payload, err)
+			}
+		})
+	}
+}
+
+func TestDialRequiresAdvertisedPort(t *testing.T) {
+	if _, err := Dial(context.Background(), "127.0.0.1", protocol.TunnelAnswer{Transport: protocol.TransportUDP}, nil); err == nil {
+		t.Fatalf("expected error without a data port")
+	}
+	if _, err := Dial(context.Background(), "127.0.0.1", protocol.TunnelAnswer{Transport: "sctp", DataPort: 1}, nil); err == nil {
+		t.Fatalf("expected error for an unknown transport")
+	}
+}
@@ -0,0 +1,128 @@
+package tun
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+)
+
+// Fake is an in-memory Device. Packets passed to Inject are returned by Read as if the
+// operating system had routed them into the interface, and packets written by the tunnel
+// appear on Written.
+type Fake struct {
+	name    string
+	mtu     int
+	inbound chan []byte
+	written chan []byte
+
+	mu        sync.Mutex
+	addresses []netip.Prefix
+	routes    []netip.Prefix
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewFake returns a Fake named name; a non-positive MTU selects DefaultMTU.
+func NewFake(name string, mtu int) *Fake {
+	if mtu <= 0 {
+		mtu = DefaultMTU
+	}
+	return &Fake{
+		name:    name,
+		mtu:     mtu,
+		inbound: make(chan []byte, 64),
+		written: make(chan []byte, 64),
+		closed:  make(chan struct{}),
+	}
+}
+
+func (f *Fake) Name() string {
+	return f.name
+}
+
+func (f *Fake) MTU() int {
+	return f.mtu
+}
+
+func (f *Fake) Read(packet []byte) (int, error) {
+	select {
+	case p := <-f.inbound:
+		if len(p) > len(packet) {
+			return 0, io.ErrShortBuffer
+		}
+		return copy(packet, p), nil
+	case <-f.closed:
+		return 0, net.ErrClosed
+	}
+}
+
+// Write records a copy of packet on Written, blocking while the buffer is full.
+func (f *Fake) Write(packet []byte) (int, error) {
+	p := append([]byte(nil), packet...)
+	select {
+	case <-f.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	select {
+	case f.written <- p:
+		return len(packet), nil
+	case <-f.closed:
+		return 0, net.ErrClosed
+	}
+}
+
+func (f *Fake) SetAddress(prefix netip.Prefix) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.addresses = append(f.addresses, prefix)
+	return nil
+}
+
+func (f *Fake) AddRoute(prefix netip.Prefix) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.routes = append(f.routes, prefix.Masked())
+	return nil
+}
+
+func (f *Fake) Close() error {
+	f.closeOnce.Do(func() { close(f.closed) })
+	return nil
+}
+
+// Inject queues packet to be returned by Read, blocking while the queue is full.
+func (f *Fake) Inject(packet []byte) error {
+	p := append([]byte(nil), packet...)
+	select {
+	case <-f.closed:
+		return net.ErrClosed
+	default:
+	}
+	select {
+	case f.inbound <- p:
+		return nil
+	case <-f.closed:
+		return net.ErrClosed
+	}
+}
+
+// Written delivers the packets the tunnel injected into the interface, in order.
+func (f *Fake) Written() <-chan []byte {
+	return f.written
+}
+
+// Addresses returns the prefixes assigned with SetAddress.
+func (f *Fake) Addresses() []netip.Prefix {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]netip.Prefix(nil), f.addresses...)
+}
+
+// Routes returns the prefixes added with AddRoute, masked to their network address.
+func (f *Fake) Routes() []netip.Prefix {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]netip.Prefix(nil), f.routes...)
+}
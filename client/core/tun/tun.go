@@ -0,0 +1,42 @@
+// Package tun abstracts the layer-3 virtual interface the tunnel engine reads IP packets from
+// and injects received packets into. Open returns the platform device; Fake stands in for it
+// in tests that must run without privileges.
+package tun
+
+import (
+	"errors"
+	"net/netip"
+)
+
+// DefaultMTU is used when a caller does not ask for a specific MTU.
+const DefaultMTU = 1400
+
+// ErrUnsupported is returned by Open on platforms without a TUN implementation.
+var ErrUnsupported = errors.New("tun: not supported on this platform")
+
+// Device is a TUN interface carrying raw IP packets without any link-layer header.
+type Device interface {
+	// Name is the interface name assigned by the operating system.
+	Name() string
+	MTU() int
+	// Read blocks until the operating system routes a packet into the interface and copies it
+	// into packet. It fails with io.ErrShortBuffer when packet is smaller than the datagram.
+	Read(packet []byte) (int, error)
+	// Write injects packet as if it had arrived on the interface.
+	Write(packet []byte) (int, error)
+	// SetAddress assigns the interface address; the prefix length also installs the on-link
+	// route for the subnet, as it would for a physical LAN.
+	SetAddress(prefix netip.Prefix) error
+	// AddRoute sends traffic for prefix through the interface.
+	AddRoute(prefix netip.Prefix) error
+	Close() error
+}
+
+// Open creates a TUN interface called name with the given MTU. An empty name lets the
+// operating system pick one and a non-positive MTU selects DefaultMTU.
+func Open(name string, mtu int) (Device, error) {
+	if mtu <= 0 {
+		mtu = DefaultMTU
+	}
+	return open(name, mtu)
+}
@@ -0,0 +1,165 @@
+//go:build linux
+
+package tun
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+const cloneDevice = "/dev/net/tun"
+
+// linuxDevice is a /dev/net/tun interface opened without packet information headers.
+type linuxDevice struct {
+	file *os.File
+	name string
+	mtu  int
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func open(name string, mtu int) (Device, error) {
+	fd, err := unix.Open(cloneDevice, unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("tun: open %s: %w", cloneDevice, err)
+	}
+	ifr, err := unix.NewIfreq(name)
+	if err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("tun: interface name %q: %w", name, err)
+	}
+	ifr.SetUint16(unix.IFF_TUN | unix.IFF_NO_PI)
+	if err := unix.IoctlIfreq(fd, unix.TUNSETIFF, ifr); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("tun: create interface: %w", err)
+	}
+	// A non-blocking descriptor lets the runtime poller wake Read when the device is closed.
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("tun: set nonblocking: %w", err)
+	}
+	dev := &linuxDevice{file: os.NewFile(uintptr(fd), cloneDevice), name: ifr.Name(), mtu: mtu}
+	if err := dev.setMTU(mtu); err != nil {
+		dev.Close()
+		return nil, err
+	}
+	return dev, nil
+}
+
+func (d *linuxDevice) Name() string {
+	return d.name
+}
+
+func (d *linuxDevice) MTU() int {
+	return d.mtu
+}
+
+func (d *linuxDevice) Read(packet []byte) (int, error) {
+	// The kernel truncates datagrams that do not fit, so read into a buffer large enough for
+	// the MTU and report short buffers the same way as the fake device.
+	if len(packet) >= d.mtu {
+		return d.file.Read(packet)
+	}
+	buf := make([]byte, d.mtu)
+	n, err := d.file.Read(buf)
+	if err != nil {
+		return 0, err
+	}
+	if n > len(packet) {
+		return 0, io.ErrShortBuffer
+	}
+	return copy(packet, buf[:n]), nil
+}
+
+func (d *linuxDevice) Write(packet []byte) (int, error) {
+	return d.file.Write(packet)
+}
+
+func (d *linuxDevice) SetAddress(prefix netip.Prefix) error {
+	if !prefix.Addr().Is4() {
+		return fmt.Errorf("tun: address %s is not IPv4", prefix)
+	}
+	return d.withSocket(func(sock int) error {
+		ifr, err := unix.NewIfreq(d.name)
+		if err != nil {
+			return err
+		}
+		if err := ifr.SetInet4Addr(prefix.Addr().AsSlice()); err != nil {
+			return err
+		}
+		if err := unix.IoctlIfreq(sock, unix.SIOCSIFADDR, ifr); err != nil {
+			return fmt.Errorf("tun: set address %s: %w", prefix, err)
+		}
+		if err := ifr.SetInet4Addr(net.CIDRMask(prefix.Bits(), 32)); err != nil {
+			return err
+		}
+		if err := unix.IoctlIfreq(sock, unix.SIOCSIFNETMASK, ifr); err != nil {
+			return fmt.Errorf("tun: set netmask %s: %w", prefix, err)
+		}
+		return d.up(sock)
+	})
+}
+
+// AddRoute uses iproute2 because the legacy route ioctls cannot express a device-only route
+// portably across kernel versions.
+func (d *linuxDevice) AddRoute(prefix netip.Prefix) error {
+	out, err := exec.Command("ip", "route", "replace", prefix.Masked().String(), "dev", d.name).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("tun: add route %s: %w: %s", prefix, err, out)
+	}
+	return nil
+}
+
+func (d *linuxDevice) Close() error {
+	d.closeOnce.Do(func() {
+		d.closeErr = d.file.Close()
+	})
+	return d.closeErr
+}
+
+func (d *linuxDevice) setMTU(mtu int) error {
+	return d.withSocket(func(sock int) error {
+		ifr, err := unix.NewIfreq(d.name)
+		if err != nil {
+			return err
+		}
+		ifr.SetUint32(uint32(mtu))
+		if err := unix.IoctlIfreq(sock, unix.SIOCSIFMTU, ifr); err != nil {
+			return fmt.Errorf("tun: set mtu %d: %w", mtu, err)
+		}
+		return nil
+	})
+}
+
+func (d *linuxDevice) up(sock int) error {
+	ifr, err := unix.NewIfreq(d.name)
+	if err != nil {
+		return err
+	}
+	if err := unix.IoctlIfreq(sock, unix.SIOCGIFFLAGS, ifr); err != nil {
+		return fmt.Errorf("tun: read flags: %w", err)
+	}
+	ifr.SetUint16(ifr.Uint16() | unix.IFF_UP | unix.IFF_RUNNING)
+	if err := unix.IoctlIfreq(sock, unix.SIOCSIFFLAGS, ifr); err != nil {
+		return fmt.Errorf("tun: bring up: %w", err)
+	}
+	return nil
+}
+
+// withSocket runs fn with a throwaway datagram socket, which the interface ioctls require.
+func (d *linuxDevice) withSocket(fn func(sock int) error) error {
+	sock, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("tun: control socket: %w", err)
+	}
+	defer unix.Close(sock)
+	return fn(sock)
+}
@@ -0,0 +1,33 @@
+//go:build linux
+
+package tun
+
+import (
+	"net/netip"
+	"os"
+	"testing"
+)
+
+// TestLinuxDevice exercises the real driver when the test runs with CAP_NET_ADMIN.
+func TestLinuxDevice(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	if _, err := os.Stat(cloneDevice); err != nil {
+		t.Skipf("no %s: %v", cloneDevice, err)
+	}
+	dev, err := Open("", 1300)
+	if err != nil {
+		t.Skipf("cannot create tun device here: %v", err)
+	}
+	defer dev.Close()
+	if dev.Name() == "" || dev.MTU() != 1300 {
+		t.Fatalf("name %q mtu %d", dev.Name(), dev.MTU())
+	}
+	if err := dev.SetAddress(netip.MustParsePrefix("10.213.0.2/24")); err != nil {
+		t.Fatalf("set address: %v", err)
+	}
+	if err := dev.SetAddress(netip.MustParsePrefix("fd00::2/64")); err == nil {
+		t.Fatal("expected IPv6 address to be rejected")
+	}
+}
@@ -0,0 +1,7 @@
+//go:build !linux
+
+package tun
+
+func open(name string, mtu int) (Device, error) {
+	return nil, ErrUnsupported
+}
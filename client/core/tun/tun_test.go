@@ -0,0 +1,85 @@
+package tun
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+var _ Device = (*Fake)(nil)
+
+func TestFakeCarriesPacketsBothWays(t *testing.T) {
+	dev := NewFake("fake0", 0)
+	if dev.MTU() != DefaultMTU {
+		t.Fatalf("mtu %d, want default %d", dev.MTU(), DefaultMTU)
+	}
+	if err := dev.Inject([]byte{0x45, 1, 2, 3}); err != nil {
+		t.Fatalf("inject: %v", err)
+	}
+	buf := make([]byte, dev.MTU())
+	n, err := dev.Read(buf)
+	if err != nil || !bytes.Equal(buf[:n], []byte{0x45, 1, 2, 3}) {
+		t.Fatalf("read %x, %v", buf[:n], err)
+	}
+
+	packet := []byte{0x45, 9, 9}
+	if _, err := dev.Write(packet); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	packet[1] = 0
+	if got := <-dev.Written(); !bytes.Equal(got, []byte{0x45, 9, 9}) {
+		t.Fatalf("written %x", got)
+	}
+}
+
+func TestFakeRejectsShortBuffer(t *testing.T) {
+	dev := NewFake("fake0", 1280)
+	if err := dev.Inject(make([]byte, 100)); err != nil {
+		t.Fatalf("inject: %v", err)
+	}
+	if _, err := dev.Read(make([]byte, 10)); !errors.Is(err, io.ErrShortBuffer) {
+		t.Fatalf("expected short buffer, got %v", err)
+	}
+}
+
+func TestFakeCloseUnblocksRead(t *testing.T) {
+	dev := NewFake("fake0", 0)
+	errs := make(chan error, 1)
+	go func() {
+		_, err := dev.Read(make([]byte, dev.MTU()))
+		errs <- err
+	}()
+	dev.Close()
+	select {
+	case err := <-errs:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("expected net.ErrClosed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("read did not return after close")
+	}
+	if _, err := dev.Write([]byte{1}); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("write after close: %v", err)
+	}
+}
+
+func TestFakeRecordsConfiguration(t *testing.T) {
+	dev := NewFake("fake0", 0)
+	addr := netip.MustParsePrefix("10.10.0.2/24")
+	if err := dev.SetAddress(addr); err != nil {
+		t.Fatalf("set address: %v", err)
+	}
+	if err := dev.AddRoute(netip.MustParsePrefix("10.20.0.9/16")); err != nil {
+		t.Fatalf("add route: %v", err)
+	}
+	if got := dev.Addresses(); len(got) != 1 || got[0] != addr {
+		t.Fatalf("addresses %v", got)
+	}
+	if got := dev.Routes(); len(got) != 1 || got[0] != netip.MustParsePrefix("10.20.0.0/16") {
+		t.Fatalf("routes %v", got)
+	}
+}
@@ -0,0 +1,456 @@
+// Package tunnel runs the client data plane: it configures the TUN device for the joined room,
+// encrypts packets read from it for the server and injects the packets the server relays back.
+package tunnel
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+
+	"selfhostgameaccel/client/core/transport"
+	"selfhostgameaccel/client/core/tun"
+	"selfhostgameaccel/server/protocol"
+	"selfhostgameaccel/server/protocol/datachannel"
+	"selfhostgameaccel/server/protocol/frame"
+)
+
+// State is the lifecycle phase reported in Status.
+type State string
+
+const (
+	StateIdle       State = "idle"
+	StateConnecting State = "connecting"
+	StateConnected  State = "connected"
+	StateFailed     State = "failed"
+	StateStopped    State = "stopped"
+)
+
+// missedKeepalives is how many keepalive intervals may pass without hearing from the server
+// before the path is considered dead.
+const missedKeepalives = 3
+
+var (
+	ErrAlreadyStarted = errors.New("tunnel: engine already started")
+	ErrNotStarted     = errors.New("tunnel: engine not started")
+	// ErrEphemeralKeyUsed is returned by New for a key another engine was already built from:
+	// both would derive the same data-channel keys and start their packet counters at 1,
+	// reusing AEAD nonces. Bootstrap again with a fresh key instead.
+	ErrEphemeralKeyUsed = errors.New("tunnel: ephemeral key already used")
+)
+
+// usedEphemeral records the public halves of the ephemeral keys engines were built from, so
+// each key yields at most one engine per process.
+var usedEphemeral sync.Map
+
+// Config carries the results of JoinRoom and BootstrapTunnel plus the local resources the
+// engine drives.
+type Config struct {
+	// Host is the server address the data plane is dialed on.
+	Host   string
+	Join   protocol.JoinRoomResponse
+	Answer protocol.TunnelAnswer
+	// Ephemeral is the private half of the key offered in TunnelOffer. New consumes it: the
+	// engine does not keep it and no other engine can be built from it.
+	Ephemeral *ecdh.PrivateKey
+	// Device is owned by the engine from Start onwards and closed by Stop.
+	Device    tun.Device
+	TLSConfig *tls.Config
+
+	// ProbeTimeout and RetryInterval tune UDP→TCP failover; zero selects the transport defaults.
+	ProbeTimeout  time.Duration
+	RetryInterval time.Duration
+	// KeepaliveInterval overrides the room's keepalive interval from Join when set.
+	KeepaliveInterval time.Duration
+	// OnStatus, when set, receives a snapshot after every state or transport change.
+	OnStatus func(Status)
+}
+
+// Status is a point-in-time view of the engine for the UI.
+type Status struct {
+	State     State
+	Transport protocol.Transport
+	VirtualIP string
+	Subnet    string
+	// Err explains why the engine entered StateFailed.
+	Err error
+
+	PacketsSent     uint64
+	PacketsReceived uint64
+	BytesSent       uint64
+	BytesReceived   uint64
+	// Dropped counts inbound frames that failed authentication or replay checks.
+	Dropped uint64
+}
+
+// Engine moves packets between a TUN device and the server data plane.
+type Engine struct {
+	cfg     Config
+	keys    datachannel.Keys
+	address netip.Prefix
+	subnet  netip.Prefix
+
+	mu      sync.Mutex
+	status  Status
+	started bool
+	conn    transport.Conn
+	// lastHeard is when the last authenticated frame, usually a pong, arrived.
+	lastHeard time.Time
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+}
+
+// New validates cfg and derives the data-channel keys; nothing is touched until Start. An
+// engine can be started only once.
+func New(cfg Config) (*Engine, error) {
+	if cfg.Device == nil {
+		return nil, errors.New("tunnel: device required")
+	}
+	if cfg.Ephemeral == nil {
+		return nil, errors.New("tunnel: ephemeral key required")
+	}
+	subnet, err := netip.ParsePrefix(cfg.Join.OverlaySubnetReference)
+	if err != nil {
+		return nil, fmt.Errorf("tunnel: overlay subnet: %w", err)
+	}
+	virtualIP, err := netip.ParseAddr(cfg.Join.VirtualIP)
+	if err != nil {
+		return nil, fmt.Errorf("tunnel: virtual ip: %w", err)
+	}
+	if _, used := usedEphemeral.LoadOrStore(string(cfg.Ephemeral.PublicKey().Bytes()), struct{}{}); used {
+		return nil, ErrEphemeralKeyUsed
+	}
+	keys, err := datachannel.ClientKeys(cfg.Join, cfg.Answer, cfg.Ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Ephemeral = nil
+	e := &Engine{
+		cfg:     cfg,
+		keys:    keys,
+		address: netip.PrefixFrom(virtualIP, subnet.Bits()),
+		subnet:  subnet.Masked(),
+	}
+	e.status = Status{State: StateIdle, VirtualIP: virtualIP.String(), Subnet: e.subnet.String()}
+	return e, nil
+}
+
+// Start configures the device, connects the negotiated transport (falling back from UDP to
+// TCP when needed) and starts the packet loops. It returns once the tunnel is connected.
+func (e *Engine) Start(ctx context.Context) error {
+	e.mu.Lock()
+	if e.started {
+		e.mu.Unlock()
+		return ErrAlreadyStarted
+	}
+	e.started = true
+	e.mu.Unlock()
+	e.setState(StateConnecting, nil)
+
+	if err := e.configureDevice(); err != nil {
+		return e.abort(err)
+	}
+	sealer, err := datachannel.NewSealer(e.keys.Suite, e.keys.Send(datachannel.RoleClient), e.cfg.Join.PeerID, 0)
+	if err != nil {
+		return e.abort(err)
+	}
+	opener, err := datachannel.NewOpener(e.keys.Suite, e.keys.Receive(datachannel.RoleClient))
+	if err != nil {
+		return e.abort(err)
+	}
+	replay, err := datachannel.NewReplayWindow(datachannel.DefaultReplayWindow)
+	if err != nil {
+		return e.abort(err)
+	}
+	keepalive, err := transport.NewKeepalive(e.keys, sealer)
+	if err != nil {
+		return e.abort(err)
+	}
+	conn, err := e.connect(ctx, keepalive)
+	if err != nil {
+		return e.abort(err)
+	}
+	// The server only learns where to reach a peer from its frames, so announce the path
+	// before any game traffic needs to flow back.
+	if err := announce(conn, keepalive); err != nil {
+		conn.Close()
+		return e.abort(err)
+	}
+
+	loopCtx, cancel := context.WithCancel(context.Background())
+	e.mu.Lock()
+	e.conn = conn
+	e.lastHeard = time.Now()
+	e.cancel = cancel
+	e.status.State = StateConnected
+	e.status.Transport = conn.Transport()
+	e.mu.Unlock()
+	e.notify()
+
+	e.wg.Add(3)
+	go e.outbound(sealer)
+	go e.inbound(opener, replay)
+	go e.keepalive(loopCtx, keepalive)
+	return nil
+}
+
+// Stop tears the tunnel down and releases the device. It is safe to call more than once.
+func (e *Engine) Stop() error {
+	e.mu.Lock()
+	if !e.started {
+		e.mu.Unlock()
+		return ErrNotStarted
+	}
+	if e.status.State == StateStopped {
+		e.mu.Unlock()
+		return nil
+	}
+	e.mu.Unlock()
+
+	e.shutdown()
+	e.wg.Wait()
+
+	e.mu.Lock()
+	e.status.State = StateStopped
+	e.status.Transport = ""
+	e.mu.Unlock()
+	e.notify()
+	return nil
+}
+
+// Status returns the current state and traffic counters.
+func (e *Engine) Status() Status {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.status
+}
+
+func (e *Engine) configureDevice() error {
+	if err := e.cfg.Device.SetAddress(e.address); err != nil {
+		return err
+	}
+	// The address already implies the subnet on most platforms; the explicit route keeps the
+	// overlay pointed at the tunnel even if it overlaps a physical network.
+	return e.cfg.Device.AddRoute(e.subnet)
+}
+
+func (e *Engine) connect(ctx context.Context, keepalive transport.Keepalive) (transport.Conn, error) {
+	if protocol.NormalizeTransport(e.cfg.Answer.Transport) != protocol.TransportUDP {
+		return transport.Dial(ctx, e.cfg.Host, e.cfg.Answer, e.cfg.TLSConfig)
+	}
+	failover := transport.NewFailover(transport.FailoverConfig{
+		Host:          e.cfg.Host,
+		Answer:        e.cfg.Answer,
+		TLSConfig:     e.cfg.TLSConfig,
+		Keepalive:     keepalive,
+		ProbeTimeout:  e.cfg.ProbeTimeout,
+		RetryInterval: e.cfg.RetryInterval,
+		OnSwitch:      e.switched,
+	})
+	if err := failover.Connect(ctx); err != nil {
+		return nil, err
+	}
+	return failover, nil
+}
+
+func announce(conn transport.Conn, keepalive transport.Keepalive) error {
+	ping, err := keepalive.Ping()
+	if err != nil {
+		return err
+	}
+	return conn.Send(ping)
+}
+
+func (e *Engine) switched(active protocol.Transport) {
+	e.mu.Lock()
+	if e.status.State != StateConnected {
+		e.mu.Unlock()
+		return
+	}
+	e.status.Transport = active
+	e.mu.Unlock()
+	e.notify()
+}
+
+// outbound reads packets the operating system routes into the device and sends them sealed.
+func (e *Engine) outbound(sealer *datachannel.Sealer) {
+	defer e.wg.Done()
+	buf := make([]byte, e.cfg.Device.MTU())
+	for {
+		n, err := e.cfg.Device.Read(buf)
+		if err != nil {
+			e.fail(fmt.Errorf("tunnel: read device: %w", err))
+			return
+		}
+		sealed, err := sealer.Seal(buf[:n])
+		if err != nil {
+			e.fail(err)
+			return
+		}
+		if err := e.conn.Send(sealed); err != nil {
+			e.fail(fmt.Errorf("tunnel: send: %w", err))
+			return
+		}
+		e.mu.Lock()
+		e.status.PacketsSent++
+		e.status.BytesSent += uint64(n)
+		e.mu.Unlock()
+	}
+}
+
+// inbound authenticates frames from the server and injects the packets they carry.
+func (e *Engine) inbound(opener *datachannel.Opener, replay *datachannel.ReplayWindow) {
+	defer e.wg.Done()
+	for {
+		raw, err := e.conn.Receive()
+		if err != nil {
+			e.fail(fmt.Errorf("tunnel: receive: %w", err))
+			return
+		}
+		pkt, err := frame.ParseData(raw)
+		if err != nil {
+			e.drop()
+			continue
+		}
+		payload, err := opener.Open(pkt)
+		if err != nil {
+			e.drop()
+			continue
+		}
+		if err := replay.Check(pkt.PacketID); err != nil {
+			e.drop()
+			continue
+		}
+		e.mu.Lock()
+		e.lastHeard = time.Now()
+		e.mu.Unlock()
+		if frame.IsPing(payload) || frame.IsPong(payload) {
+			continue
+		}
+		if _, err := e.cfg.Device.Write(payload); err != nil {
+			e.fail(fmt.Errorf("tunnel: write device: %w", err))
+			return
+		}
+		e.mu.Lock()
+		e.status.PacketsReceived++
+		e.status.BytesReceived += uint64(len(payload))
+		e.mu.Unlock()
+	}
+}
+
+// keepalive pings the server at the room's interval so NAT bindings and the server's return
+// path stay fresh while the game is idle. When nothing has come back for missedKeepalives
+// intervals the path is re-probed, which moves a UDP tunnel over to TCP, and the tunnel fails
+// if no path answers.
+func (e *Engine) keepalive(ctx context.Context, keepalive transport.Keepalive) {
+	defer e.wg.Done()
+	interval := e.cfg.KeepaliveInterval
+	if interval <= 0 {
+		interval = time.Duration(e.cfg.Join.KeepaliveIntervalSec) * time.Second
+	}
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		e.mu.Lock()
+		silence := time.Since(e.lastHeard)
+		e.mu.Unlock()
+		if silence >= missedKeepalives*interval {
+			if err := e.recover(ctx, silence); err != nil {
+				e.fail(err)
+				return
+			}
+		}
+		_ = announce(e.conn, keepalive)
+	}
+}
+
+// recover asks the transport for a working path after the server went quiet.
+func (e *Engine) recover(ctx context.Context, silence time.Duration) error {
+	err := fmt.Errorf("tunnel: no reply from server for %s", silence.Round(time.Second))
+	recoverer, ok := e.conn.(interface{ Recover(context.Context) error })
+	if !ok {
+		return err
+	}
+	if rerr := recoverer.Recover(ctx); rerr != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return fmt.Errorf("%w: %v", err, rerr)
+	}
+	e.mu.Lock()
+	e.lastHeard = time.Now()
+	e.mu.Unlock()
+	return nil
+}
+
+func (e *Engine) drop() {
+	e.mu.Lock()
+	e.status.Dropped++
+	e.mu.Unlock()
+}
+
+// fail records the first error that breaks a loop and tears the tunnel down. Errors caused by
+// Stop closing the device or transport are ignored.
+func (e *Engine) fail(err error) {
+	e.mu.Lock()
+	if e.status.State != StateConnected {
+		e.mu.Unlock()
+		return
+	}
+	e.status.State = StateFailed
+	e.status.Err = err
+	e.status.Transport = ""
+	e.mu.Unlock()
+	e.notify()
+	// The loops call fail themselves, so shutdown must not wait for them here.
+	go e.shutdown()
+}
+
+func (e *Engine) shutdown() {
+	e.mu.Lock()
+	conn, cancel := e.conn, e.cancel
+	if e.status.State == StateConnected {
+		e.status.State = StateStopped
+	}
+	e.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+	if conn != nil {
+		conn.Close()
+	}
+	e.cfg.Device.Close()
+}
+
+// abort records a Start failure and releases the device.
+func (e *Engine) abort(err error) error {
+	e.cfg.Device.Close()
+	e.setState(StateFailed, err)
+	return err
+}
+
+func (e *Engine) setState(state State, err error) {
+	e.mu.Lock()
+	e.status.State = state
+	e.status.Err = err
+	e.mu.Unlock()
+	e.notify()
+}
+
+func (e *Engine) notify() {
+	if e.cfg.OnStatus != nil {
+		e.cfg.OnStatus(e.Status())
+	}
+}
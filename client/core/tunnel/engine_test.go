@@ -0,0 +1,360 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"selfhostgameaccel/client/core/api"
+	"selfhostgameaccel/client/core/tun"
+	"selfhostgameaccel/server/dataplane"
+	"selfhostgameaccel/server/protocol"
+)
+
+type testServer struct {
+	api       *api.Client
+	clientTLS *tls.Config
+	roomID    string
+}
+
+// startServer runs a control plane plus UDP and TLS-over-TCP data planes on loopback and
+// creates one room to join.
+func startServer(t *testing.T) *testServer {
+	t.Helper()
+	server := protocol.NewServer()
+	serverTLS, clientTLS, err := protocol.GenerateTLSConfigs()
+	if err != nil {
+		t.Fatalf("tls: %v", err)
+	}
+	gateway := dataplane.NewGateway(server)
+
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen udp: %v", err)
+	}
+	udp := dataplane.NewUDPListener(packetConn, gateway)
+	go udp.Serve()
+	t.Cleanup(func() { udp.Close() })
+	server.SetDataPlanePort(protocol.TransportUDP, packetConn.LocalAddr().(*net.UDPAddr).Port)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen tcp: %v", err)
+	}
+	server.SetDataPlanePort(protocol.TransportTCP, ln.Addr().(*net.TCPAddr).Port)
+	server.SetDataPlaneTLS(true)
+	tcp := dataplane.NewTCPListener(tls.NewListener(ln, serverTLS), gateway)
+	go tcp.Serve()
+	t.Cleanup(func() { tcp.Close() })
+
+	ts := httptest.NewUnstartedServer(server.Handler())
+	ts.TLS = serverTLS
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+	httpClient := ts.Client()
+	httpClient.Transport.(*http.Transport).TLSClientConfig = clientTLS
+	client, err := api.New(ts.URL, httpClient)
+	if err != nil {
+		t.Fatalf("api client: %v", err)
+	}
+
+	ctx := context.Background()
+	login, err := client.Login(ctx, protocol.LoginRequest{Username: "gamer", Password: "password123"})
+	if err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	room, err := client.CreateRoom(ctx, protocol.CreateRoomRequest{Name: "lan", SessionToken: login.SessionToken})
+	if err != nil {
+		t.Fatalf("create room: %v", err)
+	}
+	return &testServer{api: client, clientTLS: clientTLS, roomID: room.RoomID}
+}
+
+// newEngine logs in from deviceID, joins the room, bootstraps the given transport and builds
+// an engine over a fake device.
+func (s *testServer) newEngine(t *testing.T, deviceID string, transport protocol.Transport) (*Engine, *tun.Fake) {
+	t.Helper()
+	cfg := s.bootstrap(t, deviceID, transport)
+	engine, err := New(cfg)
+	if err != nil {
+		t.Fatalf("engine: %v", err)
+	}
+	t.Cleanup(func() { engine.Stop() })
+	return engine, cfg.Device.(*tun.Fake)
+}
+
+// bootstrap logs in from deviceID, joins the room and bootstraps the given transport,
+// returning an engine config over a fake device.
+func (s *testServer) bootstrap(t *testing.T, deviceID string, transport protocol.Transport) Config {
+	t.Helper()
+	ctx := context.Background()
+	login, err := s.api.Login(ctx, protocol.LoginRequest{Username: "gamer", Password: "password123", DeviceID: deviceID})
+	if err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	join, err := s.api.JoinRoom(ctx, protocol.JoinRoomRequest{RoomID: s.roomID, DeviceID: deviceID, SessionToken: login.SessionToken})
+	if err != nil {
+		t.Fatalf("join: %v", err)
+	}
+	ephemeral, err := protocol.GenerateEphemeralKey()
+	if err != nil {
+		t.Fatalf("ephemeral: %v", err)
+	}
+	answer, err := s.api.BootstrapTunnel(ctx, protocol.TunnelOffer{
+		RoomID:       s.roomID,
+		DeviceID:     deviceID,
+		SessionToken: login.SessionToken,
+		Transport:    transport,
+		EphemeralKey: protocol.EncodeEphemeralKey(ephemeral.PublicKey()),
+	})
+	if err != nil {
+		t.Fatalf("bootstrap: %v", err)
+	}
+	return Config{
+		Host:         "127.0.0.1",
+		Join:         join,
+		Answer:       answer,
+		Ephemeral:    ephemeral,
+		Device:       tun.NewFake(deviceID, 1350),
+		TLSConfig:    s.clientTLS,
+		ProbeTimeout: 500 * time.Millisecond,
+	}
+}
+
+// ipv4Packet builds a minimal IPv4 datagram from src to dst.
+func ipv4Packet(src, dst string, payload string) []byte {
+	packet := make([]byte, 20, 20+len(payload))
+	packet[0] = 0x45
+	from := netip.MustParseAddr(src).As4()
+	to := netip.MustParseAddr(dst).As4()
+	copy(packet[12:16], from[:])
+	copy(packet[16:20], to[:])
+	return append(packet, payload...)
+}
+
+func expectWritten(t *testing.T, dev *tun.Fake, want []byte) {
+	t.Helper()
+	select {
+	case got := <-dev.Written():
+		if !bytes.Equal(got, want) {
+			t.Fatalf("device received %x, want %x", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no packet injected into device")
+	}
+}
+
+func TestEngineRelaysPacketsBetweenMembers(t *testing.T) {
+	server := startServer(t)
+	for _, transport := range []protocol.Transport{protocol.TransportUDP, protocol.TransportTCP} {
+		t.Run(string(transport), func(t *testing.T) {
+			alice, aliceDev := server.newEngine(t, "alice-"+string(transport), transport)
+			bob, bobDev := server.newEngine(t, "bob-"+string(transport), transport)
+			for _, e := range []*Engine{alice, bob} {
+				if err := e.Start(context.Background()); err != nil {
+					t.Fatalf("start: %v", err)
+				}
+				if status := e.Status(); status.State != StateConnected || status.Transport != transport {
+					t.Fatalf("status after start: %+v", status)
+				}
+			}
+
+			// Bob's first packet teaches the gateway his return path.
+			toAlice := ipv4Packet(bob.Status().VirtualIP, alice.Status().VirtualIP, "hello alice")
+			if err := bobDev.Inject(toAlice); err != nil {
+				t.Fatalf("inject: %v", err)
+			}
+			expectWritten(t, aliceDev, toAlice)
+
+			toBob := ipv4Packet(alice.Status().VirtualIP, bob.Status().VirtualIP, "hello bob")
+			if err := aliceDev.Inject(toBob); err != nil {
+				t.Fatalf("inject: %v", err)
+			}
+			expectWritten(t, bobDev, toBob)
+
+			status := alice.Status()
+			if status.PacketsSent != 1 || status.PacketsReceived != 1 || status.BytesReceived != uint64(len(toAlice)) {
+				t.Fatalf("unexpected counters: %+v", status)
+			}
+		})
+	}
+}
+
+func TestEngineConfiguresDevice(t *testing.T) {
+	server := startServer(t)
+	engine, dev := server.newEngine(t, "pc", protocol.TransportUDP)
+	if err := engine.Start(context.Background()); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	status := engine.Status()
+	subnet := netip.MustParsePrefix(status.Subnet)
+	wantAddr := netip.PrefixFrom(netip.MustParseAddr(status.VirtualIP), subnet.Bits())
+	if got := dev.Addresses(); len(got) != 1 || got[0] != wantAddr {
+		t.Fatalf("addresses %v, want %s", got, wantAddr)
+	}
+	if got := dev.Routes(); len(got) != 1 || got[0] != subnet {
+		t.Fatalf("routes %v, want %s", got, subnet)
+	}
+}
+
+func TestEngineStartStop(t *testing.T) {
+	server := startServer(t)
+	var states []State
+	engine, dev := server.newEngine(t, "pc", protocol.TransportTCP)
+	engine.cfg.OnStatus = func(s Status) { states = append(states, s.State) }
+
+	if err := engine.Stop(); !errors.Is(err, ErrNotStarted) {
+		t.Fatalf("stop before start: %v", err)
+	}
+	if err := engine.Start(context.Background()); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	if err := engine.Start(context.Background()); !errors.Is(err, ErrAlreadyStarted) {
+		t.Fatalf("second start: %v", err)
+	}
+	if err := engine.Stop(); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	if err := engine.Stop(); err != nil {
+		t.Fatalf("second stop: %v", err)
+	}
+	if err := engine.Start(context.Background()); !errors.Is(err, ErrAlreadyStarted) {
+		t.Fatalf("start after stop: %v", err)
+	}
+	if status := engine.Status(); status.State != StateStopped || status.Err != nil {
+		t.Fatalf("status after stop: %+v", status)
+	}
+	if err := dev.Inject([]byte{0x45}); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("device should be closed, inject returned %v", err)
+	}
+	want := []State{StateConnecting, StateConnected, StateStopped}
+	if len(states) != len(want) {
+		t.Fatalf("state transitions %v, want %v", states, want)
+	}
+	for i := range want {
+		if states[i] != want[i] {
+			t.Fatalf("state transitions %v, want %v", states, want)
+		}
+	}
+}
+
+func TestEngineEphemeralKeyIsSingleUse(t *testing.T) {
+	server := startServer(t)
+	cfg := server.bootstrap(t, "pc", protocol.TransportTCP)
+	engine, err := New(cfg)
+	if err != nil {
+		t.Fatalf("engine: %v", err)
+	}
+	if engine.cfg.Ephemeral != nil {
+		t.Fatal("engine kept the ephemeral private key")
+	}
+	// A second engine from the same bootstrap would derive the same keys and reuse nonces.
+	cfg.Device = tun.NewFake("pc", 1350)
+	if _, err := New(cfg); !errors.Is(err, ErrEphemeralKeyUsed) {
+		t.Fatalf("second engine from the same key: %v", err)
+	}
+}
+
+func TestEngineReportsUnreachableServer(t *testing.T) {
+	server := startServer(t)
+	engine, _ := server.newEngine(t, "pc", protocol.TransportTCP)
+	engine.cfg.Answer.DataPort = 1
+	if err := engine.Start(context.Background()); err == nil {
+		t.Fatal("expected start to fail")
+	}
+	if status := engine.Status(); status.State != StateFailed || status.Err == nil {
+		t.Fatalf("status after failed start: %+v", status)
+	}
+}
+
+// startBlockableRelay forwards UDP between one client and target until block is called,
+// after which it drops everything, like a network that stops passing UDP mid-session.
+func startBlockableRelay(t *testing.T, target string) (port int, block func()) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen relay: %v", err)
+	}
+	upstream, err := net.Dial("udp", target)
+	if err != nil {
+		t.Fatalf("dial upstream: %v", err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		upstream.Close()
+	})
+	var blocked atomic.Bool
+	var client atomic.Value
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			client.Store(addr)
+			if !blocked.Load() {
+				_, _ = upstream.Write(buf[:n])
+			}
+		}
+	}()
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, err := upstream.Read(buf)
+			if err != nil {
+				return
+			}
+			if addr, ok := client.Load().(net.Addr); ok && !blocked.Load() {
+				_, _ = conn.WriteTo(buf[:n], addr)
+			}
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr).Port, func() { blocked.Store(true) }
+}
+
+func TestEngineFailsOverWhenUDPDiesMidSession(t *testing.T) {
+	server := startServer(t)
+	alice, aliceDev := server.newEngine(t, "alice", protocol.TransportUDP)
+	bob, bobDev := server.newEngine(t, "bob", protocol.TransportTCP)
+	port, block := startBlockableRelay(t, net.JoinHostPort("127.0.0.1", strconv.Itoa(alice.cfg.Answer.DataPort)))
+	alice.cfg.Answer.DataPort = port
+	alice.cfg.KeepaliveInterval = 100 * time.Millisecond
+	alice.cfg.ProbeTimeout = 200 * time.Millisecond
+	alice.cfg.RetryInterval = time.Hour
+	for _, e := range []*Engine{alice, bob} {
+		if err := e.Start(context.Background()); err != nil {
+			t.Fatalf("start: %v", err)
+		}
+	}
+	if got := alice.Status().Transport; got != protocol.TransportUDP {
+		t.Fatalf("alice should start on udp, got %s", got)
+	}
+
+	block()
+	deadline := time.Now().Add(5 * time.Second)
+	for alice.Status().Transport != protocol.TransportTCP {
+		if time.Now().After(deadline) {
+			t.Fatalf("no failover to tcp after udp died: %+v", alice.Status())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if status := alice.Status(); status.State != StateConnected {
+		t.Fatalf("tunnel should stay up after failover: %+v", status)
+	}
+
+	toBob := ipv4Packet(alice.Status().VirtualIP, bob.Status().VirtualIP, "still here")
+	if err := aliceDev.Inject(toBob); err != nil {
+		t.Fatalf("inject: %v", err)
+	}
+	expectWritten(t, bobDev, toBob)
+}
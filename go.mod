@@ -1,3 +1,9 @@
 module selfhostgameaccel
 
 go 1.22
+
+require (
+	golang.org/x/crypto v0.33.0
+	golang.org/x/sys v0.30.0
+)
+
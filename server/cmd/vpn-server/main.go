@@ -2,20 +2,47 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"flag"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
+	"selfhostgameaccel/server/dataplane"
 	"selfhostgameaccel/server/protocol"
 )
 
 func main() {
 	addr := flag.String("addr", ":8443", "listen address for the control plane")
+	tunnelAddr := flag.String("tunnel-addr", ":1194", "UDP listen address for the data plane")
+	tunnelTCPAddr := flag.String("tunnel-tcp-addr", ":1194", "TCP listen address for the data-plane fallback (empty disables it)")
+	tunnelTCPTLS := flag.Bool("tunnel-tcp-tls", true, "wrap the TCP data-plane fallback in TLS")
+	replayWindow := flag.Int("replay-window", 256, "packets tolerated out of order per peer before being treated as replays (64-1024)")
+	broadcastRate := flag.Float64("tunnel-broadcast-rate", dataplane.DefaultBroadcastRate, "broadcast/multicast packets per second relayed within each room (0 disables relay)")
+	broadcastBurst := flag.Int("tunnel-broadcast-burst", dataplane.DefaultBroadcastBurst, "broadcast/multicast packets a room may send above the rate in a burst")
+	multicastGroups := flag.String("tunnel-multicast-groups", "224.0.0.251,224.0.0.252,239.255.255.250", "comma-separated multicast groups relayed within rooms")
+	roomPool := flag.String("room-pool", protocol.DefaultAddressPool, "IPv4 range room subnets are allocated from")
+	roomPrefixLen := flag.Int("room-prefix-len", protocol.DefaultRoomPrefixLen, "prefix length of each room subnet")
+	roomLimit := flag.Int("max-rooms-per-user", protocol.DefaultRoomLimit, "rooms a non-admin user may own (0 restricts creation to admins)")
+	janitorInterval := flag.Duration("room-janitor-interval", time.Minute, "how often idle ephemeral rooms are checked for expiry")
+	argonMemory := flag.Uint("argon2-memory-kib", uint(protocol.DefaultPasswordParams.Memory), "Argon2id memory cost for password hashes, in KiB")
+	argonIterations := flag.Uint("argon2-iterations", uint(protocol.DefaultPasswordParams.Iterations), "Argon2id passes over memory for password hashes")
+	argonParallelism := flag.Uint("argon2-parallelism", uint(protocol.DefaultPasswordParams.Parallelism), "Argon2id lanes for password hashes")
+	sessionIdle := flag.Duration("session-idle-timeout", protocol.DefaultSessionIdleTimeout, "end sessions unused for this long")
+	sessionMaxAge := flag.Duration("session-max-age", protocol.DefaultSessionMaxAge, "end sessions this long after login regardless of use")
+	persistSessions := flag.Bool("persist-sessions", true, "save sessions with -data so logins survive restarts")
+	loginLockoutThreshold := flag.Int("login-lockout-threshold", protocol.DefaultLoginLimits.LockoutThreshold, "failed logins that lock an account")
+	loginLockout := flag.Duration("login-lockout-duration", protocol.DefaultLoginLimits.LockoutDuration, "how long a locked account refuses logins")
+	loginMaxBackoff := flag.Duration("login-max-backoff", protocol.DefaultLoginLimits.MaxDelay, "longest delay imposed between failed logins from one address or for one account")
+	statsInterval := flag.Duration("stats-interval", 5*time.Minute, "how often data-plane replay and routing counters are logged (0 disables)")
 	dataPath := flag.String("data", "", "path to persist server state (JSON)")
 	flag.Parse()
 
@@ -28,6 +55,92 @@ func main() {
 	if err != nil {
 		log.Fatalf("init server: %v", err)
 	}
+	if err := server.SetAddressPool(*roomPool, *roomPrefixLen); err != nil {
+		log.Fatalf("init server: %v", err)
+	}
+	if err := server.SetRoomLimit(*roomLimit); err != nil {
+		log.Fatalf("init server: %v", err)
+	}
+	if err := server.SetSessionLifetime(*sessionIdle, *sessionMaxAge); err != nil {
+		log.Fatalf("init server: %v", err)
+	}
+	if err := server.SetSessionPersistence(*persistSessions); err != nil {
+		log.Fatalf("init server: %v", err)
+	}
+	if *argonParallelism > 255 {
+		log.Fatalf("init server: argon2-parallelism must be at most 255")
+	}
+	passwordParams := protocol.DefaultPasswordParams
+	passwordParams.Memory = uint32(*argonMemory)
+	passwordParams.Iterations = uint32(*argonIterations)
+	passwordParams.Parallelism = uint8(*argonParallelism)
+	if err := server.SetPasswordParams(passwordParams); err != nil {
+		log.Fatalf("init server: %v", err)
+	}
+
+	loginLimits := protocol.DefaultLoginLimits
+	loginLimits.LockoutThreshold = *loginLockoutThreshold
+	loginLimits.LockoutDuration = *loginLockout
+	loginLimits.MaxDelay = *loginMaxBackoff
+	if err := server.SetLoginLimits(loginLimits); err != nil {
+		log.Fatalf("init server: %v", err)
+	}
+
+	stopJanitor := server.StartJanitor(*janitorInterval)
+	defer stopJanitor()
+
+	gateway := dataplane.NewGateway(server)
+	if err := gateway.SetReplayWindow(*replayWindow); err != nil {
+		log.Fatalf("data plane: %v", err)
+	}
+	groups, err := parseMulticastGroups(*multicastGroups)
+	if err != nil {
+		log.Fatalf("data plane: %v", err)
+	}
+	gateway.SetMulticastGroups(groups)
+	gateway.SetBroadcastLimit(*broadcastRate, *broadcastBurst)
+	stopSweeper := gateway.StartSweeper(dataplane.DefaultSweepInterval)
+	defer stopSweeper()
+	if *statsInterval > 0 {
+		go logDataPlaneStats(gateway, *statsInterval)
+	}
+
+	packetConn, err := net.ListenPacket("udp", *tunnelAddr)
+	if err != nil {
+		log.Fatalf("listen data plane: %v", err)
+	}
+	if udpAddr, ok := packetConn.LocalAddr().(*net.UDPAddr); ok {
+		server.SetDataPlanePort(protocol.TransportUDP, udpAddr.Port)
+	}
+	udpTunnels := dataplane.NewUDPListener(packetConn, gateway)
+	go func() {
+		log.Printf("data plane listening on udp://%s", udpTunnels.Addr())
+		if err := udpTunnels.Serve(); err != nil {
+			log.Fatalf("data plane error: %v", err)
+		}
+	}()
+
+	var tcpTunnels *dataplane.TCPListener
+	if *tunnelTCPAddr != "" {
+		ln, err := net.Listen("tcp", *tunnelTCPAddr)
+		if err != nil {
+			log.Fatalf("listen tcp data plane: %v", err)
+		}
+		if tcpAddr, ok := ln.Addr().(*net.TCPAddr); ok {
+			server.SetDataPlanePort(protocol.TransportTCP, tcpAddr.Port)
+		}
+		if *tunnelTCPTLS {
+			ln = tls.NewListener(ln, serverTLS)
+		}
+		server.SetDataPlaneTLS(*tunnelTCPTLS)
+		tcpTunnels = dataplane.NewTCPListener(ln, gateway)
+		go func() {
+			log.Printf("data plane fallback listening on tcp://%s (tls=%t)", tcpTunnels.Addr(), *tunnelTCPTLS)
+			if err := tcpTunnels.Serve(); err != nil {
+				log.Fatalf("tcp data plane error: %v", err)
+			}
+		}()
+	}
 
 	srv := &http.Server{
 		Addr:      *addr,
@@ -53,9 +166,57 @@ func main() {
 	if err := srv.Shutdown(shutdownCtx); err != nil {
 		log.Fatalf("failed to shutdown: %v", err)
 	}
+	if err := udpTunnels.Close(); err != nil {
+		log.Printf("data plane close: %v", err)
+	}
+	if tcpTunnels != nil {
+		if err := tcpTunnels.Close(); err != nil {
+			log.Printf("tcp data plane close: %v", err)
+		}
+	}
 	log.Println("server stopped")
 }
 
+// logDataPlaneStats periodically logs the gateway's replay-window and routing counters, summed
+// over live and retired peers, so replayed or dropped traffic shows up in the server log.
+func logDataPlaneStats(gateway *dataplane.Gateway, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		peers := gateway.ReplayStats()
+		replay := gateway.RetiredReplayStats()
+		for _, st := range peers {
+			replay.Accepted += st.Accepted
+			replay.Reordered += st.Reordered
+			replay.Duplicates += st.Duplicates
+			replay.TooOld += st.TooOld
+		}
+		route := gateway.RouteStats()
+		log.Printf("data plane: peers=%d accepted=%d reordered=%d duplicates=%d too_old=%d forwarded=%d broadcast=%d spoofed=%d no_route=%d filtered=%d rate_limited=%d malformed=%d",
+			len(peers), replay.Accepted, replay.Reordered, replay.Duplicates, replay.TooOld,
+			route.Forwarded, route.Broadcast, route.Spoofed, route.NoRoute, route.Filtered, route.RateLimited, route.Malformed)
+	}
+}
+
+func parseMulticastGroups(raw string) ([]netip.Addr, error) {
+	var groups []netip.Addr
+	for _, field := range strings.Split(raw, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		group, err := netip.ParseAddr(field)
+		if err != nil {
+			return nil, fmt.Errorf("multicast group %q: %w", field, err)
+		}
+		if !group.IsMulticast() {
+			return nil, fmt.Errorf("%s is not a multicast address", group)
+		}
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
+
 func resolveDataPath(raw string) string {
 	if raw == "" {
 		return ""
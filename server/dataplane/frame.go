@@ -0,0 +1,27 @@
+package dataplane
+
+import "net/netip"
+
+// maxFrameSize bounds a single datagram; it comfortably fits any MTU a room may choose.
+const maxFrameSize = 65535
+
+// packetAddrs extracts the source and destination addresses of an IPv4 or IPv6 packet.
+func packetAddrs(packet []byte) (src, dst netip.Addr, ok bool) {
+	if len(packet) == 0 {
+		return netip.Addr{}, netip.Addr{}, false
+	}
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < 20 {
+			return netip.Addr{}, netip.Addr{}, false
+		}
+		return netip.AddrFrom4([4]byte(packet[12:16])), netip.AddrFrom4([4]byte(packet[16:20])), true
+	case 6:
+		if len(packet) < 40 {
+			return netip.Addr{}, netip.Addr{}, false
+		}
+		return netip.AddrFrom16([16]byte(packet[8:24])), netip.AddrFrom16([16]byte(packet[24:40])), true
+	default:
+		return netip.Addr{}, netip.Addr{}, false
+	}
+}
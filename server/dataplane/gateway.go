@@ -0,0 +1,307 @@
+// Package dataplane carries tunneled IP packets between the members of a room.
+package dataplane
+
+import (
+	"bytes"
+	"net/netip"
+	"sync"
+	"time"
+
+	"selfhostgameaccel/server/protocol"
+	"selfhostgameaccel/server/protocol/datachannel"
+	"selfhostgameaccel/server/protocol/frame"
+)
+
+// SessionResolver looks up the data-plane credentials issued when a device joins a room.
+// protocol.Server satisfies it.
+type SessionResolver interface {
+	LookupTunnelSession(peerID uint32) (protocol.TunnelSession, bool)
+}
+
+// activityRecorder is implemented by resolvers that track when devices were last active;
+// protocol.Server uses it for membership last-seen times.
+type activityRecorder interface {
+	MarkTunnelSeen(peerID uint32, at time.Time)
+}
+
+// seenInterval throttles how often a busy peer's activity is reported to the resolver.
+const seenInterval = 30 * time.Second
+
+// DefaultSweepInterval is how often StartSweeper checks peers against the resolver.
+const DefaultSweepInterval = 30 * time.Second
+
+// link is the path back to a peer over whichever transport its last frame arrived on.
+type link interface {
+	send(frame []byte) error
+}
+
+type peer struct {
+	session   protocol.TunnelSession
+	virtualIP netip.Addr
+	sealer    *datachannel.Sealer
+	opener    *datachannel.Opener
+	replay    *datachannel.ReplayWindow
+	link      link
+	lastSeen  time.Time
+}
+
+// Gateway authenticates frames from joined devices and forwards the IP packets they carry to
+// other members of the same room, as decided by its Router. Transport listeners feed it frames;
+// a peer is reachable over the transport it most recently sent from, so UDP and TCP members
+// share a room transparently.
+type Gateway struct {
+	resolver SessionResolver
+	router   *Router
+
+	mu           sync.Mutex
+	peers        map[uint32]*peer
+	replayWidth  int
+	retiredStats datachannel.ReplayStats
+}
+
+func NewGateway(resolver SessionResolver) *Gateway {
+	return &Gateway{
+		resolver:    resolver,
+		router:      NewRouter(),
+		peers:       map[uint32]*peer{},
+		replayWidth: datachannel.DefaultReplayWindow,
+	}
+}
+
+// SetReplayWindow sets how many packet IDs each peer's replay window tolerates. It applies to
+// peers whose keys are installed afterwards.
+func (g *Gateway) SetReplayWindow(width int) error {
+	if _, err := datachannel.NewReplayWindow(width); err != nil {
+		return err
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.replayWidth = width
+	return nil
+}
+
+// SetBroadcastLimit caps how many broadcast and multicast packets per second each room relays.
+func (g *Gateway) SetBroadcastLimit(rate float64, burst int) {
+	g.router.SetBroadcastLimit(rate, burst)
+}
+
+// SetMulticastGroups selects the multicast groups relayed to every member of a room.
+func (g *Gateway) SetMulticastGroups(groups []netip.Addr) {
+	g.router.SetMulticastGroups(groups)
+}
+
+// ReplayStats returns the replay-window counters of every active peer, keyed by peer ID.
+func (g *Gateway) ReplayStats() map[uint32]datachannel.ReplayStats {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	stats := make(map[uint32]datachannel.ReplayStats, len(g.peers))
+	for id, p := range g.peers {
+		stats[id] = p.replay.Stats()
+	}
+	return stats
+}
+
+// RouteStats returns the router's forwarding and drop counters.
+func (g *Gateway) RouteStats() RouteStats {
+	return g.router.Stats()
+}
+
+// RetiredReplayStats returns the summed counters of peers that have since been revoked or re-keyed.
+func (g *Gateway) RetiredReplayStats() datachannel.ReplayStats {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.retiredStats
+}
+
+func (g *Gateway) handleFrame(raw []byte, from link) {
+	pkt, err := frame.ParseData(raw)
+	if err != nil {
+		return
+	}
+	src, ok := g.authorizedPeer(pkt.PeerID)
+	if !ok {
+		return
+	}
+	packet, err := src.opener.Open(pkt)
+	if err != nil {
+		return
+	}
+	if err := src.replay.Check(pkt.PacketID); err != nil {
+		return
+	}
+
+	now := time.Now()
+	g.mu.Lock()
+	src.link = from
+	report := now.Sub(src.lastSeen) >= seenInterval
+	src.lastSeen = now
+	g.mu.Unlock()
+	if recorder, ok := g.resolver.(activityRecorder); ok && report {
+		recorder.MarkTunnelSeen(src.session.PeerID, now)
+	}
+
+	// Pings only refresh the sender's endpoint; answering lets the client confirm the path.
+	if frame.IsPing(packet) {
+		g.send(src, frame.PongPayload())
+		return
+	}
+	targets, err := g.router.Route(src.session.PeerID, packet)
+	if err != nil {
+		return
+	}
+	for _, id := range targets {
+		if target, ok := g.reachablePeer(id); ok {
+			g.send(target, packet)
+		}
+	}
+}
+
+// detach forgets a link that can no longer carry frames, such as a closed TCP connection.
+func (g *Gateway) detach(l link) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, p := range g.peers {
+		if p.link == l {
+			p.link = nil
+		}
+	}
+}
+
+func (g *Gateway) send(target *peer, payload []byte) {
+	g.mu.Lock()
+	to := target.link
+	g.mu.Unlock()
+	if to == nil {
+		return
+	}
+	out, err := target.sealer.Seal(payload)
+	if err != nil {
+		return
+	}
+	_ = to.send(out)
+}
+
+// authorizedPeer returns the cached state for peerID after confirming the control plane still
+// honours its session, so revoked sessions stop working immediately and a new bootstrap
+// switches the peer to fresh keys.
+func (g *Gateway) authorizedPeer(peerID uint32) (*peer, bool) {
+	session, ok := g.resolver.LookupTunnelSession(peerID)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	cached, hasCached := g.peers[peerID]
+	if !ok || !session.Bootstrapped() {
+		if hasCached {
+			g.retirePeerLocked(peerID, cached)
+		}
+		return nil, false
+	}
+	if hasCached {
+		if sameKeys(cached.session, session) {
+			return cached, true
+		}
+		g.retirePeerLocked(peerID, cached)
+	}
+	keys, err := datachannel.SessionKeys(session)
+	if err != nil {
+		return nil, false
+	}
+	sealer, err := datachannel.NewSealer(keys.Suite, keys.Send(datachannel.RoleServer), peerID, 0)
+	if err != nil {
+		return nil, false
+	}
+	opener, err := datachannel.NewOpener(keys.Suite, keys.Receive(datachannel.RoleServer))
+	if err != nil {
+		return nil, false
+	}
+	replay, err := datachannel.NewReplayWindow(g.replayWidth)
+	if err != nil {
+		return nil, false
+	}
+	virtualIP, err := netip.ParseAddr(session.VirtualIP)
+	if err != nil {
+		return nil, false
+	}
+	p := &peer{session: session, virtualIP: virtualIP, sealer: sealer, opener: opener, replay: replay}
+	g.peers[peerID] = p
+	// A missing subnet only disables subnet-directed broadcasts; 255.255.255.255 still works.
+	subnet, _ := netip.ParsePrefix(session.Subnet)
+	g.router.Add(peerID, session.RoomID, virtualIP, subnet)
+	return p, true
+}
+
+// Sweep retires peers whose tunnel sessions the control plane no longer honours, so members
+// who left, were kicked or whose room expired stop being routable even if they never send
+// again. It returns how many peers were retired.
+func (g *Gateway) Sweep() int {
+	g.mu.Lock()
+	ids := make([]uint32, 0, len(g.peers))
+	for id := range g.peers {
+		ids = append(ids, id)
+	}
+	g.mu.Unlock()
+
+	retired := 0
+	for _, id := range ids {
+		session, ok := g.resolver.LookupTunnelSession(id)
+		g.mu.Lock()
+		if cached, has := g.peers[id]; has && (!ok || !session.Bootstrapped() || !sameKeys(cached.session, session)) {
+			g.retirePeerLocked(id, cached)
+			retired++
+		}
+		g.mu.Unlock()
+	}
+	return retired
+}
+
+// StartSweeper calls Sweep every interval until the returned stop function is called.
+func (g *Gateway) StartSweeper(interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				g.Sweep()
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+func (g *Gateway) retirePeerLocked(peerID uint32, p *peer) {
+	stats := p.replay.Stats()
+	g.retiredStats.Accepted += stats.Accepted
+	g.retiredStats.Reordered += stats.Reordered
+	g.retiredStats.Duplicates += stats.Duplicates
+	g.retiredStats.TooOld += stats.TooOld
+	delete(g.peers, peerID)
+	g.router.Remove(peerID)
+}
+
+func sameKeys(a, b protocol.TunnelSession) bool {
+	return a.CipherSuite == b.CipherSuite && bytes.Equal(a.Key, b.Key) &&
+		bytes.Equal(a.SharedSecret, b.SharedSecret) && bytes.Equal(a.AnswerKey, b.AnswerKey)
+}
+
+// reachablePeer returns the routed peer if it has a link and its session is still current.
+func (g *Gateway) reachablePeer(peerID uint32) (*peer, bool) {
+	g.mu.Lock()
+	target, ok := g.peers[peerID]
+	if ok && target.link == nil {
+		ok = false
+	}
+	g.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	current, ok := g.authorizedPeer(peerID)
+	if !ok || current != target {
+		return nil, false
+	}
+	return target, true
+}
@@ -0,0 +1,390 @@
+package dataplane
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"selfhostgameaccel/server/protocol"
+	"selfhostgameaccel/server/protocol/datachannel"
+	"selfhostgameaccel/server/protocol/frame"
+)
+
+type staticResolver struct {
+	mu       sync.Mutex
+	sessions map[uint32]protocol.TunnelSession
+}
+
+func newStaticResolver(sessions ...protocol.TunnelSession) *staticResolver {
+	r := &staticResolver{sessions: map[uint32]protocol.TunnelSession{}}
+	for _, s := range sessions {
+		r.sessions[s.PeerID] = s
+	}
+	return r
+}
+
+func (r *staticResolver) LookupTunnelSession(peerID uint32) (protocol.TunnelSession, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.sessions[peerID]
+	return s, ok
+}
+
+func (r *staticResolver) revoke(peerID uint32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.sessions, peerID)
+}
+
+// bootstrappedSession builds a tunnel session as if the device had joined and completed
+// /tunnel/bootstrap.
+func bootstrappedSession(peerID uint32, roomID, virtualIP string) protocol.TunnelSession {
+	return protocol.TunnelSession{
+		PeerID:       peerID,
+		RoomID:       roomID,
+		DeviceID:     fmt.Sprintf("device-%d", peerID),
+		VirtualIP:    virtualIP,
+		Key:          []byte(fmt.Sprintf("session-key-%d", peerID)),
+		CipherSuite:  protocol.CipherSuiteAES256GCM,
+		SharedSecret: []byte(fmt.Sprintf("shared-%d", peerID)),
+		OfferKey:     []byte("offer"),
+		AnswerKey:    []byte("answer"),
+	}
+}
+
+// testConn is the client side of one data-plane transport.
+type testConn interface {
+	write(raw []byte) error
+	read(timeout time.Duration) ([]byte, error)
+}
+
+type udpTestConn struct {
+	conn   net.PacketConn
+	server net.Addr
+}
+
+func (u udpTestConn) write(raw []byte) error {
+	_, err := u.conn.WriteTo(raw, u.server)
+	return err
+}
+
+func (u udpTestConn) read(timeout time.Duration) ([]byte, error) {
+	buf := make([]byte, maxFrameSize)
+	_ = u.conn.SetReadDeadline(time.Now().Add(timeout))
+	n, _, err := u.conn.ReadFrom(buf)
+	return buf[:n], err
+}
+
+type testPeer struct {
+	t      *testing.T
+	conn   testConn
+	id     uint32
+	sealer *datachannel.Sealer
+	opener *datachannel.Opener
+}
+
+func newTestPeer(t *testing.T, server net.Addr, session protocol.TunnelSession) *testPeer {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return newTestPeerOver(t, udpTestConn{conn: conn, server: server}, session)
+}
+
+func newTestPeerOver(t *testing.T, conn testConn, session protocol.TunnelSession) *testPeer {
+	t.Helper()
+	keys, err := datachannel.SessionKeys(session)
+	if err != nil {
+		t.Fatalf("keys: %v", err)
+	}
+	sealer, _ := datachannel.NewSealer(keys.Suite, keys.Send(datachannel.RoleClient), session.PeerID, 0)
+	opener, _ := datachannel.NewOpener(keys.Suite, keys.Receive(datachannel.RoleClient))
+	return &testPeer{t: t, conn: conn, id: session.PeerID, sealer: sealer, opener: opener}
+}
+
+// send seals payload, writes it to the server and returns the raw frame for replay tests.
+func (p *testPeer) send(payload []byte) []byte {
+	p.t.Helper()
+	raw, err := p.sealer.Seal(payload)
+	if err != nil {
+		p.t.Fatalf("seal: %v", err)
+	}
+	p.sendRaw(raw)
+	return raw
+}
+
+func (p *testPeer) sendRaw(raw []byte) {
+	p.t.Helper()
+	if err := p.conn.write(raw); err != nil {
+		p.t.Fatalf("write: %v", err)
+	}
+}
+
+func (p *testPeer) receive(timeout time.Duration) ([]byte, bool) {
+	p.t.Helper()
+	raw, err := p.conn.read(timeout)
+	if err != nil {
+		return nil, false
+	}
+	pkt, err := frame.ParseData(raw)
+	if err != nil {
+		p.t.Fatalf("parse: %v", err)
+	}
+	packet, err := p.opener.Open(pkt)
+	if err != nil {
+		p.t.Fatalf("open: %v", err)
+	}
+	return packet, true
+}
+
+func startListener(t *testing.T, resolver SessionResolver) *UDPListener {
+	t.Helper()
+	return startUDPListener(t, NewGateway(resolver))
+}
+
+func startUDPListener(t *testing.T, gateway *Gateway) *UDPListener {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	l := NewUDPListener(conn, gateway)
+	go l.Serve()
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func ipv4Packet(src, dst [4]byte, body string) []byte {
+	packet := make([]byte, 20+len(body))
+	packet[0] = 0x45
+	packet[8] = 64
+	packet[9] = 17
+	copy(packet[12:16], src[:])
+	copy(packet[16:20], dst[:])
+	copy(packet[20:], body)
+	return packet
+}
+
+// registerEndpoint pings the listener and waits for the pong, which means the sender's
+// address has been learned.
+func registerEndpoint(t *testing.T, p *testPeer) {
+	t.Helper()
+	p.send(frame.PingPayload())
+	got, ok := p.receive(time.Second)
+	if !ok || !frame.IsPong(got) {
+		t.Fatalf("peer %d did not get a pong", p.id)
+	}
+}
+
+func TestForwardsPacketsWithinRoom(t *testing.T) {
+	alice := bootstrappedSession(1, "room-1", "10.0.1.2")
+	bob := bootstrappedSession(2, "room-1", "10.0.1.3")
+	l := startListener(t, newStaticResolver(alice, bob))
+
+	a := newTestPeer(t, l.Addr(), alice)
+	b := newTestPeer(t, l.Addr(), bob)
+	registerEndpoint(t, a)
+	registerEndpoint(t, b)
+
+	packet := ipv4Packet([4]byte{10, 0, 1, 2}, [4]byte{10, 0, 1, 3}, "hello bob")
+	a.send(packet)
+	got, ok := b.receive(time.Second)
+	if !ok {
+		t.Fatalf("bob did not receive forwarded packet")
+	}
+	if string(got) != string(packet) {
+		t.Fatalf("payload mismatch: %q", got)
+	}
+}
+
+func TestRoomsAreIsolated(t *testing.T) {
+	// Both rooms hand out the same addresses, as independent overlays may.
+	alice := bootstrappedSession(1, "room-1", "10.0.1.2")
+	bob := bootstrappedSession(2, "room-1", "10.0.1.3")
+	carol := bootstrappedSession(3, "room-2", "10.0.1.2")
+	dave := bootstrappedSession(4, "room-2", "10.0.1.3")
+	l := startListener(t, newStaticResolver(alice, bob, carol, dave))
+
+	a := newTestPeer(t, l.Addr(), alice)
+	b := newTestPeer(t, l.Addr(), bob)
+	c := newTestPeer(t, l.Addr(), carol)
+	d := newTestPeer(t, l.Addr(), dave)
+	for _, p := range []*testPeer{a, b, c, d} {
+		registerEndpoint(t, p)
+	}
+
+	a.send(ipv4Packet([4]byte{10, 0, 1, 2}, [4]byte{10, 0, 1, 3}, "room-1 only"))
+	if got, ok := b.receive(time.Second); !ok || string(got[20:]) != "room-1 only" {
+		t.Fatalf("bob did not receive his room's packet")
+	}
+	if _, ok := d.receive(100 * time.Millisecond); ok {
+		t.Fatalf("packet leaked into room-2")
+	}
+
+	c.send(ipv4Packet([4]byte{10, 0, 1, 2}, [4]byte{10, 0, 1, 3}, "room-2 only"))
+	if got, ok := d.receive(time.Second); !ok || string(got[20:]) != "room-2 only" {
+		t.Fatalf("dave did not receive his room's packet")
+	}
+	if _, ok := b.receive(100 * time.Millisecond); ok {
+		t.Fatalf("packet leaked into room-1")
+	}
+}
+
+func TestRelaysBroadcastToRoomOnly(t *testing.T) {
+	var sessions []protocol.TunnelSession
+	for i, ip := range []string{"10.0.1.2", "10.0.1.3", "10.0.1.4"} {
+		s := bootstrappedSession(uint32(i+1), "room-1", ip)
+		s.Subnet = "10.0.1.0/24"
+		sessions = append(sessions, s)
+	}
+	outsider := bootstrappedSession(4, "room-2", "10.0.1.5")
+	outsider.Subnet = "10.0.1.0/24"
+	l := startListener(t, newStaticResolver(append(sessions, outsider)...))
+
+	var peers []*testPeer
+	for _, s := range append(sessions, outsider) {
+		p := newTestPeer(t, l.Addr(), s)
+		registerEndpoint(t, p)
+		peers = append(peers, p)
+	}
+
+	for _, dst := range [][4]byte{{255, 255, 255, 255}, {10, 0, 1, 255}, {239, 255, 255, 250}} {
+		packet := ipv4Packet([4]byte{10, 0, 1, 2}, dst, "who is hosting?")
+		peers[0].send(packet)
+		for _, p := range peers[1:3] {
+			if got, ok := p.receive(time.Second); !ok || string(got) != string(packet) {
+				t.Fatalf("peer %d missed broadcast to %v", p.id, dst)
+			}
+		}
+		if _, ok := peers[0].receive(100 * time.Millisecond); ok {
+			t.Fatalf("broadcast echoed back to its sender")
+		}
+		if _, ok := peers[3].receive(100 * time.Millisecond); ok {
+			t.Fatalf("broadcast leaked into another room")
+		}
+	}
+}
+
+func TestDropsSpoofedSourceAddress(t *testing.T) {
+	alice := bootstrappedSession(1, "room-1", "10.0.1.2")
+	bob := bootstrappedSession(2, "room-1", "10.0.1.3")
+	carol := bootstrappedSession(3, "room-1", "10.0.1.4")
+	l := startListener(t, newStaticResolver(alice, bob, carol))
+
+	a := newTestPeer(t, l.Addr(), alice)
+	b := newTestPeer(t, l.Addr(), bob)
+	registerEndpoint(t, a)
+	registerEndpoint(t, b)
+
+	a.send(ipv4Packet([4]byte{10, 0, 1, 4}, [4]byte{10, 0, 1, 3}, "pretending to be carol"))
+	if _, ok := b.receive(100 * time.Millisecond); ok {
+		t.Fatalf("packet with a spoofed source was forwarded")
+	}
+	if stats := l.gateway.RouteStats(); stats.Spoofed != 1 || stats.Forwarded != 0 {
+		t.Fatalf("unexpected route stats: %+v", stats)
+	}
+}
+
+func TestDropsFramesWithWrongKeyOrRevokedSession(t *testing.T) {
+	alice := bootstrappedSession(1, "room-1", "10.0.1.2")
+	bob := bootstrappedSession(2, "room-1", "10.0.1.3")
+	resolver := newStaticResolver(alice, bob)
+	l := startListener(t, resolver)
+
+	b := newTestPeer(t, l.Addr(), bob)
+	registerEndpoint(t, b)
+
+	forged := alice
+	forged.SharedSecret = []byte("guessed-secret")
+	mallory := newTestPeer(t, l.Addr(), forged)
+	mallory.send(ipv4Packet([4]byte{10, 0, 1, 2}, [4]byte{10, 0, 1, 3}, "forged"))
+	if _, ok := b.receive(100 * time.Millisecond); ok {
+		t.Fatalf("frame sealed with the wrong key was forwarded")
+	}
+
+	a := newTestPeer(t, l.Addr(), alice)
+	registerEndpoint(t, a)
+	resolver.revoke(alice.PeerID)
+	a.send(ipv4Packet([4]byte{10, 0, 1, 2}, [4]byte{10, 0, 1, 3}, "after revoke"))
+	if _, ok := b.receive(100 * time.Millisecond); ok {
+		t.Fatalf("frame from revoked session was forwarded")
+	}
+}
+
+func TestSweepRetiresRevokedPeersWithoutTraffic(t *testing.T) {
+	alice := bootstrappedSession(1, "room-1", "10.0.1.2")
+	bob := bootstrappedSession(2, "room-1", "10.0.1.3")
+	resolver := newStaticResolver(alice, bob)
+	l := startListener(t, resolver)
+
+	a := newTestPeer(t, l.Addr(), alice)
+	b := newTestPeer(t, l.Addr(), bob)
+	registerEndpoint(t, a)
+	registerEndpoint(t, b)
+
+	if retired := l.gateway.Sweep(); retired != 0 {
+		t.Fatalf("sweep retired %d peers with current sessions", retired)
+	}
+	resolver.revoke(bob.PeerID)
+	if retired := l.gateway.Sweep(); retired != 1 {
+		t.Fatalf("sweep retired %d peers, want 1", retired)
+	}
+
+	l.gateway.mu.Lock()
+	_, cached := l.gateway.peers[bob.PeerID]
+	l.gateway.mu.Unlock()
+	l.gateway.router.mu.Lock()
+	_, routed := l.gateway.router.peers[bob.PeerID]
+	l.gateway.router.mu.Unlock()
+	if cached || routed {
+		t.Fatalf("revoked peer still known to the gateway: cached=%v routed=%v", cached, routed)
+	}
+	if _, ok := l.gateway.ReplayStats()[alice.PeerID]; !ok {
+		t.Fatalf("sweep retired a peer whose session is still current")
+	}
+	if got := l.gateway.RetiredReplayStats().Accepted; got != 1 {
+		t.Fatalf("retired peer's counters were not kept: accepted %d", got)
+	}
+}
+
+func TestDropsFramesBeforeBootstrap(t *testing.T) {
+	pending := bootstrappedSession(1, "room-1", "10.0.1.2")
+	pending.SharedSecret = nil
+	l := startListener(t, newStaticResolver(pending))
+
+	client := pending
+	client.SharedSecret = []byte("client-only-secret")
+	p := newTestPeer(t, l.Addr(), client)
+	p.send(frame.PingPayload())
+	if _, ok := p.receive(100 * time.Millisecond); ok {
+		t.Fatalf("session without a completed bootstrap must not get a pong")
+	}
+}
+
+func TestDropsReplayedFrames(t *testing.T) {
+	alice := bootstrappedSession(1, "room-1", "10.0.1.2")
+	bob := bootstrappedSession(2, "room-1", "10.0.1.3")
+	l := startListener(t, newStaticResolver(alice, bob))
+
+	a := newTestPeer(t, l.Addr(), alice)
+	b := newTestPeer(t, l.Addr(), bob)
+	registerEndpoint(t, a)
+	registerEndpoint(t, b)
+
+	raw := a.send(ipv4Packet([4]byte{10, 0, 1, 2}, [4]byte{10, 0, 1, 3}, "once"))
+	if _, ok := b.receive(time.Second); !ok {
+		t.Fatalf("original packet was not forwarded")
+	}
+	a.sendRaw(raw)
+	if _, ok := b.receive(100 * time.Millisecond); ok {
+		t.Fatalf("replayed frame was forwarded")
+	}
+	stats := l.gateway.ReplayStats()[alice.PeerID]
+	if stats.Duplicates != 1 || stats.Accepted != 2 {
+		t.Fatalf("unexpected replay stats: %+v", stats)
+	}
+}
@@ -0,0 +1,236 @@
+package dataplane
+
+import (
+	"errors"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUnknownPeer     = errors.New("dataplane: peer has no route entry")
+	ErrMalformedPacket = errors.New("dataplane: not an IPv4 or IPv6 packet")
+	ErrSpoofedSource   = errors.New("dataplane: source address does not belong to sender")
+	ErrNoRoute         = errors.New("dataplane: destination is not a member of the sender's room")
+	ErrGroupNotRelayed = errors.New("dataplane: multicast group is not relayed")
+	ErrRateLimited     = errors.New("dataplane: room broadcast rate exceeded")
+)
+
+const (
+	// DefaultBroadcastRate is how many broadcast or multicast packets per second a room may
+	// relay; discovery protocols typically announce once a second per member.
+	DefaultBroadcastRate = 50
+	// DefaultBroadcastBurst lets a room briefly exceed the rate, e.g. when everyone starts
+	// searching for games at once.
+	DefaultBroadcastBurst = 100
+)
+
+// DefaultMulticastGroups are the discovery groups LAN games and consoles commonly use:
+// mDNS, LLMNR and SSDP.
+var DefaultMulticastGroups = []netip.Addr{
+	netip.MustParseAddr("224.0.0.251"),
+	netip.MustParseAddr("224.0.0.252"),
+	netip.MustParseAddr("239.255.255.250"),
+}
+
+// RouteStats counts routing decisions across all rooms.
+type RouteStats struct {
+	Forwarded   uint64
+	Broadcast   uint64
+	Spoofed     uint64
+	NoRoute     uint64
+	Filtered    uint64
+	RateLimited uint64
+	Malformed   uint64
+}
+
+type routeEntry struct {
+	roomID string
+	addr   netip.Addr
+}
+
+// roomTable is one room's view of the overlay.
+type roomTable struct {
+	members   map[netip.Addr]uint32
+	broadcast netip.Addr
+	// tokens and refilled implement the room's broadcast token bucket.
+	tokens   float64
+	refilled time.Time
+}
+
+// Router maps each room's virtual IPs to the peers holding them. Every room has its own
+// table, so a lookup can only ever resolve to members of the sender's room, and a sender may
+// only use the address it was assigned. Broadcasts and relayed multicast groups are
+// replicated to every other member of the room, within a per-room rate limit.
+type Router struct {
+	mu     sync.Mutex
+	rooms  map[string]*roomTable
+	peers  map[uint32]routeEntry
+	groups map[netip.Addr]bool
+	rate   float64
+	burst  float64
+	stats  RouteStats
+	now    func() time.Time
+}
+
+func NewRouter() *Router {
+	r := &Router{
+		rooms: map[string]*roomTable{},
+		peers: map[uint32]routeEntry{},
+		rate:  DefaultBroadcastRate,
+		burst: DefaultBroadcastBurst,
+		now:   time.Now,
+	}
+	r.SetMulticastGroups(DefaultMulticastGroups)
+	return r
+}
+
+// SetBroadcastLimit sets the per-room broadcast rate in packets per second and the burst
+// allowed above it. A non-positive rate disables broadcast and multicast relay entirely.
+func (r *Router) SetBroadcastLimit(rate float64, burst int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if burst < 1 {
+		burst = 1
+	}
+	r.rate = rate
+	r.burst = float64(burst)
+	for _, table := range r.rooms {
+		table.tokens = min(table.tokens, r.burst)
+	}
+}
+
+// SetMulticastGroups replaces the set of multicast groups relayed inside rooms.
+func (r *Router) SetMulticastGroups(groups []netip.Addr) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.groups = make(map[netip.Addr]bool, len(groups))
+	for _, g := range groups {
+		r.groups[g] = true
+	}
+}
+
+// Add assigns addr in roomID to peerID, replacing any previous entry for either. subnet is the
+// room's overlay subnet; its broadcast address is relayed like 255.255.255.255.
+func (r *Router) Add(peerID uint32, roomID string, addr netip.Addr, subnet netip.Prefix) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.removeLocked(peerID)
+	table, ok := r.rooms[roomID]
+	if !ok {
+		table = &roomTable{members: map[netip.Addr]uint32{}, tokens: r.burst, refilled: r.now()}
+		r.rooms[roomID] = table
+	}
+	if subnet.IsValid() && subnet.Addr().Is4() {
+		table.broadcast = broadcastAddr(subnet)
+	}
+	if previous, taken := table.members[addr]; taken {
+		delete(r.peers, previous)
+	}
+	table.members[addr] = peerID
+	r.peers[peerID] = routeEntry{roomID: roomID, addr: addr}
+}
+
+// Remove forgets peerID's address.
+func (r *Router) Remove(peerID uint32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.removeLocked(peerID)
+}
+
+func (r *Router) removeLocked(peerID uint32) {
+	entry, ok := r.peers[peerID]
+	if !ok {
+		return
+	}
+	delete(r.peers, peerID)
+	table := r.rooms[entry.roomID]
+	if table.members[entry.addr] == peerID {
+		delete(table.members, entry.addr)
+	}
+	if len(table.members) == 0 {
+		delete(r.rooms, entry.roomID)
+	}
+}
+
+// Route returns the peers a packet sent by peerID should be delivered to: the one member
+// holding a unicast destination, or every other member for broadcasts and relayed multicast.
+// Packets whose source address is not the sender's, or whose destination is outside the
+// sender's room, are refused.
+func (r *Router) Route(peerID uint32, packet []byte) ([]uint32, error) {
+	src, dst, ok := packetAddrs(packet)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry, known := r.peers[peerID]
+	switch {
+	case !known:
+		return nil, ErrUnknownPeer
+	case !ok:
+		r.stats.Malformed++
+		return nil, ErrMalformedPacket
+	case src != entry.addr:
+		r.stats.Spoofed++
+		return nil, ErrSpoofedSource
+	}
+	table := r.rooms[entry.roomID]
+	if dst.IsMulticast() || dst == netip.AddrFrom4([4]byte{255, 255, 255, 255}) || dst == table.broadcast {
+		return r.fanOutLocked(table, peerID, dst)
+	}
+	target, found := table.members[dst]
+	if !found || target == peerID {
+		r.stats.NoRoute++
+		return nil, ErrNoRoute
+	}
+	r.stats.Forwarded++
+	return []uint32{target}, nil
+}
+
+func (r *Router) fanOutLocked(table *roomTable, sender uint32, dst netip.Addr) ([]uint32, error) {
+	if dst.IsMulticast() && !r.groups[dst] {
+		r.stats.Filtered++
+		return nil, ErrGroupNotRelayed
+	}
+	if !r.takeTokenLocked(table) {
+		r.stats.RateLimited++
+		return nil, ErrRateLimited
+	}
+	targets := make([]uint32, 0, len(table.members)-1)
+	for _, id := range table.members {
+		if id != sender {
+			targets = append(targets, id)
+		}
+	}
+	r.stats.Broadcast++
+	return targets, nil
+}
+
+// takeTokenLocked refills the room's bucket for the time elapsed and spends one token.
+func (r *Router) takeTokenLocked(table *roomTable) bool {
+	if r.rate <= 0 {
+		return false
+	}
+	now := r.now()
+	table.tokens = min(r.burst, table.tokens+now.Sub(table.refilled).Seconds()*r.rate)
+	table.refilled = now
+	if table.tokens < 1 {
+		return false
+	}
+	table.tokens--
+	return true
+}
+
+// Stats returns the routing counters.
+func (r *Router) Stats() RouteStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stats
+}
+
+func broadcastAddr(subnet netip.Prefix) netip.Addr {
+	ip := subnet.Masked().Addr().As4()
+	for i := subnet.Bits(); i < 32; i++ {
+		ip[i/8] |= 0x80 >> (i % 8)
+	}
+	return netip.AddrFrom4(ip)
+}
@@ -0,0 +1,193 @@
+package dataplane
+
+import (
+	"errors"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+)
+
+var subnet1 = netip.MustParsePrefix("10.0.1.0/24")
+
+func addr(s string) netip.Addr {
+	return netip.MustParseAddr(s)
+}
+
+// expectTargets checks that got holds exactly want, in any order.
+func expectTargets(t *testing.T, got []uint32, want ...uint32) {
+	t.Helper()
+	slices.Sort(got)
+	slices.Sort(want)
+	if !slices.Equal(got, want) {
+		t.Fatalf("targets %v, want %v", got, want)
+	}
+}
+
+func TestRouterForwardsOnlyWithinRoom(t *testing.T) {
+	r := NewRouter()
+	r.Add(1, "room-1", addr("10.0.1.2"), subnet1)
+	r.Add(2, "room-1", addr("10.0.1.3"), subnet1)
+	// room-2 reuses room-1's addresses; the tables must never mix.
+	r.Add(3, "room-2", addr("10.0.1.2"), subnet1)
+	r.Add(4, "room-2", addr("10.0.1.4"), subnet1)
+
+	got, err := r.Route(1, ipv4Packet([4]byte{10, 0, 1, 2}, [4]byte{10, 0, 1, 3}, ""))
+	if err != nil {
+		t.Fatalf("route 1→10.0.1.3: %v", err)
+	}
+	expectTargets(t, got, 2)
+	got, err = r.Route(3, ipv4Packet([4]byte{10, 0, 1, 2}, [4]byte{10, 0, 1, 4}, ""))
+	if err != nil {
+		t.Fatalf("route 3→10.0.1.4: %v", err)
+	}
+	expectTargets(t, got, 4)
+	if _, err := r.Route(1, ipv4Packet([4]byte{10, 0, 1, 2}, [4]byte{10, 0, 1, 4}, "")); !errors.Is(err, ErrNoRoute) {
+		t.Fatalf("room-1 reached a room-2 address: %v", err)
+	}
+	if _, err := r.Route(4, ipv4Packet([4]byte{10, 0, 1, 4}, [4]byte{10, 0, 1, 3}, "")); !errors.Is(err, ErrNoRoute) {
+		t.Fatalf("room-2 reached a room-1 address: %v", err)
+	}
+	stats := r.Stats()
+	if stats.Forwarded != 2 || stats.NoRoute != 2 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestRouterRejectsSpoofedAndMalformedPackets(t *testing.T) {
+	r := NewRouter()
+	r.Add(1, "room-1", addr("10.0.1.2"), subnet1)
+	r.Add(2, "room-1", addr("10.0.1.3"), subnet1)
+
+	if _, err := r.Route(1, ipv4Packet([4]byte{10, 0, 1, 9}, [4]byte{10, 0, 1, 3}, "")); !errors.Is(err, ErrSpoofedSource) {
+		t.Fatalf("spoofed source: %v", err)
+	}
+	// Claiming another member's address is spoofing too.
+	if _, err := r.Route(1, ipv4Packet([4]byte{10, 0, 1, 3}, [4]byte{10, 0, 1, 3}, "")); !errors.Is(err, ErrSpoofedSource) {
+		t.Fatalf("borrowed source: %v", err)
+	}
+	if _, err := r.Route(1, []byte{0x45, 0, 0}); !errors.Is(err, ErrMalformedPacket) {
+		t.Fatalf("truncated packet: %v", err)
+	}
+	if _, err := r.Route(1, ipv4Packet([4]byte{10, 0, 1, 2}, [4]byte{10, 0, 1, 2}, "")); !errors.Is(err, ErrNoRoute) {
+		t.Fatalf("packet to self: %v", err)
+	}
+	if _, err := r.Route(9, ipv4Packet([4]byte{10, 0, 1, 2}, [4]byte{10, 0, 1, 3}, "")); !errors.Is(err, ErrUnknownPeer) {
+		t.Fatalf("unknown peer: %v", err)
+	}
+	if stats := r.Stats(); stats.Spoofed != 2 || stats.Malformed != 1 || stats.Forwarded != 0 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestRouterRemoveAndReassign(t *testing.T) {
+	r := NewRouter()
+	r.Add(1, "room-1", addr("10.0.1.2"), subnet1)
+	r.Add(2, "room-1", addr("10.0.1.3"), subnet1)
+	packet := ipv4Packet([4]byte{10, 0, 1, 2}, [4]byte{10, 0, 1, 3}, "")
+
+	r.Remove(2)
+	if _, err := r.Route(1, packet); !errors.Is(err, ErrNoRoute) {
+		t.Fatalf("removed peer still routable: %v", err)
+	}
+
+	// A re-bootstrapped device takes the address over under a new peer ID.
+	r.Add(2, "room-1", addr("10.0.1.3"), subnet1)
+	r.Add(5, "room-1", addr("10.0.1.3"), subnet1)
+	got, err := r.Route(1, packet)
+	if err != nil {
+		t.Fatalf("route after reassignment: %v", err)
+	}
+	expectTargets(t, got, 5)
+	if _, err := r.Route(2, ipv4Packet([4]byte{10, 0, 1, 3}, [4]byte{10, 0, 1, 2}, "")); !errors.Is(err, ErrUnknownPeer) {
+		t.Fatalf("displaced peer kept its route: %v", err)
+	}
+	// Removing the displaced peer must not drop the new holder's entry.
+	r.Remove(2)
+	got, err = r.Route(1, packet)
+	if err != nil {
+		t.Fatalf("route after removing displaced peer: %v", err)
+	}
+	expectTargets(t, got, 5)
+}
+
+func TestRouterReplicatesBroadcastWithinRoom(t *testing.T) {
+	r := NewRouter()
+	r.Add(1, "room-1", addr("10.0.1.2"), subnet1)
+	r.Add(2, "room-1", addr("10.0.1.3"), subnet1)
+	r.Add(3, "room-1", addr("10.0.1.4"), subnet1)
+	r.Add(4, "room-2", addr("10.0.2.2"), netip.MustParsePrefix("10.0.2.0/24"))
+
+	for _, dst := range [][4]byte{{255, 255, 255, 255}, {10, 0, 1, 255}, {239, 255, 255, 250}, {224, 0, 0, 251}} {
+		got, err := r.Route(1, ipv4Packet([4]byte{10, 0, 1, 2}, dst, ""))
+		if err != nil {
+			t.Fatalf("broadcast to %v: %v", dst, err)
+		}
+		expectTargets(t, got, 2, 3)
+	}
+	// room-2's subnet broadcast is just an unknown unicast address inside room-1.
+	if _, err := r.Route(1, ipv4Packet([4]byte{10, 0, 1, 2}, [4]byte{10, 0, 2, 255}, "")); !errors.Is(err, ErrNoRoute) {
+		t.Fatalf("foreign subnet broadcast: %v", err)
+	}
+	if _, err := r.Route(1, ipv4Packet([4]byte{10, 0, 1, 2}, [4]byte{239, 1, 2, 3}, "")); !errors.Is(err, ErrGroupNotRelayed) {
+		t.Fatalf("unselected multicast group: %v", err)
+	}
+	if _, err := r.Route(1, ipv4Packet([4]byte{10, 0, 1, 9}, [4]byte{255, 255, 255, 255}, "")); !errors.Is(err, ErrSpoofedSource) {
+		t.Fatalf("spoofed broadcast: %v", err)
+	}
+
+	r.SetMulticastGroups([]netip.Addr{addr("239.1.2.3")})
+	got, err := r.Route(1, ipv4Packet([4]byte{10, 0, 1, 2}, [4]byte{239, 1, 2, 3}, ""))
+	if err != nil {
+		t.Fatalf("configured multicast group: %v", err)
+	}
+	expectTargets(t, got, 2, 3)
+	if stats := r.Stats(); stats.Broadcast != 5 || stats.Filtered != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestRouterLimitsBroadcastRatePerRoom(t *testing.T) {
+	now := time.Unix(1000, 0)
+	r := NewRouter()
+	r.now = func() time.Time { return now }
+	r.SetBroadcastLimit(2, 3)
+	r.Add(1, "room-1", addr("10.0.1.2"), subnet1)
+	r.Add(2, "room-1", addr("10.0.1.3"), subnet1)
+	r.Add(3, "room-2", addr("10.0.1.2"), subnet1)
+	r.Add(4, "room-2", addr("10.0.1.3"), subnet1)
+	broadcast := ipv4Packet([4]byte{10, 0, 1, 2}, [4]byte{255, 255, 255, 255}, "")
+
+	for i := 0; i < 3; i++ {
+		if _, err := r.Route(1, broadcast); err != nil {
+			t.Fatalf("broadcast %d within burst: %v", i, err)
+		}
+	}
+	if _, err := r.Route(1, broadcast); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("broadcast over burst: %v", err)
+	}
+	// A flooding room must not eat another room's budget, nor block unicast.
+	if _, err := r.Route(3, broadcast); err != nil {
+		t.Fatalf("other room's broadcast: %v", err)
+	}
+	if _, err := r.Route(1, ipv4Packet([4]byte{10, 0, 1, 2}, [4]byte{10, 0, 1, 3}, "")); err != nil {
+		t.Fatalf("unicast while rate limited: %v", err)
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if _, err := r.Route(1, broadcast); err != nil {
+		t.Fatalf("broadcast after refill: %v", err)
+	}
+	if _, err := r.Route(1, broadcast); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("refill should grant a single token: %v", err)
+	}
+	if stats := r.Stats(); stats.RateLimited != 2 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	r.SetBroadcastLimit(0, 0)
+	now = now.Add(time.Minute)
+	if _, err := r.Route(3, broadcast); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("disabled relay still forwarded: %v", err)
+	}
+}
@@ -0,0 +1,139 @@
+package dataplane
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"selfhostgameaccel/server/protocol"
+	"selfhostgameaccel/server/protocol/frame"
+)
+
+const (
+	// DefaultHandshakeTimeout bounds how long a client may take to complete the TLS handshake.
+	DefaultHandshakeTimeout = 10 * time.Second
+	// DefaultStreamIdleTimeout drops connections that send nothing for three of the longest
+	// keepalive intervals a room may use.
+	DefaultStreamIdleTimeout = 3 * protocol.MaxKeepaliveInterval * time.Second
+)
+
+// TCPListener accepts stream connections carrying length-prefixed frames and hands them to a
+// Gateway. Wrap the listener with tls.NewListener to serve the data channel over TLS.
+type TCPListener struct {
+	ln               net.Listener
+	gateway          *Gateway
+	handshakeTimeout time.Duration
+	idleTimeout      time.Duration
+
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+}
+
+func NewTCPListener(ln net.Listener, gateway *Gateway) *TCPListener {
+	return &TCPListener{
+		ln:               ln,
+		gateway:          gateway,
+		handshakeTimeout: DefaultHandshakeTimeout,
+		idleTimeout:      DefaultStreamIdleTimeout,
+		conns:            map[net.Conn]struct{}{},
+	}
+}
+
+// SetTimeouts changes the TLS handshake and idle read deadlines for connections accepted
+// afterwards. Call it before Serve.
+func (l *TCPListener) SetTimeouts(handshake, idle time.Duration) {
+	l.handshakeTimeout, l.idleTimeout = handshake, idle
+}
+
+// Addr returns the local address connections are accepted on.
+func (l *TCPListener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+// Serve accepts connections until the listener is closed.
+func (l *TCPListener) Serve() error {
+	for {
+		conn, err := l.ln.Accept()
+		if err != nil {
+			l.mu.Lock()
+			closed := l.closed
+			l.mu.Unlock()
+			if closed || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		if !l.track(conn) {
+			conn.Close()
+			return nil
+		}
+		go l.serveConn(conn)
+	}
+}
+
+// Close stops Serve and drops every open connection.
+func (l *TCPListener) Close() error {
+	l.mu.Lock()
+	l.closed = true
+	for conn := range l.conns {
+		conn.Close()
+	}
+	l.mu.Unlock()
+	return l.ln.Close()
+}
+
+func (l *TCPListener) track(conn net.Conn) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return false
+	}
+	l.conns[conn] = struct{}{}
+	return true
+}
+
+func (l *TCPListener) serveConn(conn net.Conn) {
+	link := &streamLink{conn: conn}
+	defer func() {
+		l.gateway.detach(link)
+		l.mu.Lock()
+		delete(l.conns, conn)
+		l.mu.Unlock()
+		conn.Close()
+	}()
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), l.handshakeTimeout)
+		err := tlsConn.HandshakeContext(ctx)
+		cancel()
+		if err != nil {
+			return
+		}
+	}
+	r := bufio.NewReader(conn)
+	for {
+		if err := conn.SetReadDeadline(time.Now().Add(l.idleTimeout)); err != nil {
+			return
+		}
+		raw, err := frame.ReadStream(r)
+		if err != nil {
+			return
+		}
+		l.gateway.handleFrame(raw, link)
+	}
+}
+
+type streamLink struct {
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func (s *streamLink) send(packet []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return frame.WriteStream(s.conn, packet)
+}
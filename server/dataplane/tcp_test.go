@@ -0,0 +1,150 @@
+package dataplane
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"selfhostgameaccel/server/protocol"
+	"selfhostgameaccel/server/protocol/frame"
+)
+
+type streamTestConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func (s streamTestConn) write(raw []byte) error {
+	return frame.WriteStream(s.conn, raw)
+}
+
+func (s streamTestConn) read(timeout time.Duration) ([]byte, error) {
+	_ = s.conn.SetReadDeadline(time.Now().Add(timeout))
+	return frame.ReadStream(s.reader)
+}
+
+func startTCPListener(t *testing.T, gateway *Gateway, serverTLS *tls.Config) *TCPListener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	if serverTLS != nil {
+		ln = tls.NewListener(ln, serverTLS)
+	}
+	l := NewTCPListener(ln, gateway)
+	go l.Serve()
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func dialStream(t *testing.T, addr net.Addr, clientTLS *tls.Config) streamTestConn {
+	t.Helper()
+	var (
+		conn net.Conn
+		err  error
+	)
+	if clientTLS != nil {
+		conn, err = tls.Dial("tcp", addr.String(), clientTLS)
+	} else {
+		conn, err = net.Dial("tcp", addr.String())
+	}
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return streamTestConn{conn: conn, reader: bufio.NewReader(conn)}
+}
+
+func TestTCPAndUDPMembersShareARoom(t *testing.T) {
+	serverTLS, clientTLS, err := protocol.GenerateTLSConfigs()
+	if err != nil {
+		t.Fatalf("tls: %v", err)
+	}
+	alice := bootstrappedSession(1, "room-1", "10.0.1.2")
+	bob := bootstrappedSession(2, "room-1", "10.0.1.3")
+	bob.CipherSuite = protocol.CipherSuiteChaCha20Poly1305
+	gateway := NewGateway(newStaticResolver(alice, bob))
+	udp := startUDPListener(t, gateway)
+	tcp := startTCPListener(t, gateway, serverTLS)
+
+	a := newTestPeer(t, udp.Addr(), alice)
+	b := newTestPeerOver(t, dialStream(t, tcp.Addr(), clientTLS), bob)
+	registerEndpoint(t, a)
+	registerEndpoint(t, b)
+
+	toBob := ipv4Packet([4]byte{10, 0, 1, 2}, [4]byte{10, 0, 1, 3}, "over udp")
+	a.send(toBob)
+	if got, ok := b.receive(time.Second); !ok || string(got) != string(toBob) {
+		t.Fatalf("tcp member did not receive udp member's packet")
+	}
+	toAlice := ipv4Packet([4]byte{10, 0, 1, 3}, [4]byte{10, 0, 1, 2}, "over tls")
+	b.send(toAlice)
+	if got, ok := a.receive(time.Second); !ok || string(got) != string(toAlice) {
+		t.Fatalf("udp member did not receive tcp member's packet")
+	}
+}
+
+func TestPlainTCPDetachesClosedConnections(t *testing.T) {
+	alice := bootstrappedSession(1, "room-1", "10.0.1.2")
+	gateway := NewGateway(newStaticResolver(alice))
+	tcp := startTCPListener(t, gateway, nil)
+
+	conn := dialStream(t, tcp.Addr(), nil)
+	a := newTestPeerOver(t, conn, alice)
+	registerEndpoint(t, a)
+	conn.conn.Close()
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		gateway.mu.Lock()
+		attached := gateway.peers[alice.PeerID].link != nil
+		gateway.mu.Unlock()
+		if !attached {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("closed connection should be detached from its peer")
+}
+
+func TestTCPListenerDropsStalledConnections(t *testing.T) {
+	serverTLS, clientTLS, err := protocol.GenerateTLSConfigs()
+	if err != nil {
+		t.Fatalf("tls: %v", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	l := NewTCPListener(tls.NewListener(ln, serverTLS), NewGateway(newStaticResolver()))
+	l.SetTimeouts(100*time.Millisecond, 200*time.Millisecond)
+	go l.Serve()
+	t.Cleanup(func() { l.Close() })
+
+	closedWithin := func(conn net.Conn, limit time.Duration) bool {
+		_ = conn.SetReadDeadline(time.Now().Add(limit))
+		_, err := conn.Read(make([]byte, 1))
+		var netErr net.Error
+		return err != nil && !(errors.As(err, &netErr) && netErr.Timeout())
+	}
+
+	// A client that never starts the TLS handshake.
+	raw, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer raw.Close()
+	if !closedWithin(raw, 2*time.Second) {
+		t.Fatalf("connection without a handshake was not dropped")
+	}
+
+	// A client that completes the handshake and then goes silent.
+	idle := dialStream(t, l.Addr(), clientTLS)
+	if !closedWithin(idle.conn, 2*time.Second) {
+		t.Fatalf("idle connection was not dropped")
+	}
+}
@@ -0,0 +1,61 @@
+package dataplane
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+// UDPListener receives datagram frames and hands them to a Gateway.
+type UDPListener struct {
+	conn    net.PacketConn
+	gateway *Gateway
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func NewUDPListener(conn net.PacketConn, gateway *Gateway) *UDPListener {
+	return &UDPListener{conn: conn, gateway: gateway}
+}
+
+// Addr returns the local address frames are received on.
+func (l *UDPListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// Serve reads frames until the listener is closed.
+func (l *UDPListener) Serve() error {
+	buf := make([]byte, maxFrameSize)
+	for {
+		n, addr, err := l.conn.ReadFrom(buf)
+		if err != nil {
+			l.mu.Lock()
+			closed := l.closed
+			l.mu.Unlock()
+			if closed || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		l.gateway.handleFrame(buf[:n], udpLink{conn: l.conn, addr: addr})
+	}
+}
+
+// Close stops Serve and releases the socket.
+func (l *UDPListener) Close() error {
+	l.mu.Lock()
+	l.closed = true
+	l.mu.Unlock()
+	return l.conn.Close()
+}
+
+type udpLink struct {
+	conn net.PacketConn
+	addr net.Addr
+}
+
+func (u udpLink) send(frame []byte) error {
+	_, err := u.conn.WriteTo(frame, u.addr)
+	return err
+}
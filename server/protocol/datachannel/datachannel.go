@@ -0,0 +1,246 @@
+// Package datachannel encrypts tunneled packets with the cipher suite negotiated during tunnel
+// bootstrap. It follows OpenVPN's AEAD data-channel layout: the P_DATA_V2 header is
+// authenticated as additional data, the nonce is the 32-bit packet ID followed by a per-direction
+// implicit IV, and the wire payload is the 16-byte tag followed by the ciphertext.
+//
+// Nonces are never reused: keys are derived from a fresh X25519 exchange, so every bootstrap
+// (including the one a client must perform after either side restarts) produces keys that have
+// never been used before, and a Sealer refuses to wrap its packet counter. Callers must build
+// exactly one Sealer per bootstrap; the client tunnel engine enforces this by consuming the
+// ephemeral key and starting only once.
+package datachannel
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+
+	"selfhostgameaccel/server/protocol"
+	"selfhostgameaccel/server/protocol/frame"
+)
+
+const (
+	KeyLen        = 32
+	ImplicitIVLen = 8
+	TagLen        = 16
+
+	nonceLen = 4 + ImplicitIVLen
+)
+
+var (
+	ErrUnsupportedSuite   = errors.New("datachannel: unsupported cipher suite")
+	ErrMissingKeyMaterial = errors.New("datachannel: session key, shared secret and both ephemeral keys are required")
+	ErrPacketIDExhausted  = errors.New("datachannel: packet id space exhausted, re-key required")
+	ErrShortPayload       = errors.New("datachannel: payload shorter than tag")
+	ErrDecrypt            = errors.New("datachannel: authentication failed")
+)
+
+// derivationLabel domain-separates data-channel keys from anything else derived from a session key.
+const derivationLabel = "selfhostgameaccel data channel v1"
+
+// Role identifies which end of the tunnel is using a set of keys.
+type Role int
+
+const (
+	RoleClient Role = iota
+	RoleServer
+)
+
+// DirectionKey protects traffic flowing one way.
+type DirectionKey struct {
+	Key        [KeyLen]byte
+	ImplicitIV [ImplicitIVLen]byte
+}
+
+// Keys holds the key material for both directions of one tunnel.
+type Keys struct {
+	Suite          protocol.CipherSuite
+	ClientToServer DirectionKey
+	ServerToClient DirectionKey
+}
+
+// DeriveKeys expands the X25519 shared secret and the room session key into per-direction keys
+// with HKDF-SHA256. The ephemeral keys are the raw public keys from TunnelOffer and TunnelAnswer,
+// which bind the keys to this particular exchange.
+func DeriveKeys(suite protocol.CipherSuite, sessionKey, sharedSecret, offerKey, answerKey []byte) (Keys, error) {
+	suite = protocol.ValidateCipherSuite(suite)
+	if suite == "" {
+		return Keys{}, ErrUnsupportedSuite
+	}
+	if len(sessionKey) == 0 || len(sharedSecret) == 0 || len(offerKey) == 0 || len(answerKey) == 0 {
+		return Keys{}, ErrMissingKeyMaterial
+	}
+	secret := make([]byte, 0, len(sharedSecret)+len(sessionKey))
+	secret = append(secret, sharedSecret...)
+	secret = append(secret, sessionKey...)
+	salt := sha256.New()
+	writeLengthPrefixed(salt, offerKey)
+	writeLengthPrefixed(salt, answerKey)
+	info := []byte(derivationLabel + " " + string(suite))
+
+	keys := Keys{Suite: suite}
+	r := hkdf.New(sha256.New, secret, salt.Sum(nil), info)
+	for _, dst := range [][]byte{
+		keys.ClientToServer.Key[:], keys.ClientToServer.ImplicitIV[:],
+		keys.ServerToClient.Key[:], keys.ServerToClient.ImplicitIV[:],
+	} {
+		if _, err := io.ReadFull(r, dst); err != nil {
+			return Keys{}, fmt.Errorf("datachannel: expand keys: %w", err)
+		}
+	}
+	return keys, nil
+}
+
+// SessionKeys derives the keys for a tunnel session the control plane has bootstrapped.
+func SessionKeys(session protocol.TunnelSession) (Keys, error) {
+	return DeriveKeys(session.CipherSuite, session.Key, session.SharedSecret, session.OfferKey, session.AnswerKey)
+}
+
+// ClientKeys derives the client's keys from its join response, the bootstrap answer and the
+// ephemeral private key it offered.
+func ClientKeys(join protocol.JoinRoomResponse, answer protocol.TunnelAnswer, ephemeral *ecdh.PrivateKey) (Keys, error) {
+	sessionKey, err := protocol.DecodeSessionKey(join.SessionKey)
+	if err != nil {
+		return Keys{}, err
+	}
+	serverKey, err := protocol.DecodeEphemeralKey(answer.EphemeralKey)
+	if err != nil {
+		return Keys{}, err
+	}
+	shared, err := ephemeral.ECDH(serverKey)
+	if err != nil {
+		return Keys{}, fmt.Errorf("datachannel: x25519: %w", err)
+	}
+	return DeriveKeys(answer.CipherSuite, sessionKey, shared, ephemeral.PublicKey().Bytes(), serverKey.Bytes())
+}
+
+func writeLengthPrefixed(w io.Writer, b []byte) {
+	_ = binary.Write(w, binary.BigEndian, uint32(len(b)))
+	_, _ = w.Write(b)
+}
+
+// Send returns the key role uses for outbound traffic.
+func (k Keys) Send(role Role) DirectionKey {
+	if role == RoleServer {
+		return k.ServerToClient
+	}
+	return k.ClientToServer
+}
+
+// Receive returns the key role uses for inbound traffic.
+func (k Keys) Receive(role Role) DirectionKey {
+	if role == RoleServer {
+		return k.ClientToServer
+	}
+	return k.ServerToClient
+}
+
+func newAEAD(suite protocol.CipherSuite, key DirectionKey) (cipher.AEAD, error) {
+	switch protocol.ValidateCipherSuite(suite) {
+	case protocol.CipherSuiteAES256GCM:
+		block, err := aes.NewCipher(key.Key[:])
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case protocol.CipherSuiteChaCha20Poly1305:
+		return chacha20poly1305.New(key.Key[:])
+	default:
+		return nil, ErrUnsupportedSuite
+	}
+}
+
+func nonceFor(iv [ImplicitIVLen]byte, packetID uint32) []byte {
+	nonce := make([]byte, nonceLen)
+	binary.BigEndian.PutUint32(nonce, packetID)
+	copy(nonce[4:], iv[:])
+	return nonce
+}
+
+// Sealer encrypts outbound packets for one direction. Create exactly one Sealer per derived
+// key: its packet counter is what keeps nonces unique.
+type Sealer struct {
+	aead   cipher.AEAD
+	iv     [ImplicitIVLen]byte
+	peerID uint32
+	keyID  uint8
+
+	mu   sync.Mutex
+	last uint32
+}
+
+func NewSealer(suite protocol.CipherSuite, key DirectionKey, peerID uint32, keyID uint8) (*Sealer, error) {
+	aead, err := newAEAD(suite, key)
+	if err != nil {
+		return nil, err
+	}
+	return &Sealer{aead: aead, iv: key.ImplicitIV, peerID: peerID, keyID: keyID}, nil
+}
+
+// Seal encrypts payload and returns the encoded P_DATA_V2 packet.
+func (s *Sealer) Seal(payload []byte) ([]byte, error) {
+	s.mu.Lock()
+	if s.last == ^uint32(0) {
+		s.mu.Unlock()
+		return nil, ErrPacketIDExhausted
+	}
+	s.last++
+	packetID := s.last
+	s.mu.Unlock()
+
+	pkt := frame.DataPacket{KeyID: s.keyID, PeerID: s.peerID, PacketID: packetID}
+	header, err := pkt.Header()
+	if err != nil {
+		return nil, err
+	}
+	sealed := s.aead.Seal(nil, nonceFor(s.iv, packetID), payload, header)
+	// OpenVPN places the tag before the ciphertext on the wire.
+	split := len(sealed) - TagLen
+	wire := make([]byte, 0, len(header)+len(sealed))
+	wire = append(wire, header...)
+	wire = append(wire, sealed[split:]...)
+	return append(wire, sealed[:split]...), nil
+}
+
+// Opener decrypts inbound packets for one direction.
+type Opener struct {
+	aead cipher.AEAD
+	iv   [ImplicitIVLen]byte
+}
+
+func NewOpener(suite protocol.CipherSuite, key DirectionKey) (*Opener, error) {
+	aead, err := newAEAD(suite, key)
+	if err != nil {
+		return nil, err
+	}
+	return &Opener{aead: aead, iv: key.ImplicitIV}, nil
+}
+
+// Open authenticates pkt and returns its plaintext. Callers are responsible for replay checks
+// on pkt.PacketID once Open succeeds.
+func (o *Opener) Open(pkt frame.DataPacket) ([]byte, error) {
+	if len(pkt.Payload) < TagLen {
+		return nil, ErrShortPayload
+	}
+	header, err := pkt.Header()
+	if err != nil {
+		return nil, err
+	}
+	sealed := make([]byte, 0, len(pkt.Payload))
+	sealed = append(sealed, pkt.Payload[TagLen:]...)
+	sealed = append(sealed, pkt.Payload[:TagLen]...)
+	plain, err := o.aead.Open(sealed[:0], nonceFor(o.iv, pkt.PacketID), sealed, header)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plain, nil
+}
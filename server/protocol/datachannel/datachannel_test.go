@@ -0,0 +1,121 @@
+package datachannel
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"selfhostgameaccel/server/protocol"
+	"selfhostgameaccel/server/protocol/frame"
+)
+
+func mustDerive(t *testing.T, suite protocol.CipherSuite, offer, answer string) Keys {
+	t.Helper()
+	keys, err := DeriveKeys(suite, []byte("room-session-key"), []byte("x25519-shared-secret"), []byte(offer), []byte(answer))
+	if err != nil {
+		t.Fatalf("derive: %v", err)
+	}
+	return keys
+}
+
+func TestSealOpenRoundTripForEachSuite(t *testing.T) {
+	for _, suite := range []protocol.CipherSuite{protocol.CipherSuiteAES256GCM, protocol.CipherSuiteChaCha20Poly1305} {
+		t.Run(string(suite), func(t *testing.T) {
+			keys := mustDerive(t, suite, "offer", "answer")
+			sealer, err := NewSealer(suite, keys.Send(RoleClient), 7, 0)
+			if err != nil {
+				t.Fatalf("sealer: %v", err)
+			}
+			opener, err := NewOpener(suite, keys.Receive(RoleServer))
+			if err != nil {
+				t.Fatalf("opener: %v", err)
+			}
+
+			for i := 1; i <= 3; i++ {
+				raw, err := sealer.Seal([]byte("ip packet"))
+				if err != nil {
+					t.Fatalf("seal: %v", err)
+				}
+				pkt, err := frame.ParseData(raw)
+				if err != nil {
+					t.Fatalf("parse: %v", err)
+				}
+				if pkt.PeerID != 7 || pkt.PacketID != uint32(i) {
+					t.Fatalf("unexpected header: %+v", pkt)
+				}
+				plain, err := opener.Open(pkt)
+				if err != nil {
+					t.Fatalf("open: %v", err)
+				}
+				if string(plain) != "ip packet" {
+					t.Fatalf("plaintext mismatch: %q", plain)
+				}
+			}
+		})
+	}
+}
+
+func TestOpenRejectsTamperingAndWrongDirection(t *testing.T) {
+	suite := protocol.CipherSuiteAES256GCM
+	keys := mustDerive(t, suite, "offer", "answer")
+	sealer, _ := NewSealer(suite, keys.Send(RoleClient), 1, 0)
+	raw, err := sealer.Seal([]byte("payload"))
+	if err != nil {
+		t.Fatalf("seal: %v", err)
+	}
+
+	wrongDirection, _ := NewOpener(suite, keys.Receive(RoleClient))
+	pkt, _ := frame.ParseData(raw)
+	if _, err := wrongDirection.Open(pkt); !errors.Is(err, ErrDecrypt) {
+		t.Fatalf("expected decrypt failure with the other direction's key, got %v", err)
+	}
+
+	opener, _ := NewOpener(suite, keys.Receive(RoleServer))
+	tampered, _ := frame.ParseData(append([]byte(nil), raw...))
+	tampered.PacketID++
+	if _, err := opener.Open(tampered); !errors.Is(err, ErrDecrypt) {
+		t.Fatalf("expected header tampering to be detected, got %v", err)
+	}
+	short := pkt
+	short.Payload = short.Payload[:TagLen-1]
+	if _, err := opener.Open(short); !errors.Is(err, ErrShortPayload) {
+		t.Fatalf("expected short payload error, got %v", err)
+	}
+}
+
+func TestDeriveKeysBindsEphemeralKeys(t *testing.T) {
+	first := mustDerive(t, protocol.CipherSuiteAES256GCM, "offer-1", "answer-1")
+	second := mustDerive(t, protocol.CipherSuiteAES256GCM, "offer-2", "answer-1")
+	if first.ClientToServer == second.ClientToServer {
+		t.Fatalf("new ephemeral keys must yield new data-channel keys")
+	}
+	if first.ClientToServer == first.ServerToClient {
+		t.Fatalf("directions must use distinct keys")
+	}
+	otherSuite := mustDerive(t, protocol.CipherSuiteChaCha20Poly1305, "offer-1", "answer-1")
+	if bytes.Equal(first.ClientToServer.Key[:], otherSuite.ClientToServer.Key[:]) {
+		t.Fatalf("keys must be bound to the cipher suite")
+	}
+
+	if _, err := DeriveKeys(protocol.CipherSuiteAES256GCM, []byte("k"), []byte("s"), nil, []byte("a")); !errors.Is(err, ErrMissingKeyMaterial) {
+		t.Fatalf("expected missing key material error, got %v", err)
+	}
+	if _, err := DeriveKeys(protocol.CipherSuiteAES256GCM, []byte("k"), nil, []byte("o"), []byte("a")); !errors.Is(err, ErrMissingKeyMaterial) {
+		t.Fatalf("expected missing shared secret error, got %v", err)
+	}
+	if _, err := DeriveKeys("rot13", []byte("k"), []byte("s"), []byte("o"), []byte("a")); !errors.Is(err, ErrUnsupportedSuite) {
+		t.Fatalf("expected unsupported suite error, got %v", err)
+	}
+}
+
+func TestSealerRefusesToWrapPacketID(t *testing.T) {
+	keys := mustDerive(t, protocol.CipherSuiteAES256GCM, "offer", "answer")
+	sealer, _ := NewSealer(keys.Suite, keys.Send(RoleServer), 1, 0)
+	sealer.last = ^uint32(0) - 1
+	if _, err := sealer.Seal(nil); err != nil {
+		t.Fatalf("last packet id should still be usable: %v", err)
+	}
+	if _, err := sealer.Seal(nil); !errors.Is(err, ErrPacketIDExhausted) {
+		t.Fatalf("expected exhaustion error, got %v", err)
+	}
+}
@@ -0,0 +1,118 @@
+package datachannel
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+const (
+	MinReplayWindow     = 64
+	MaxReplayWindow     = 1024
+	DefaultReplayWindow = 256
+)
+
+var (
+	ErrReplayed = errors.New("datachannel: packet id already seen")
+	ErrTooOld   = errors.New("datachannel: packet id older than replay window")
+)
+
+// ReplayStats counts the verdicts of a ReplayWindow. Duplicates point at replayed traffic,
+// while a growing TooOld alongside Reordered usually means the network reorders more than
+// the window tolerates.
+type ReplayStats struct {
+	Accepted   uint64
+	Reordered  uint64
+	Duplicates uint64
+	TooOld     uint64
+}
+
+// ReplayWindow tracks the packet IDs received on one direction of one tunnel. It accepts IDs
+// that arrive out of order as long as they fall within the window and have not been seen.
+type ReplayWindow struct {
+	mu      sync.Mutex
+	width   uint32
+	highest uint32
+	bitmap  []uint64
+	stats   ReplayStats
+}
+
+// NewReplayWindow creates a window covering width packet IDs. The width is rounded up to a
+// multiple of 64 and must lie between MinReplayWindow and MaxReplayWindow.
+func NewReplayWindow(width int) (*ReplayWindow, error) {
+	if width < MinReplayWindow || width > MaxReplayWindow {
+		return nil, fmt.Errorf("datachannel: replay window must be between %d and %d packets", MinReplayWindow, MaxReplayWindow)
+	}
+	words := (width + 63) / 64
+	return &ReplayWindow{width: uint32(words * 64), bitmap: make([]uint64, words)}, nil
+}
+
+// Width reports how many packet IDs behind the newest one are still accepted.
+func (w *ReplayWindow) Width() int {
+	return int(w.width)
+}
+
+// Check records id and reports whether it must be dropped. Only call it for packets that have
+// already been authenticated, otherwise forged IDs could advance the window.
+func (w *ReplayWindow) Check(id uint32) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// Packet IDs start at 1, so 0 can only come from a sender that wrapped or a forgery.
+	if id == 0 {
+		w.stats.TooOld++
+		return ErrTooOld
+	}
+	if id > w.highest {
+		if id-w.highest >= w.width {
+			clear(w.bitmap)
+		} else {
+			for next := w.highest + 1; next != id; next++ {
+				w.clearBit(next)
+			}
+		}
+		w.highest = id
+		w.setBit(id)
+		w.stats.Accepted++
+		return nil
+	}
+	if w.highest-id >= w.width {
+		w.stats.TooOld++
+		return ErrTooOld
+	}
+	if w.hasBit(id) {
+		w.stats.Duplicates++
+		return ErrReplayed
+	}
+	w.setBit(id)
+	w.stats.Accepted++
+	w.stats.Reordered++
+	return nil
+}
+
+// Stats returns a snapshot of the window's counters.
+func (w *ReplayWindow) Stats() ReplayStats {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.stats
+}
+
+func (w *ReplayWindow) slot(id uint32) (int, uint64) {
+	pos := id % w.width
+	return int(pos / 64), 1 << (pos % 64)
+}
+
+func (w *ReplayWindow) setBit(id uint32) {
+	word, mask := w.slot(id)
+	w.bitmap[word] |= mask
+}
+
+func (w *ReplayWindow) clearBit(id uint32) {
+	word, mask := w.slot(id)
+	w.bitmap[word] &^= mask
+}
+
+func (w *ReplayWindow) hasBit(id uint32) bool {
+	word, mask := w.slot(id)
+	return w.bitmap[word]&mask != 0
+}
@@ -0,0 +1,72 @@
+package datachannel
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestReplayWindowAcceptsReorderingAndRejectsDuplicates(t *testing.T) {
+	w, err := NewReplayWindow(64)
+	if err != nil {
+		t.Fatalf("window: %v", err)
+	}
+	for _, id := range []uint32{1, 2, 5, 3, 4} {
+		if err := w.Check(id); err != nil {
+			t.Fatalf("id %d rejected: %v", id, err)
+		}
+	}
+	if err := w.Check(3); !errors.Is(err, ErrReplayed) {
+		t.Fatalf("expected duplicate to be rejected, got %v", err)
+	}
+	if err := w.Check(0); !errors.Is(err, ErrTooOld) {
+		t.Fatalf("expected id 0 to be rejected, got %v", err)
+	}
+
+	stats := w.Stats()
+	if stats.Accepted != 5 || stats.Reordered != 2 || stats.Duplicates != 1 || stats.TooOld != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestReplayWindowSlidesForward(t *testing.T) {
+	w, _ := NewReplayWindow(64)
+	if err := w.Check(10); err != nil {
+		t.Fatalf("check: %v", err)
+	}
+	if err := w.Check(80); err != nil {
+		t.Fatalf("check: %v", err)
+	}
+	if err := w.Check(10); !errors.Is(err, ErrTooOld) {
+		t.Fatalf("expected id behind the window to be too old, got %v", err)
+	}
+	// 74 shares a bitmap slot with 10; sliding forward must have cleared it.
+	if err := w.Check(74); err != nil {
+		t.Fatalf("id inside the window should be accepted after sliding: %v", err)
+	}
+	if err := w.Check(1000); err != nil {
+		t.Fatalf("large jump should be accepted: %v", err)
+	}
+	// 970 shares a slot with 74 from before the jump; the full reset must have cleared it.
+	if err := w.Check(970); err != nil {
+		t.Fatalf("slot reused after a full reset should be accepted: %v", err)
+	}
+	if err := w.Check(1000); !errors.Is(err, ErrReplayed) {
+		t.Fatalf("expected duplicate after jump, got %v", err)
+	}
+}
+
+func TestReplayWindowWidthBounds(t *testing.T) {
+	if _, err := NewReplayWindow(MinReplayWindow - 1); err == nil {
+		t.Fatalf("expected error for a window below the minimum")
+	}
+	if _, err := NewReplayWindow(MaxReplayWindow + 1); err == nil {
+		t.Fatalf("expected error for a window above the maximum")
+	}
+	w, err := NewReplayWindow(100)
+	if err != nil {
+		t.Fatalf("window: %v", err)
+	}
+	if w.Width() != 128 {
+		t.Fatalf("expected width rounded up to 128, got %d", w.Width())
+	}
+}
@@ -0,0 +1,214 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	errDeviceUnknown = errors.New("device is not enrolled; log in from it first")
+	errDeviceRevoked = errors.New("device has been revoked; log in from it again to re-enroll")
+)
+
+// deviceKey indexes Server.devices. Device IDs are chosen by clients, so each user has a
+// namespace of their own; usernames cannot contain spaces, which keeps the key unambiguous.
+func deviceKey(username, deviceID string) string {
+	return username + " " + deviceID
+}
+
+// deviceRecord is one enrolled client device. Only a hash of its refresh token is kept, so a
+// leaked state file cannot be used to mint sessions.
+type deviceRecord struct {
+	ID        string
+	Username  string
+	Name      string
+	Platform  string `json:",omitempty"`
+	TokenHash string `json:",omitempty"`
+	CreatedAt time.Time
+	LastUsed  time.Time
+	RevokedAt time.Time `json:",omitempty"`
+}
+
+func (d *deviceRecord) revoked() bool {
+	return !d.RevokedAt.IsZero()
+}
+
+func (d *deviceRecord) info() DeviceInfo {
+	return DeviceInfo{
+		DeviceID:      d.ID,
+		Name:          d.Name,
+		Platform:      d.Platform,
+		CreatedAtUnix: unixOrZero(d.CreatedAt),
+		LastUsedUnix:  unixOrZero(d.LastUsed),
+		Revoked:       d.revoked(),
+	}
+}
+
+// enrollDeviceLocked registers deviceID to username, or re-enrolls it after a password login,
+// and issues it a fresh refresh token; any earlier token of the device stops working.
+func (s *Server) enrollDeviceLocked(username, deviceID, name, platform string) string {
+	now := s.now()
+	device, ok := s.devices[deviceKey(username, deviceID)]
+	if !ok {
+		device = &deviceRecord{ID: deviceID, Username: username, Name: deviceID, CreatedAt: now}
+		s.devices[deviceKey(username, deviceID)] = device
+	}
+	if name != "" {
+		device.Name = name
+	}
+	if platform != "" {
+		device.Platform = platform
+	}
+	token := newToken()
+	delete(s.deviceTokens, device.TokenHash)
+	device.TokenHash = hashToken(token)
+	s.deviceTokens[device.TokenHash] = deviceKey(username, deviceID)
+	device.LastUsed = now
+	device.RevokedAt = time.Time{}
+	return token
+}
+
+// revokeDeviceLocked stops the device's refresh token from working until it is enrolled again.
+func (s *Server) revokeDeviceLocked(device *deviceRecord) {
+	delete(s.deviceTokens, device.TokenHash)
+	device.TokenHash = ""
+	device.RevokedAt = s.now()
+}
+
+// deviceForTokenLocked finds the live device a refresh token was issued to.
+func (s *Server) deviceForTokenLocked(token string) (*deviceRecord, bool) {
+	if token == "" {
+		return nil, false
+	}
+	hash := hashToken(token)
+	device, ok := s.devices[s.deviceTokens[hash]]
+	if !ok || device.TokenHash != hash || device.revoked() {
+		return nil, false
+	}
+	return device, true
+}
+
+// indexDeviceTokensLocked rebuilds s.deviceTokens from the device records, after they were
+// loaded or rekeyed.
+func (s *Server) indexDeviceTokensLocked() {
+	s.deviceTokens = make(map[string]string, len(s.devices))
+	for key, device := range s.devices {
+		if device.TokenHash != "" {
+			s.deviceTokens[device.TokenHash] = key
+		}
+	}
+}
+
+// useDeviceLocked makes sure username has enrolled deviceID, by registering or logging in
+// from it, and has not revoked it since.
+func (s *Server) useDeviceLocked(username, deviceID string) error {
+	device, ok := s.devices[deviceKey(username, deviceID)]
+	switch {
+	case !ok:
+		return errDeviceUnknown
+	case device.revoked():
+		return errDeviceRevoked
+	}
+	device.LastUsed = s.now()
+	return nil
+}
+
+// rekeyDevices moves devices saved under their bare ID, before each user had a namespace of
+// their own, to their deviceKey. It reports whether anything moved.
+func rekeyDevices(devices map[string]*deviceRecord) bool {
+	moved := false
+	for key, device := range devices {
+		if want := deviceKey(device.Username, device.ID); key != want {
+			delete(devices, key)
+			devices[want] = device
+			moved = true
+		}
+	}
+	return moved
+}
+
+// attributeDeviceBans gives device bans from before device IDs were per account the account
+// that had enrolled the ID, which was unique then. Bans whose device cannot be found keep
+// matching the ID under any account. It reports whether anything changed.
+func attributeDeviceBans(room *roomRecord, devices map[string]*deviceRecord) bool {
+	changed := false
+	for i, ban := range room.Bans {
+		if ban.Username != "" || ban.DeviceID == "" {
+			continue
+		}
+		owners := []string{}
+		for _, device := range devices {
+			if device.ID == ban.DeviceID {
+				owners = append(owners, device.Username)
+			}
+		}
+		if len(owners) == 1 {
+			room.Bans[i].Username = owners[0]
+			changed = true
+		}
+	}
+	return changed
+}
+
+// migrateLegacyDevices builds device records from the device_bags map and userRecord.Device
+// fields of older state files. Bags mapped device IDs and refresh tokens alike to usernames,
+// without recording which device a token was issued to, so a token is only attached to a
+// device when its user has exactly one of each. Every other token gets a device record of its
+// own, which the user can list and revoke like any other, so no client is logged out.
+func migrateLegacyDevices(bags map[string]string, users map[string]userRecord, devices map[string]*deviceRecord) {
+	addDevice := func(username, deviceID string) {
+		if _, ok := devices[deviceKey(username, deviceID)]; !ok {
+			devices[deviceKey(username, deviceID)] = &deviceRecord{ID: deviceID, Username: username, Name: deviceID}
+		}
+	}
+	for name, user := range users {
+		if user.Device != "" {
+			addDevice(name, user.Device)
+		}
+	}
+	tokens := map[string][]string{}
+	for key, username := range bags {
+		// Clients chose their device IDs, so one shaped like a token is still a device when its
+		// user registered with it.
+		if legacyTokenPattern.MatchString(key) && key != users[username].Device {
+			tokens[username] = append(tokens[username], key)
+			continue
+		}
+		addDevice(username, key)
+	}
+	for username, userTokens := range tokens {
+		var tokenless []*deviceRecord
+		for _, device := range devices {
+			if device.Username == username && device.TokenHash == "" {
+				tokenless = append(tokenless, device)
+			}
+		}
+		if len(userTokens) == 1 && len(tokenless) == 1 {
+			tokenless[0].TokenHash = hashToken(userTokens[0])
+			continue
+		}
+		for _, token := range userTokens {
+			hash := hashToken(token)
+			id := "legacy-" + hash[:12]
+			devices[deviceKey(username, id)] = &deviceRecord{ID: id, Username: username, Name: "legacy sign-in", TokenHash: hash}
+		}
+	}
+	for name, user := range users {
+		user.Device = ""
+		users[name] = user
+	}
+}
+
+// validDeviceName keeps names printable and short enough for a device list.
+func validDeviceName(name string) error {
+	if len(name) == 0 || len(name) > 64 {
+		return fmt.Errorf("device name must be 1-64 characters")
+	}
+	for _, r := range name {
+		if r < 0x20 || r == 0x7f {
+			return fmt.Errorf("device name may not contain control characters")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,341 @@
+// Package frame encodes and decodes data-channel packets using OpenVPN's wire layout so
+// both ends of a tunnel, and existing tooling such as the Wireshark OpenVPN dissector,
+// interpret the traffic the same way.
+//
+// Every packet starts with one byte holding the opcode in the upper five bits and the key ID
+// in the lower three. Data packets use the P_DATA_V2 layout: a 24-bit peer ID, a 32-bit
+// packet ID and an opaque payload produced by the data-channel cipher. Control packets use
+// the tls-auth layout with an optional HMAC-SHA256 over the whole packet.
+package frame
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Opcode identifies the kind of packet, using OpenVPN's numbering.
+type Opcode uint8
+
+const (
+	OpControlHardResetClientV1 Opcode = 1
+	OpControlHardResetServerV1 Opcode = 2
+	OpControlSoftResetV1       Opcode = 3
+	OpControlV1                Opcode = 4
+	OpAckV1                    Opcode = 5
+	OpDataV1                   Opcode = 6
+	OpControlHardResetClientV2 Opcode = 7
+	OpControlHardResetServerV2 Opcode = 8
+	OpDataV2                   Opcode = 9
+)
+
+const (
+	// MaxKeyID is the largest key ID that fits the three low bits of the first byte.
+	MaxKeyID = 7
+	// MaxPeerID is the largest peer ID that fits the 24-bit field of P_DATA_V2.
+	MaxPeerID = 0xFFFFFF
+
+	// DataHeaderLen is the size of a P_DATA_V2 header: opcode/key byte, peer ID and packet ID.
+	DataHeaderLen = 1 + 3 + 4
+
+	sessionIDLen = 8
+	hmacLen      = sha256.Size
+	maxAcks      = 8
+)
+
+var (
+	ErrShortPacket    = errors.New("frame: packet too short")
+	ErrUnexpectedOp   = errors.New("frame: unexpected opcode")
+	ErrInvalidKeyID   = errors.New("frame: key id out of range")
+	ErrInvalidPeerID  = errors.New("frame: peer id out of range")
+	ErrTooManyAcks    = errors.New("frame: too many acks")
+	ErrAuthentication = errors.New("frame: hmac mismatch")
+)
+
+func (o Opcode) String() string {
+	switch o {
+	case OpControlHardResetClientV1:
+		return "P_CONTROL_HARD_RESET_CLIENT_V1"
+	case OpControlHardResetServerV1:
+		return "P_CONTROL_HARD_RESET_SERVER_V1"
+	case OpControlSoftResetV1:
+		return "P_CONTROL_SOFT_RESET_V1"
+	case OpControlV1:
+		return "P_CONTROL_V1"
+	case OpAckV1:
+		return "P_ACK_V1"
+	case OpDataV1:
+		return "P_DATA_V1"
+	case OpControlHardResetClientV2:
+		return "P_CONTROL_HARD_RESET_CLIENT_V2"
+	case OpControlHardResetServerV2:
+		return "P_CONTROL_HARD_RESET_SERVER_V2"
+	case OpDataV2:
+		return "P_DATA_V2"
+	default:
+		return fmt.Sprintf("opcode(%d)", uint8(o))
+	}
+}
+
+// IsControl reports whether packets with this opcode use the control layout.
+func (o Opcode) IsControl() bool {
+	switch o {
+	case OpControlHardResetClientV1, OpControlHardResetServerV1, OpControlSoftResetV1,
+		OpControlV1, OpAckV1, OpControlHardResetClientV2, OpControlHardResetServerV2:
+		return true
+	default:
+		return false
+	}
+}
+
+// Peek returns the opcode and key ID of an encoded packet without decoding the rest.
+func Peek(b []byte) (Opcode, uint8, error) {
+	if len(b) == 0 {
+		return 0, 0, ErrShortPacket
+	}
+	return Opcode(b[0] >> 3), b[0] & MaxKeyID, nil
+}
+
+func opByte(op Opcode, keyID uint8) (byte, error) {
+	if keyID > MaxKeyID {
+		return 0, ErrInvalidKeyID
+	}
+	return byte(op)<<3 | keyID, nil
+}
+
+// DataPacket is a P_DATA_V2 packet. Payload carries the cipher output (tag and ciphertext)
+// and is not interpreted by the codec.
+type DataPacket struct {
+	KeyID    uint8
+	PeerID   uint32
+	PacketID uint32
+	Payload  []byte
+}
+
+// Header returns the encoded P_DATA_V2 header, which AEAD ciphers authenticate as additional data.
+func (p DataPacket) Header() ([]byte, error) {
+	return p.appendHeader(make([]byte, 0, DataHeaderLen))
+}
+
+func (p DataPacket) appendHeader(dst []byte) ([]byte, error) {
+	if p.PeerID > MaxPeerID {
+		return nil, ErrInvalidPeerID
+	}
+	first, err := opByte(OpDataV2, p.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	dst = append(dst, first, byte(p.PeerID>>16), byte(p.PeerID>>8), byte(p.PeerID))
+	return binary.BigEndian.AppendUint32(dst, p.PacketID), nil
+}
+
+// Marshal encodes the packet.
+func (p DataPacket) Marshal() ([]byte, error) {
+	out, err := p.appendHeader(make([]byte, 0, DataHeaderLen+len(p.Payload)))
+	if err != nil {
+		return nil, err
+	}
+	return append(out, p.Payload...), nil
+}
+
+// ParseData decodes a P_DATA_V2 packet. The returned payload aliases b.
+func ParseData(b []byte) (DataPacket, error) {
+	op, keyID, err := Peek(b)
+	if err != nil {
+		return DataPacket{}, err
+	}
+	if op != OpDataV2 {
+		return DataPacket{}, fmt.Errorf("%w: %s", ErrUnexpectedOp, op)
+	}
+	if len(b) < DataHeaderLen {
+		return DataPacket{}, ErrShortPacket
+	}
+	return DataPacket{
+		KeyID:    keyID,
+		PeerID:   uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3]),
+		PacketID: binary.BigEndian.Uint32(b[4:8]),
+		Payload:  b[DataHeaderLen:],
+	}, nil
+}
+
+// SessionID identifies one end of a control session.
+type SessionID [sessionIDLen]byte
+
+// ControlPacket is a P_CONTROL_* or P_ACK_V1 packet in the tls-auth layout.
+type ControlPacket struct {
+	Opcode    Opcode
+	KeyID     uint8
+	SessionID SessionID
+	// ReplayID and NetTime form the tls-auth replay-protection prefix.
+	ReplayID uint32
+	NetTime  uint32
+	// Acks lists message IDs being acknowledged; RemoteSessionID is only encoded when Acks is non-empty.
+	Acks            []uint32
+	RemoteSessionID SessionID
+	// MessageID and Payload are omitted for P_ACK_V1.
+	MessageID uint32
+	Payload   []byte
+}
+
+// Authenticator signs and verifies control packets with HMAC-SHA256, like OpenVPN's tls-auth.
+// A nil Authenticator encodes packets without an HMAC field.
+type Authenticator struct {
+	key []byte
+}
+
+func NewAuthenticator(key []byte) *Authenticator {
+	return &Authenticator{key: append([]byte(nil), key...)}
+}
+
+func (a *Authenticator) size() int {
+	if a == nil {
+		return 0
+	}
+	return hmacLen
+}
+
+// sum computes the HMAC in tls-auth order: replay prefix, then opcode and session ID, then the rest.
+func (a *Authenticator) sum(first []byte, replay []byte, rest []byte) []byte {
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write(replay)
+	mac.Write(first)
+	mac.Write(rest)
+	return mac.Sum(nil)
+}
+
+// Marshal encodes the packet, signing it when auth is non-nil.
+func (p ControlPacket) Marshal(auth *Authenticator) ([]byte, error) {
+	if !p.Opcode.IsControl() {
+		return nil, fmt.Errorf("%w: %s", ErrUnexpectedOp, p.Opcode)
+	}
+	if len(p.Acks) > maxAcks {
+		return nil, ErrTooManyAcks
+	}
+	first, err := opByte(p.Opcode, p.KeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	head := append([]byte{first}, p.SessionID[:]...)
+	var replay []byte
+	if auth != nil {
+		replay = binary.BigEndian.AppendUint32(replay, p.ReplayID)
+		replay = binary.BigEndian.AppendUint32(replay, p.NetTime)
+	}
+	rest := []byte{byte(len(p.Acks))}
+	for _, ack := range p.Acks {
+		rest = binary.BigEndian.AppendUint32(rest, ack)
+	}
+	if len(p.Acks) > 0 {
+		rest = append(rest, p.RemoteSessionID[:]...)
+	}
+	if p.Opcode != OpAckV1 {
+		rest = binary.BigEndian.AppendUint32(rest, p.MessageID)
+		rest = append(rest, p.Payload...)
+	}
+
+	out := make([]byte, 0, len(head)+auth.size()+len(replay)+len(rest))
+	out = append(out, head...)
+	if auth != nil {
+		out = append(out, auth.sum(head, replay, rest)...)
+	}
+	out = append(out, replay...)
+	return append(out, rest...), nil
+}
+
+// ParseControl decodes a control packet, verifying its HMAC when auth is non-nil.
+// The returned payload aliases b.
+func ParseControl(b []byte, auth *Authenticator) (ControlPacket, error) {
+	op, keyID, err := Peek(b)
+	if err != nil {
+		return ControlPacket{}, err
+	}
+	if !op.IsControl() {
+		return ControlPacket{}, fmt.Errorf("%w: %s", ErrUnexpectedOp, op)
+	}
+	p := ControlPacket{Opcode: op, KeyID: keyID}
+	r := reader{buf: b[1:]}
+	copy(p.SessionID[:], r.next(sessionIDLen))
+	if r.err != nil {
+		return ControlPacket{}, r.err
+	}
+	head := b[:1+sessionIDLen]
+
+	var mac, replay []byte
+	if auth != nil {
+		mac = r.next(hmacLen)
+		replay = r.next(8)
+		if r.err == nil {
+			p.ReplayID = binary.BigEndian.Uint32(replay[:4])
+			p.NetTime = binary.BigEndian.Uint32(replay[4:])
+		}
+	}
+	restStart := r.offset + 1
+	ackCount := int(r.byte())
+	if ackCount > maxAcks {
+		return ControlPacket{}, ErrTooManyAcks
+	}
+	for i := 0; i < ackCount; i++ {
+		p.Acks = append(p.Acks, r.uint32())
+	}
+	if ackCount > 0 {
+		copy(p.RemoteSessionID[:], r.next(sessionIDLen))
+	}
+	if op != OpAckV1 {
+		p.MessageID = r.uint32()
+		p.Payload = r.remaining()
+	}
+	if r.err != nil {
+		return ControlPacket{}, r.err
+	}
+	if auth != nil && !hmac.Equal(mac, auth.sum(head, replay, b[restStart:])) {
+		return ControlPacket{}, ErrAuthentication
+	}
+	return p, nil
+}
+
+type reader struct {
+	buf    []byte
+	offset int
+	err    error
+}
+
+func (r *reader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.buf)-r.offset < n {
+		r.err = ErrShortPacket
+		return nil
+	}
+	out := r.buf[r.offset : r.offset+n]
+	r.offset += n
+	return out
+}
+
+func (r *reader) byte() byte {
+	b := r.next(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *reader) uint32() uint32 {
+	b := r.next(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (r *reader) remaining() []byte {
+	if r.err != nil {
+		return nil
+	}
+	out := r.buf[r.offset:]
+	r.offset = len(r.buf)
+	return out
+}
@@ -0,0 +1,143 @@
+package frame
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestDataPacketRoundTrip(t *testing.T) {
+	in := DataPacket{KeyID: 2, PeerID: 0xABCDEF, PacketID: 42, Payload: []byte("ciphertext")}
+	raw, err := in.Marshal()
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	// 0x4a = P_DATA_V2 (9) << 3 | key id 2, matching what the Wireshark dissector expects.
+	want := []byte{0x4a, 0xab, 0xcd, 0xef, 0, 0, 0, 42}
+	if !bytes.Equal(raw[:DataHeaderLen], want) {
+		t.Fatalf("header = %x, want %x", raw[:DataHeaderLen], want)
+	}
+	header, err := in.Header()
+	if err != nil || !bytes.Equal(header, want) {
+		t.Fatalf("Header() = %x, %v", header, err)
+	}
+
+	out, err := ParseData(raw)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if out.KeyID != in.KeyID || out.PeerID != in.PeerID || out.PacketID != in.PacketID || !bytes.Equal(out.Payload, in.Payload) {
+		t.Fatalf("round trip mismatch: %+v", out)
+	}
+}
+
+func TestDataPacketRejectsInvalidInput(t *testing.T) {
+	if _, err := (DataPacket{PeerID: MaxPeerID + 1}).Marshal(); !errors.Is(err, ErrInvalidPeerID) {
+		t.Fatalf("expected peer id error, got %v", err)
+	}
+	if _, err := (DataPacket{KeyID: MaxKeyID + 1}).Marshal(); !errors.Is(err, ErrInvalidKeyID) {
+		t.Fatalf("expected key id error, got %v", err)
+	}
+	if _, err := ParseData([]byte{byte(OpDataV2) << 3, 0, 0}); !errors.Is(err, ErrShortPacket) {
+		t.Fatalf("expected short packet error, got %v", err)
+	}
+	if _, err := ParseData([]byte{byte(OpControlV1) << 3, 0, 0, 0, 0, 0, 0, 0}); !errors.Is(err, ErrUnexpectedOp) {
+		t.Fatalf("expected opcode error, got %v", err)
+	}
+}
+
+func TestControlPacketRoundTripWithHMAC(t *testing.T) {
+	auth := NewAuthenticator([]byte("shared tls-auth key"))
+	in := ControlPacket{
+		Opcode:          OpControlV1,
+		KeyID:           1,
+		SessionID:       SessionID{1, 2, 3, 4, 5, 6, 7, 8},
+		ReplayID:        9,
+		NetTime:         1700000000,
+		Acks:            []uint32{3, 4},
+		RemoteSessionID: SessionID{8, 7, 6, 5, 4, 3, 2, 1},
+		MessageID:       5,
+		Payload:         []byte("hello"),
+	}
+	raw, err := in.Marshal(auth)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	out, err := ParseControl(raw, auth)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if out.Opcode != in.Opcode || out.KeyID != in.KeyID || out.SessionID != in.SessionID ||
+		out.ReplayID != in.ReplayID || out.NetTime != in.NetTime || out.RemoteSessionID != in.RemoteSessionID ||
+		out.MessageID != in.MessageID || !bytes.Equal(out.Payload, in.Payload) || len(out.Acks) != 2 || out.Acks[1] != 4 {
+		t.Fatalf("round trip mismatch: %+v", out)
+	}
+
+	tampered := append([]byte(nil), raw...)
+	tampered[len(tampered)-1] ^= 0xff
+	if _, err := ParseControl(tampered, auth); !errors.Is(err, ErrAuthentication) {
+		t.Fatalf("expected hmac failure, got %v", err)
+	}
+	if _, err := ParseControl(raw, NewAuthenticator([]byte("other key"))); !errors.Is(err, ErrAuthentication) {
+		t.Fatalf("expected hmac failure with wrong key, got %v", err)
+	}
+}
+
+func TestAckPacketWithoutHMAC(t *testing.T) {
+	in := ControlPacket{Opcode: OpAckV1, SessionID: SessionID{1}, Acks: []uint32{7}, RemoteSessionID: SessionID{2}}
+	raw, err := in.Marshal(nil)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if len(raw) != 1+8+1+4+8 {
+		t.Fatalf("unexpected ack length %d", len(raw))
+	}
+	out, err := ParseControl(raw, nil)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if len(out.Acks) != 1 || out.Acks[0] != 7 || out.RemoteSessionID != in.RemoteSessionID || out.Payload != nil {
+		t.Fatalf("unexpected ack: %+v", out)
+	}
+	if _, err := ParseControl(raw[:5], nil); !errors.Is(err, ErrShortPacket) {
+		t.Fatalf("expected short packet error, got %v", err)
+	}
+}
+
+func TestPingPong(t *testing.T) {
+	if !IsPing(PingPayload()) || IsPing(PongPayload()) {
+		t.Fatalf("ping detection broken")
+	}
+	if !IsPong(PongPayload()) || IsPong(PingPayload()) {
+		t.Fatalf("pong detection broken")
+	}
+	op, key, err := Peek([]byte{byte(OpControlHardResetClientV2)<<3 | 3})
+	if err != nil || op != OpControlHardResetClientV2 || key != 3 {
+		t.Fatalf("peek = %s %d %v", op, key, err)
+	}
+}
+
+func TestStreamFraming(t *testing.T) {
+	var buf bytes.Buffer
+	for _, packet := range [][]byte{[]byte("first"), {}, []byte("third")} {
+		if err := WriteStream(&buf, packet); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	for _, want := range []string{"first", "", "third"} {
+		got, err := ReadStream(&buf)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if string(got) != want {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+	if err := WriteStream(&buf, make([]byte, MaxStreamPacket+1)); !errors.Is(err, ErrStreamPacketTooLarge) {
+		t.Fatalf("expected oversize error, got %v", err)
+	}
+	if _, err := ReadStream(bytes.NewReader([]byte{0, 5, 'a'})); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("expected truncated packet error, got %v", err)
+	}
+}
@@ -0,0 +1,37 @@
+package frame
+
+import "bytes"
+
+// pingMagic is the payload OpenVPN sends inside an encrypted data packet as a keepalive.
+var pingMagic = []byte{
+	0x2a, 0x18, 0x7b, 0xf3, 0x64, 0x1e, 0xb4, 0xcb,
+	0x07, 0xed, 0x2d, 0x0a, 0x98, 0x1f, 0xc7, 0x48,
+}
+
+// pongMagic answers a ping so the sender can tell the path works in both directions. OpenVPN
+// itself never replies to pings; peers that do not know this payload drop it like any other
+// packet that is not a valid IP datagram.
+var pongMagic = []byte{
+	0x2a, 0x18, 0x7b, 0xf3, 0x64, 0x1e, 0xb4, 0xcb,
+	0x07, 0xed, 0x2d, 0x0a, 0x98, 0x1f, 0xc7, 0x49,
+}
+
+// PingPayload returns a fresh copy of the data-channel ping payload.
+func PingPayload() []byte {
+	return append([]byte(nil), pingMagic...)
+}
+
+// PongPayload returns a fresh copy of the data-channel pong payload.
+func PongPayload() []byte {
+	return append([]byte(nil), pongMagic...)
+}
+
+// IsPing reports whether a decrypted data payload is a ping rather than an IP packet.
+func IsPing(payload []byte) bool {
+	return bytes.Equal(payload, pingMagic)
+}
+
+// IsPong reports whether a decrypted data payload is a pong rather than an IP packet.
+func IsPong(payload []byte) bool {
+	return bytes.Equal(payload, pongMagic)
+}
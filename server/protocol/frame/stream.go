@@ -0,0 +1,40 @@
+package frame
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// MaxStreamPacket is the largest packet the 16-bit length prefix of a stream transport can carry.
+const MaxStreamPacket = 0xFFFF
+
+var ErrStreamPacketTooLarge = errors.New("frame: packet too large for stream framing")
+
+// WriteStream writes packet to a stream transport (TCP or TLS) behind a 16-bit big-endian
+// length, as OpenVPN does in TCP mode. Callers sharing w must serialize calls.
+func WriteStream(w io.Writer, packet []byte) error {
+	if len(packet) > MaxStreamPacket {
+		return ErrStreamPacketTooLarge
+	}
+	buf := make([]byte, 2, 2+len(packet))
+	binary.BigEndian.PutUint16(buf, uint16(len(packet)))
+	_, err := w.Write(append(buf, packet...))
+	return err
+}
+
+// ReadStream reads one length-prefixed packet written by WriteStream.
+func ReadStream(r io.Reader) ([]byte, error) {
+	var prefix [2]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, err
+	}
+	packet := make([]byte, binary.BigEndian.Uint16(prefix[:]))
+	if _, err := io.ReadFull(r, packet); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return packet, nil
+}
@@ -0,0 +1,48 @@
+package protocol
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// DecodeSessionKey parses the session_key field of JoinRoomResponse into raw key bytes.
+func DecodeSessionKey(encoded string) ([]byte, error) {
+	key, err := hex.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("decode session key: %w", err)
+	}
+	if len(key) == 0 {
+		return nil, errors.New("session key required")
+	}
+	return key, nil
+}
+
+// GenerateEphemeralKey creates the X25519 keypair one side contributes to a tunnel bootstrap.
+func GenerateEphemeralKey() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+// EncodeEphemeralKey renders a public key for the ephemeral_pub_key field of TunnelOffer and TunnelAnswer.
+func EncodeEphemeralKey(pub *ecdh.PublicKey) string {
+	return base64.StdEncoding.EncodeToString(pub.Bytes())
+}
+
+// DecodeEphemeralKey parses the ephemeral_pub_key field of TunnelOffer or TunnelAnswer.
+func DecodeEphemeralKey(encoded string) (*ecdh.PublicKey, error) {
+	if encoded == "" {
+		return nil, errors.New("ephemeral key required")
+	}
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("decode ephemeral key: %w", err)
+	}
+	pub, err := ecdh.X25519().NewPublicKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("parse ephemeral key: %w", err)
+	}
+	return pub, nil
+}
@@ -0,0 +1,101 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+)
+
+const (
+	// DefaultAddressPool is the range room subnets are carved from.
+	DefaultAddressPool = "10.0.0.0/16"
+	// DefaultRoomPrefixLen gives every room a /24, i.e. 253 member addresses.
+	DefaultRoomPrefixLen = 24
+)
+
+var (
+	ErrPoolExhausted = errors.New("ipam: no free room subnet left in the address pool")
+	ErrSubnetFull    = errors.New("ipam: room subnet has no free member addresses")
+)
+
+// AddressPool allocates non-overlapping room subnets from a larger IPv4 prefix, and member
+// addresses inside a room subnet. It holds no state of its own: callers pass in what is already
+// in use, so leases live with the rooms they belong to and survive restarts through the
+// normal state file.
+type AddressPool struct {
+	prefix    netip.Prefix
+	prefixLen int
+}
+
+// NewAddressPool validates that pool is IPv4 and can hold at least one room of prefixLen bits
+// with room for members.
+func NewAddressPool(pool string, prefixLen int) (AddressPool, error) {
+	prefix, err := netip.ParsePrefix(pool)
+	if err != nil {
+		return AddressPool{}, fmt.Errorf("ipam: address pool: %w", err)
+	}
+	if !prefix.Addr().Is4() {
+		return AddressPool{}, fmt.Errorf("ipam: address pool %s is not IPv4", prefix)
+	}
+	// A /30 is the smallest subnet with a host address left after the network, gateway and
+	// broadcast addresses are reserved.
+	if prefixLen < prefix.Bits() || prefixLen > 30 {
+		return AddressPool{}, fmt.Errorf("ipam: room prefix /%d does not fit in %s (must be /%d–/30)", prefixLen, prefix, prefix.Bits())
+	}
+	return AddressPool{prefix: prefix.Masked(), prefixLen: prefixLen}, nil
+}
+
+func (p AddressPool) String() string {
+	return fmt.Sprintf("%s (/%d rooms)", p.prefix, p.prefixLen)
+}
+
+// AllocateSubnet returns the lowest room subnet in the pool that overlaps none of used. used
+// may include subnets outside the pool, such as rooms created under an earlier configuration.
+func (p AddressPool) AllocateSubnet(used []netip.Prefix) (netip.Prefix, error) {
+	size := uint64(1) << (32 - p.prefixLen)
+	count := uint64(1) << (p.prefixLen - p.prefix.Bits())
+	base := addrToUint32(p.prefix.Addr())
+	for i := uint64(0); i < count; i++ {
+		candidate := netip.PrefixFrom(uint32ToAddr(base+uint32(i*size)), p.prefixLen)
+		if !overlapsAny(candidate, used) {
+			return candidate, nil
+		}
+	}
+	return netip.Prefix{}, ErrPoolExhausted
+}
+
+// AllocateHost returns the lowest free member address in subnet. The network address, the
+// first host (reserved for a server-side gateway) and the broadcast address are never handed out.
+func AllocateHost(subnet netip.Prefix, used map[netip.Addr]bool) (netip.Addr, error) {
+	subnet = subnet.Masked()
+	if !subnet.Addr().Is4() || subnet.Bits() > 30 {
+		return netip.Addr{}, fmt.Errorf("ipam: cannot allocate hosts in %s", subnet)
+	}
+	base := addrToUint32(subnet.Addr())
+	size := uint32(1) << (32 - subnet.Bits())
+	for offset := uint32(2); offset < size-1; offset++ {
+		addr := uint32ToAddr(base + offset)
+		if !used[addr] {
+			return addr, nil
+		}
+	}
+	return netip.Addr{}, ErrSubnetFull
+}
+
+func overlapsAny(candidate netip.Prefix, used []netip.Prefix) bool {
+	for _, u := range used {
+		if candidate.Overlaps(u) {
+			return true
+		}
+	}
+	return false
+}
+
+func addrToUint32(a netip.Addr) uint32 {
+	b := a.As4()
+	return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+}
+
+func uint32ToAddr(v uint32) netip.Addr {
+	return netip.AddrFrom4([4]byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)})
+}
@@ -0,0 +1,82 @@
+package protocol
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+)
+
+func TestAddressPoolAllocatesNonOverlappingSubnets(t *testing.T) {
+	pool, err := NewAddressPool("10.8.0.0/22", 24)
+	if err != nil {
+		t.Fatalf("pool: %v", err)
+	}
+	var used []netip.Prefix
+	for _, want := range []string{"10.8.0.0/24", "10.8.1.0/24", "10.8.2.0/24", "10.8.3.0/24"} {
+		got, err := pool.AllocateSubnet(used)
+		if err != nil {
+			t.Fatalf("allocate: %v", err)
+		}
+		if got.String() != want {
+			t.Fatalf("allocated %s, want %s", got, want)
+		}
+		used = append(used, got)
+	}
+	if _, err := pool.AllocateSubnet(used); !errors.Is(err, ErrPoolExhausted) {
+		t.Fatalf("expected exhausted pool, got %v", err)
+	}
+
+	// Freed subnets are reused, and subnets from an older, wider configuration are avoided.
+	used = []netip.Prefix{netip.MustParsePrefix("10.8.0.0/23"), netip.MustParsePrefix("10.8.3.0/24")}
+	got, err := pool.AllocateSubnet(used)
+	if err != nil || got.String() != "10.8.2.0/24" {
+		t.Fatalf("allocated %s, %v; want 10.8.2.0/24", got, err)
+	}
+}
+
+func TestAddressPoolRejectsBadConfiguration(t *testing.T) {
+	for _, tc := range []struct {
+		pool string
+		bits int
+	}{
+		{"10.0.0.0/16", 8},
+		{"10.0.0.0/16", 31},
+		{"fd00::/48", 64},
+		{"not-a-prefix", 24},
+	} {
+		if _, err := NewAddressPool(tc.pool, tc.bits); err == nil {
+			t.Fatalf("expected %s with /%d to be rejected", tc.pool, tc.bits)
+		}
+	}
+}
+
+func TestAllocateHostSkipsReservedAndUsedAddresses(t *testing.T) {
+	subnet := netip.MustParsePrefix("10.8.1.0/29")
+	used := map[netip.Addr]bool{}
+	var got []string
+	for {
+		addr, err := AllocateHost(subnet, used)
+		if errors.Is(err, ErrSubnetFull) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("allocate: %v", err)
+		}
+		used[addr] = true
+		got = append(got, addr.String())
+	}
+	want := []string{"10.8.1.2", "10.8.1.3", "10.8.1.4", "10.8.1.5", "10.8.1.6"}
+	if len(got) != len(want) {
+		t.Fatalf("allocated %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("allocated %v, want %v", got, want)
+		}
+	}
+
+	delete(used, netip.MustParseAddr("10.8.1.4"))
+	if addr, err := AllocateHost(subnet, used); err != nil || addr.String() != "10.8.1.4" {
+		t.Fatalf("reclaimed address not reused: %s, %v", addr, err)
+	}
+}
@@ -0,0 +1,212 @@
+package protocol
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Error codes accompanying the 429 returned by /auth/login while attempts are throttled.
+const (
+	ErrorCodeRateLimited   = "rate_limited"
+	ErrorCodeAccountLocked = "account_locked"
+)
+
+// LoginLimits throttles password guessing. Failed logins are counted per client address and
+// per username; once either count passes its free attempts, further logins wait out a delay
+// that doubles with every failure up to MaxDelay. An account that reaches LockoutThreshold
+// failures is locked for LockoutDuration. Counts are forgotten after ResetAfter without a
+// failure, and a successful login clears its account's count.
+type LoginLimits struct {
+	UserFreeAttempts int
+	// IPFreeAttempts is higher since players behind one NAT share an address.
+	IPFreeAttempts   int
+	BaseDelay        time.Duration
+	MaxDelay         time.Duration
+	LockoutThreshold int
+	LockoutDuration  time.Duration
+	ResetAfter       time.Duration
+}
+
+var DefaultLoginLimits = LoginLimits{
+	UserFreeAttempts: 3,
+	IPFreeAttempts:   10,
+	BaseDelay:        time.Second,
+	MaxDelay:         5 * time.Minute,
+	LockoutThreshold: 10,
+	LockoutDuration:  15 * time.Minute,
+	ResetAfter:       time.Hour,
+}
+
+func (l LoginLimits) Validate() error {
+	switch {
+	case l.UserFreeAttempts < 1 || l.IPFreeAttempts < 1:
+		return errors.New("login limits: at least one free attempt is required")
+	case l.BaseDelay <= 0 || l.MaxDelay < l.BaseDelay:
+		return errors.New("login limits: backoff delays must be positive and the maximum at least the base")
+	case l.LockoutThreshold <= l.UserFreeAttempts:
+		return errors.New("login limits: lockout threshold must exceed the free attempts")
+	case l.LockoutDuration <= 0 || l.ResetAfter <= 0:
+		return errors.New("login limits: lockout duration and reset window must be positive")
+	}
+	return nil
+}
+
+// SetLoginLimits replaces the login throttling policy; counts already collected are kept.
+func (s *Server) SetLoginLimits(l LoginLimits) error {
+	if err := l.Validate(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.loginLimits = l
+	return nil
+}
+
+type loginFailures struct {
+	Count        int
+	Last         time.Time
+	BlockedUntil time.Time
+	Locked       bool
+	// Addresses, kept for accounts only, lists where the failures came from so clearing a
+	// lockout can lift the backoff those addresses built up too.
+	Addresses map[string]bool
+}
+
+// fail counts one more failure, forgetting earlier ones that are too old, and works out how
+// long the next attempt has to wait.
+func (f *loginFailures) fail(now time.Time, free int, l LoginLimits) {
+	if now.Sub(f.Last) >= l.ResetAfter {
+		f.Count, f.Locked = 0, false
+	}
+	f.Count++
+	f.Last = now
+	if f.Count > free {
+		delay := l.MaxDelay
+		if shift := f.Count - free - 1; shift < 32 && l.BaseDelay<<shift < l.MaxDelay {
+			delay = l.BaseDelay << shift
+		}
+		f.BlockedUntil = now.Add(delay)
+	}
+}
+
+// loginBlockedLocked reports how long a login for username from ip must wait, and the error
+// code explaining why; zero means it may proceed.
+func (s *Server) loginBlockedLocked(ip, username string, now time.Time) (time.Duration, string) {
+	var wait time.Duration
+	code := ErrorCodeRateLimited
+	if f, ok := s.loginFailuresByUser[username]; ok && now.Before(f.BlockedUntil) {
+		wait = f.BlockedUntil.Sub(now)
+		if f.Locked {
+			code = ErrorCodeAccountLocked
+		}
+	}
+	if f, ok := s.loginFailuresByIP[ip]; ok && f.BlockedUntil.Sub(now) > wait {
+		wait = f.BlockedUntil.Sub(now)
+	}
+	return wait, code
+}
+
+// beginLoginAttemptLocked counts an attempt as failed before its password is checked, so
+// concurrent guesses cannot slip through while the hash is computed; loginSucceededLocked
+// takes it back.
+func (s *Server) beginLoginAttemptLocked(ip, username string, now time.Time) {
+	l := s.loginLimits
+	ipFailures, ok := s.loginFailuresByIP[ip]
+	if !ok {
+		ipFailures = &loginFailures{}
+		s.loginFailuresByIP[ip] = ipFailures
+	}
+	ipFailures.fail(now, l.IPFreeAttempts, l)
+	userFailures, ok := s.loginFailuresByUser[username]
+	if !ok {
+		userFailures = &loginFailures{Addresses: map[string]bool{}}
+		s.loginFailuresByUser[username] = userFailures
+	}
+	userFailures.fail(now, l.UserFreeAttempts, l)
+	userFailures.Addresses[ip] = true
+	if userFailures.Count >= l.LockoutThreshold {
+		userFailures.Locked = true
+		userFailures.BlockedUntil = now.Add(l.LockoutDuration)
+	}
+}
+
+// loginSucceededLocked clears the account's failures. The address keeps its earlier ones, but
+// the delay this attempt added is lifted: the address was not blocked when it began.
+func (s *Server) loginSucceededLocked(ip, username string) {
+	delete(s.loginFailuresByUser, username)
+	if f, ok := s.loginFailuresByIP[ip]; ok {
+		f.Count--
+		f.BlockedUntil = time.Time{}
+	}
+}
+
+// clearLoginFailuresLocked forgets username's failed logins along with those of the addresses
+// they came from, which would otherwise keep the user waiting. It reports whether the account
+// was locked.
+func (s *Server) clearLoginFailuresLocked(username string, now time.Time) bool {
+	f, ok := s.loginFailuresByUser[username]
+	if !ok {
+		return false
+	}
+	for ip := range f.Addresses {
+		delete(s.loginFailuresByIP, ip)
+	}
+	delete(s.loginFailuresByUser, username)
+	return f.Locked && now.Before(f.BlockedUntil)
+}
+
+// pruneLoginFailures drops counts that have aged out, including those of unknown usernames.
+func (s *Server) pruneLoginFailures() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	for _, failures := range []map[string]*loginFailures{s.loginFailuresByIP, s.loginFailuresByUser} {
+		for key, f := range failures {
+			if now.Sub(f.Last) >= s.loginLimits.ResetAfter && !now.Before(f.BlockedUntil) {
+				delete(failures, key)
+			}
+		}
+	}
+}
+
+// lockedAccountsLocked lists the existing accounts currently locked out, by username.
+func (s *Server) lockedAccountsLocked(now time.Time) []LockedAccount {
+	locked := []LockedAccount{}
+	for username, f := range s.loginFailuresByUser {
+		if _, exists := s.users[username]; !exists || !f.Locked || !now.Before(f.BlockedUntil) {
+			continue
+		}
+		locked = append(locked, LockedAccount{
+			Username:        username,
+			FailedAttempts:  f.Count,
+			LastFailureUnix: f.Last.Unix(),
+			LockedUntilUnix: f.BlockedUntil.Unix(),
+		})
+	}
+	sort.Slice(locked, func(i, j int) bool { return locked[i].Username < locked[j].Username })
+	return locked
+}
+
+// clientIP is the address login attempts are counted against: the TCP peer, since the
+// control plane is served directly rather than behind a proxy.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func writeThrottled(w http.ResponseWriter, wait time.Duration, code string) {
+	seconds := int((wait + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	err := errors.New("too many failed logins; try again later")
+	if code == ErrorCodeAccountLocked {
+		err = errors.New("account temporarily locked after repeated failed logins")
+	}
+	writeErrorCode(w, http.StatusTooManyRequests, code, err)
+}
@@ -0,0 +1,121 @@
+package protocol
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// PasswordParams are the Argon2id cost settings new password hashes are created with. Hashes
+// made with other settings still verify and are upgraded on the user's next login.
+type PasswordParams struct {
+	// Memory is in KiB.
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// DefaultPasswordParams follow the OWASP baseline for Argon2id (19 MiB, 2 passes, 1 lane).
+var DefaultPasswordParams = PasswordParams{
+	Memory:      19 * 1024,
+	Iterations:  2,
+	Parallelism: 1,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+func (p PasswordParams) Validate() error {
+	switch {
+	case p.Iterations < 1:
+		return errors.New("argon2id: at least one iteration is required")
+	case p.Parallelism < 1:
+		return errors.New("argon2id: parallelism must be at least 1")
+	case p.Memory < 8*uint32(p.Parallelism):
+		return fmt.Errorf("argon2id: memory must be at least %d KiB for parallelism %d", 8*uint32(p.Parallelism), p.Parallelism)
+	case p.SaltLength < 8:
+		return errors.New("argon2id: salt must be at least 8 bytes")
+	case p.KeyLength < 16:
+		return errors.New("argon2id: key must be at least 16 bytes")
+	}
+	return nil
+}
+
+const argon2idPrefix = "$argon2id$"
+
+// HashPassword derives an Argon2id hash with a fresh salt and encodes it as a PHC string:
+// $argon2id$v=19$m=<KiB>,t=<iterations>,p=<parallelism>$<salt>$<key>, both base64 without padding.
+func HashPassword(password string, p PasswordParams) (string, error) {
+	salt := make([]byte, p.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("argon2id: salt: %w", err)
+	}
+	key := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2idPrefix, argon2.Version, p.Memory, p.Iterations, p.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// verifyPassword checks password against a stored hash. Hashes that are not PHC Argon2id
+// strings are treated as the legacy salted SHA-256 scheme, which needs legacySalt. rehash
+// reports a match whose hash should be replaced because it uses the legacy scheme or
+// parameters other than current.
+func verifyPassword(password, stored, legacySalt string, current PasswordParams) (ok, rehash bool) {
+	if !strings.HasPrefix(stored, argon2idPrefix) {
+		ok = subtle.ConstantTimeCompare([]byte(stored), []byte(legacyPasswordHash(password, legacySalt))) == 1
+		return ok, ok
+	}
+	params, salt, key, err := decodeArgon2id(stored)
+	if err != nil {
+		return false, false
+	}
+	candidate := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+	if subtle.ConstantTimeCompare(key, candidate) != 1 {
+		return false, false
+	}
+	return true, params.Memory != current.Memory || params.Iterations != current.Iterations ||
+		params.Parallelism != current.Parallelism || params.SaltLength != current.SaltLength ||
+		params.KeyLength != current.KeyLength
+}
+
+func decodeArgon2id(encoded string) (PasswordParams, []byte, []byte, error) {
+	// "", "argon2id", "v=19", "m=..,t=..,p=..", salt, key
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return PasswordParams{}, nil, nil, errors.New("argon2id: malformed hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return PasswordParams{}, nil, nil, fmt.Errorf("argon2id: unsupported version %q", parts[2])
+	}
+	var p PasswordParams
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Iterations, &p.Parallelism); err != nil {
+		return PasswordParams{}, nil, nil, fmt.Errorf("argon2id: parameters: %w", err)
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return PasswordParams{}, nil, nil, fmt.Errorf("argon2id: salt: %w", err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return PasswordParams{}, nil, nil, fmt.Errorf("argon2id: key: %w", err)
+	}
+	p.SaltLength, p.KeyLength = uint32(len(salt)), uint32(len(key))
+	if err := p.Validate(); err != nil {
+		return PasswordParams{}, nil, nil, err
+	}
+	return p, salt, key, nil
+}
+
+// legacyPasswordHash is the single salted SHA-256 earlier releases stored; it is only used to
+// verify those records until they are rehashed.
+func legacyPasswordHash(password, salt string) string {
+	sum := sha256.Sum256([]byte(salt + ":" + password))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,72 @@
+package protocol
+
+import (
+	"strings"
+	"testing"
+)
+
+// testPasswordParams keeps hashing cheap in tests.
+var testPasswordParams = PasswordParams{Memory: 64, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+
+func TestHashPasswordRoundTrip(t *testing.T) {
+	hash, err := HashPassword("hunter2", testPasswordParams)
+	if err != nil {
+		t.Fatalf("hash: %v", err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Fatalf("unexpected PHC string %q", hash)
+	}
+	if ok, rehash := verifyPassword("hunter2", hash, "", testPasswordParams); !ok || rehash {
+		t.Fatalf("verify = %t, rehash = %t", ok, rehash)
+	}
+	if ok, _ := verifyPassword("hunter3", hash, "", testPasswordParams); ok {
+		t.Fatalf("wrong password verified")
+	}
+	other, _ := HashPassword("hunter2", testPasswordParams)
+	if other == hash {
+		t.Fatalf("hashes should be salted")
+	}
+}
+
+func TestVerifyPasswordFlagsOutdatedParams(t *testing.T) {
+	hash, _ := HashPassword("hunter2", testPasswordParams)
+	stronger := testPasswordParams
+	stronger.Iterations = 2
+	if ok, rehash := verifyPassword("hunter2", hash, "", stronger); !ok || !rehash {
+		t.Fatalf("verify = %t, rehash = %t; want true, true", ok, rehash)
+	}
+}
+
+func TestVerifyPasswordAcceptsLegacyHash(t *testing.T) {
+	legacy := legacyPasswordHash("hunter2", "salt")
+	if ok, rehash := verifyPassword("hunter2", legacy, "salt", testPasswordParams); !ok || !rehash {
+		t.Fatalf("verify = %t, rehash = %t; want true, true", ok, rehash)
+	}
+	if ok, _ := verifyPassword("hunter2", legacy, "pepper", testPasswordParams); ok {
+		t.Fatalf("legacy hash verified with the wrong salt")
+	}
+}
+
+func TestVerifyPasswordRejectsMalformedHash(t *testing.T) {
+	for _, stored := range []string{
+		"$argon2id$v=19$m=64,t=1,p=1$!!$!!",
+		"$argon2id$v=16$m=64,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2U",
+		"$argon2id$v=19$m=64,t=0,p=1$c2FsdHNhbHRzYWx0c2FsdA$a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2U",
+		"$argon2id$",
+	} {
+		if ok, _ := verifyPassword("hunter2", stored, "", testPasswordParams); ok {
+			t.Fatalf("malformed hash %q verified", stored)
+		}
+	}
+}
+
+func TestPasswordParamsValidate(t *testing.T) {
+	if err := DefaultPasswordParams.Validate(); err != nil {
+		t.Fatalf("defaults invalid: %v", err)
+	}
+	bad := DefaultPasswordParams
+	bad.Iterations = 0
+	if err := bad.Validate(); err == nil {
+		t.Fatalf("expected zero iterations to be rejected")
+	}
+}
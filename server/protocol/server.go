@@ -2,15 +2,16 @@ package protocol
 
 import (
 	"crypto/rand"
-	"crypto/sha256"
-	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
 	"net/http"
+	"net/netip"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -28,25 +29,35 @@ const (
 	CipherSuiteChaCha20Poly1305 CipherSuite = "chacha20-poly1305"
 )
 
+// LoginRequest enrolls the device it is sent from. DeviceID names a device of the user to
+// enroll or re-enroll; when empty a new device ID is generated. Device IDs are per user, and
+// rooms can only be joined from enrolled devices.
 type LoginRequest struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
+	Username   string `json:"username"`
+	Password   string `json:"password"`
+	DeviceID   string `json:"device_id,omitempty"`
+	DeviceName string `json:"device_name,omitempty"`
+	Platform   string `json:"platform,omitempty"`
 }
 
 type RegisterRequest struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
-	DeviceID string `json:"device_id"`
+	Username   string `json:"username"`
+	Password   string `json:"password"`
+	DeviceID   string `json:"device_id"`
+	DeviceName string `json:"device_name,omitempty"`
+	Platform   string `json:"platform,omitempty"`
 }
 
 type LoginResponse struct {
 	SessionToken string `json:"session_token"`
 	DeviceToken  string `json:"device_token"`
+	DeviceID     string `json:"device_id"`
 }
 
 type RegisterResponse struct {
 	SessionToken string `json:"session_token"`
 	DeviceToken  string `json:"device_token"`
+	DeviceID     string `json:"device_id"`
 }
 
 type RefreshTokenRequest struct {
@@ -57,11 +68,111 @@ type RefreshTokenResponse struct {
 	SessionToken string `json:"session_token"`
 }
 
+type ListLockoutsRequest struct {
+	SessionToken string `json:"session_token"`
+}
+
+// LockedAccount is an account refusing logins after too many failed attempts.
+type LockedAccount struct {
+	Username        string `json:"username"`
+	FailedAttempts  int    `json:"failed_attempts"`
+	LastFailureUnix int64  `json:"last_failure_unix_sec"`
+	LockedUntilUnix int64  `json:"locked_until_unix_sec"`
+}
+
+type ListLockoutsResponse struct {
+	Accounts []LockedAccount `json:"accounts"`
+}
+
+// ClearLockoutRequest unlocks TargetUser and forgets their failed logins, lifting any backoff
+// on the addresses those logins came from.
+type ClearLockoutRequest struct {
+	SessionToken string `json:"session_token"`
+	TargetUser   string `json:"target_user"`
+}
+
+type ClearLockoutResponse struct {
+	Username string `json:"username"`
+	// WasLocked reports whether the account was locked out when it was cleared.
+	WasLocked bool `json:"was_locked"`
+}
+
+type DeviceInfo struct {
+	DeviceID      string `json:"device_id"`
+	Name          string `json:"name"`
+	Platform      string `json:"platform,omitempty"`
+	CreatedAtUnix int64  `json:"created_at_unix_sec"`
+	LastUsedUnix  int64  `json:"last_used_unix_sec"`
+	Revoked       bool   `json:"revoked"`
+}
+
+type ListDevicesRequest struct {
+	SessionToken string `json:"session_token"`
+}
+
+type ListDevicesResponse struct {
+	Devices []DeviceInfo `json:"devices"`
+}
+
+type RenameDeviceRequest struct {
+	SessionToken string `json:"session_token"`
+	DeviceID     string `json:"device_id"`
+	Name         string `json:"name"`
+}
+
+// RevokeDeviceRequest stops a device from refreshing sessions or joining rooms, ends the
+// sessions issued to it and tears down its tunnels. Logging in from the device again
+// re-enrolls it.
+type RevokeDeviceRequest struct {
+	SessionToken string `json:"session_token"`
+	DeviceID     string `json:"device_id"`
+}
+
+type RevokeDeviceResponse struct {
+	Device DeviceInfo `json:"device"`
+	// RevokedTunnels counts the data-plane sessions the device lost.
+	RevokedTunnels int `json:"revoked_tunnels"`
+	// RevokedSessions counts the control-plane sessions issued to the device that were ended.
+	RevokedSessions int `json:"revoked_sessions"`
+}
+
+type LogoutRequest struct {
+	SessionToken string `json:"session_token"`
+}
+
+type LogoutResponse struct {
+	Username string `json:"username"`
+}
+
+// RevokeSessionsRequest ends every session of TargetUser. Admins may target anyone; other
+// users only themselves.
+type RevokeSessionsRequest struct {
+	SessionToken string `json:"session_token"`
+	TargetUser   string `json:"target_user"`
+}
+
+type RevokeSessionsResponse struct {
+	Username string `json:"username"`
+	Revoked  int    `json:"revoked"`
+}
+
 type CreateRoomRequest struct {
 	Name               string    `json:"name"`
 	PreferredTransport Transport `json:"preferred_transport"`
 	MTU                int       `json:"mtu"`
-	SessionToken       string    `json:"session_token"`
+	// Password, when set, must be presented by users joining without an invite code.
+	Password string `json:"password,omitempty"`
+	// InviteOnly rooms can only be joined with an invite code and are hidden from users who
+	// have no role in them.
+	InviteOnly bool `json:"invite_only,omitempty"`
+	// MaxMembers caps how many devices may be joined at once; 0 means no limit. With Waitlist
+	// set, joins beyond the cap queue up and are admitted in order as slots free up.
+	MaxMembers int  `json:"max_members,omitempty"`
+	Waitlist   bool `json:"waitlist,omitempty"`
+	// IdleTimeoutSec, when set, deletes the room after that many seconds without activity.
+	// It must be at least 60.
+	IdleTimeoutSec int    `json:"idle_timeout_seconds,omitempty"`
+	SessionToken   string `json:"session_token"`
 }
 
 type CreateRoomResponse struct {
@@ -71,18 +182,190 @@ type CreateRoomResponse struct {
 	MTU                int       `json:"mtu"`
 }
 
+type ListRoomsRequest struct {
+	SessionToken string `json:"session_token"`
+}
+
+// RoomSummary is one entry of the room list a user picks from.
+type RoomSummary struct {
+	RoomID             string    `json:"room_id"`
+	Name               string    `json:"name"`
+	PreferredTransport Transport `json:"preferred_transport"`
+	MTU                int       `json:"mtu"`
+	OverlaySubnet      string    `json:"overlay_subnet"`
+	Owner              string    `json:"owner,omitempty"`
+	MemberCount        int       `json:"member_count"`
+	HasPassword        bool      `json:"has_password"`
+	InviteOnly         bool      `json:"invite_only"`
+	MaxMembers         int       `json:"max_members,omitempty"`
+	Waitlist           bool      `json:"waitlist"`
+	WaitingCount       int       `json:"waiting_count"`
+	IdleTimeoutSec     int       `json:"idle_timeout_seconds,omitempty"`
+	// IsMember reports whether any of the caller's devices has joined the room.
+	IsMember bool `json:"is_member"`
+	// Role is the caller's role in the room, empty when they have none.
+	Role RoomRole `json:"role,omitempty"`
+}
+
+type ListRoomsResponse struct {
+	Rooms []RoomSummary `json:"rooms"`
+}
+
+type GetRoomRequest struct {
+	RoomID       string `json:"room_id"`
+	SessionToken string `json:"session_token"`
+}
+
+type RoomMember struct {
+	DeviceID     string   `json:"device_id"`
+	Username     string   `json:"username"`
+	VirtualIP    string   `json:"virtual_ip"`
+	Role         RoomRole `json:"role"`
+	JoinedAtUnix int64    `json:"joined_at_unix_sec"`
+	LastSeenUnix int64    `json:"last_seen_unix_sec"`
+}
+
+type RoomBan struct {
+	Username      string `json:"username,omitempty"`
+	DeviceID      string `json:"device_id,omitempty"`
+	BannedBy      string `json:"banned_by"`
+	ExpiresAtUnix int64  `json:"expires_at_unix_sec"`
+}
+
+type RoomDetail struct {
+	RoomSummary
+	KeepaliveIntervalSec int          `json:"keepalive_interval_seconds"`
+	Members              []RoomMember `json:"members"`
+	// Bans is only filled in for callers who may lift them.
+	Bans []RoomBan `json:"bans,omitempty"`
+}
+
+// UpdateRoomRequest changes a room's settings; zero-valued fields are left as they are.
+// Members pick up transport, MTU and keepalive changes the next time they join.
+type UpdateRoomRequest struct {
+	RoomID               string    `json:"room_id"`
+	Name                 string    `json:"name,omitempty"`
+	PreferredTransport   Transport `json:"preferred_transport,omitempty"`
+	MTU                  int       `json:"mtu,omitempty"`
+	KeepaliveIntervalSec int       `json:"keepalive_interval_seconds,omitempty"`
+	// Password replaces the join password; ClearPassword removes it.
+	Password      string `json:"password,omitempty"`
+	ClearPassword bool   `json:"clear_password,omitempty"`
+	InviteOnly    *bool  `json:"invite_only,omitempty"`
+	// MaxMembers replaces the member cap when set; 0 removes it.
+	MaxMembers *int  `json:"max_members,omitempty"`
+	Waitlist   *bool `json:"waitlist,omitempty"`
+	// IdleTimeoutSec replaces the idle timeout when set; 0 makes the room permanent.
+	IdleTimeoutSec *int   `json:"idle_timeout_seconds,omitempty"`
+	SessionToken   string `json:"session_token"`
+}
+
+// CreateInviteRequest asks for an invite code to a room. A zero TTL uses DefaultInviteTTL; a
+// zero MaxUses allows any number of joins until the code expires.
+type CreateInviteRequest struct {
+	RoomID       string `json:"room_id"`
+	TTLSeconds   int    `json:"ttl_seconds,omitempty"`
+	MaxUses      int    `json:"max_uses,omitempty"`
+	SessionToken string `json:"session_token"`
+}
+
+type CreateInviteResponse struct {
+	RoomID        string `json:"room_id"`
+	Code          string `json:"code"`
+	ExpiresAtUnix int64  `json:"expires_at_unix_sec"`
+	MaxUses       int    `json:"max_uses"`
+}
+
+type DeleteRoomRequest struct {
+	RoomID       string `json:"room_id"`
+	SessionToken string `json:"session_token"`
+}
+
+type DeleteRoomResponse struct {
+	RoomID string `json:"room_id"`
+	// DisconnectedDevices lists the members whose tunnels were revoked with the room.
+	DisconnectedDevices []string `json:"disconnected_devices"`
+}
+
+// KickMemberRequest removes a device from a room; it may join again. Device IDs are per
+// account, so Username is needed when several members' devices share DeviceID.
+type KickMemberRequest struct {
+	RoomID       string `json:"room_id"`
+	DeviceID     string `json:"device_id"`
+	Username     string `json:"username,omitempty"`
+	SessionToken string `json:"session_token"`
+}
+
+type KickMemberResponse struct {
+	RoomID   string `json:"room_id"`
+	DeviceID string `json:"device_id"`
+}
+
+// BanRequest bars a user (all of their devices), or with DeviceID one of their devices, from
+// a room. Username may be left out of a device ban when the device is in the room under a
+// single account. A zero DurationSeconds bans until lifted.
+type BanRequest struct {
+	RoomID          string `json:"room_id"`
+	Username        string `json:"username,omitempty"`
+	DeviceID        string `json:"device_id,omitempty"`
+	DurationSeconds int    `json:"duration_seconds,omitempty"`
+	SessionToken    string `json:"session_token"`
+}
+
+type BanResponse struct {
+	RoomID   string `json:"room_id"`
+	Username string `json:"username,omitempty"`
+	DeviceID string `json:"device_id,omitempty"`
+	// ExpiresAtUnix is 0 for a ban without expiry.
+	ExpiresAtUnix int64 `json:"expires_at_unix_sec"`
+	// RemovedDevices lists the members disconnected by the ban.
+	RemovedDevices []string `json:"removed_devices"`
+}
+
+// UnbanRequest lifts the ban matching Username and DeviceID. Username may be left out when
+// only one account has a ban on DeviceID.
+type UnbanRequest struct {
+	RoomID       string `json:"room_id"`
+	Username     string `json:"username,omitempty"`
+	DeviceID     string `json:"device_id,omitempty"`
+	SessionToken string `json:"session_token"`
+}
+
 type JoinRoomRequest struct {
 	RoomID       string `json:"room_id"`
 	DeviceID     string `json:"device_id"`
 	SessionToken string `json:"session_token"`
+	// RotateKey replaces the device's data-plane session key and peer ID; otherwise joining again
+	// returns the session the device already holds.
+	RotateKey bool `json:"rotate_key,omitempty"`
+	// Password or InviteCode admit a device whose user has no role in a protected room yet.
+	Password   string `json:"password,omitempty"`
+	InviteCode string `json:"invite_code,omitempty"`
 }
 
 type JoinRoomResponse struct {
 	VirtualIP              string    `json:"virtual_ip"`
 	SessionKey             string    `json:"session_key"`
+	PeerID                 uint32    `json:"peer_id"`
 	Transport              Transport `json:"transport"`
 	KeepaliveIntervalSec   int       `json:"keepalive_interval_seconds"`
+	MTU                    int       `json:"mtu,omitempty"`
 	OverlaySubnetReference string    `json:"overlay_subnet,omitempty"`
+	// Waitlisted is set (with status 202 Accepted and no session) when the room is full and
+	// the device was queued instead; joining again reports its place until it is admitted.
+	Waitlisted       bool `json:"waitlisted,omitempty"`
+	WaitlistPosition int  `json:"waitlist_position,omitempty"`
+}
+
+type LeaveRoomRequest struct {
+	RoomID       string `json:"room_id"`
+	DeviceID     string `json:"device_id"`
+	SessionToken string `json:"session_token"`
+}
+
+type LeaveRoomResponse struct {
+	RoomID   string `json:"room_id"`
+	DeviceID string `json:"device_id"`
 }
 
 type Keepalive struct {
@@ -97,6 +380,8 @@ type KeepaliveAck struct {
 
 type TunnelOffer struct {
 	RoomID       string      `json:"room_id"`
+	DeviceID     string      `json:"device_id"`
+	SessionToken string      `json:"session_token"`
 	Transport    Transport   `json:"transport"`
 	CipherSuite  CipherSuite `json:"cipher_suite"`
 	EphemeralKey string      `json:"ephemeral_pub_key"`
@@ -106,6 +391,53 @@ type TunnelAnswer struct {
 	Transport    Transport   `json:"transport"`
 	CipherSuite  CipherSuite `json:"cipher_suite"`
 	EphemeralKey string      `json:"ephemeral_pub_key"`
+	DataPort     int         `json:"data_port,omitempty"`
+	// FallbackPort is the TCP data-plane port offered when UDP is negotiated, so clients can
+	// fall back without another bootstrap. DataTLS applies to whichever TCP port is used.
+	FallbackPort int  `json:"fallback_port,omitempty"`
+	DataTLS      bool `json:"data_tls,omitempty"`
+}
+
+// RoomRole is a user's standing within one room, independent of global admin rights.
+type RoomRole string
+
+const (
+	// RoomRoleOwner created the room (or had it transferred to them) and may delete it and
+	// assign roles.
+	RoomRoleOwner RoomRole = "owner"
+	// RoomRoleModerator may change the room's settings.
+	RoomRoleModerator RoomRole = "moderator"
+	// RoomRoleMember has at least one device joined to the room.
+	RoomRoleMember RoomRole = "member"
+)
+
+// rank orders roles so permission checks can ask for "at least" a role.
+func (r RoomRole) rank() int {
+	switch r {
+	case RoomRoleOwner:
+		return 3
+	case RoomRoleModerator:
+		return 2
+	case RoomRoleMember:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// RoomRoleUpdateRequest assigns TargetUser a role in a room. Assigning RoomRoleOwner transfers
+// ownership and leaves the previous owner a moderator; RoomRoleMember clears a moderator.
+type RoomRoleUpdateRequest struct {
+	RoomID       string   `json:"room_id"`
+	TargetUser   string   `json:"target_user"`
+	Role         RoomRole `json:"role"`
+	SessionToken string   `json:"session_token"`
+}
+
+type RoomRoleUpdateResponse struct {
+	RoomID   string   `json:"room_id"`
+	Username string   `json:"username"`
+	Role     RoomRole `json:"role"`
 }
 
 type AdminRoleUpdateRequest struct {
@@ -119,22 +451,102 @@ type AdminRoleUpdateResponse struct {
 	IsAdmin  bool   `json:"is_admin"`
 }
 
+// TunnelSession holds the data-plane credentials issued to a device when it joins a room.
+type TunnelSession struct {
+	PeerID    uint32
+	RoomID    string
+	DeviceID  string
+	Username  string
+	VirtualIP string
+	// Subnet is the room's overlay subnet, which the data plane needs to recognise broadcasts.
+	Subnet string
+	Key    []byte
+
+	// The bootstrap fields are filled in by /tunnel/bootstrap; frames are rejected until then.
+	CipherSuite  CipherSuite
+	SharedSecret []byte
+	OfferKey     []byte
+	AnswerKey    []byte
+}
+
+// Bootstrapped reports whether the session has completed the ephemeral key exchange.
+func (t TunnelSession) Bootstrapped() bool {
+	return len(t.SharedSecret) > 0
+}
+
+// maxPeerID is the largest peer ID that fits the 24-bit field of a data frame; 0xFFFFFF is
+// reserved as "undefined" by OpenVPN.
+const maxPeerID = 0xFFFFFE
+
+// DefaultInviteTTL is how long an invite code stays valid when the owner does not say;
+// maxInviteTTL bounds what they may ask for.
+const (
+	DefaultInviteTTL = 24 * time.Hour
+	maxInviteTTL     = 7 * 24 * time.Hour
+)
+
+// ErrorCodeRoomFull accompanies the 409 returned when a room without a waitlist is at capacity.
+const ErrorCodeRoomFull = "room_full"
+
+// DefaultRoomLimit is how many rooms a user without global admin rights may own.
+const DefaultRoomLimit = 3
+
+// Bounds accepted when a room is created or its settings are updated. 576 is the smallest MTU
+// IPv4 hosts must accept; anything above 1500 would fragment on a typical internet path.
+const (
+	minRoomMTU = 576
+	maxRoomMTU = 1500
+)
+
+// minRoomIdleTimeout is the shortest idle timeout, in seconds, a room may have. The data plane
+// reports tunnel activity at most every 30 seconds, so anything shorter could expire a room
+// whose members are busy playing.
+const minRoomIdleTimeout = 60
+
+// MaxKeepaliveInterval is the longest keepalive interval, in seconds, a room may ask its
+// members for; the data plane treats streams silent for a few of these as dead.
+const MaxKeepaliveInterval = 300
+
 type Server struct {
 	mux         *http.ServeMux
 	mu          sync.Mutex
 	users       map[string]userRecord
-	sessions    map[string]string
-	deviceBags  map[string]string
+	sessions    map[string]*sessionRecord // keyed by hashToken(session token)
+	devices     map[string]*deviceRecord
 	rooms       map[string]*roomRecord
+	tunnels     map[uint32]TunnelSession
+	nextPeerID  uint32
+	dataPorts   map[Transport]int
+	dataTLS     bool
+	pool        AddressPool
+	roomLimit   int
 	persistPath string
+	now         func() time.Time
+
+	passwordParams PasswordParams
+
+	// deviceTokens maps hashToken(device refresh token) to the deviceKey it was issued to.
+	deviceTokens map[string]string
+
+	sessionIdle     time.Duration
+	sessionMaxAge   time.Duration
+	persistSessions bool
+
+	// Login throttling state is kept in memory only; a restart forgives past failures.
+	loginLimits         LoginLimits
+	loginFailuresByIP   map[string]*loginFailures
+	loginFailuresByUser map[string]*loginFailures
 }
 
 type userRecord struct {
 	Username string
-	Salt     string
-	Hash     string
-	Device   string
-	IsAdmin  bool
+	// Hash is an Argon2id PHC string. Records from before Argon2id hold a salted SHA-256 here
+	// with its Salt until the user's next login rehashes them.
+	Salt string `json:",omitempty"`
+	Hash string
+	// Device is only read from state files written before the device registry.
+	Device  string `json:",omitempty"`
+	IsAdmin bool
 }
 
 type roomRecord struct {
@@ -144,7 +556,79 @@ type roomRecord struct {
 	MTU                int
 	OverlaySubnet      string
 	KeepaliveInterval  int
-	Members            map[string]string
+	// Owner is the user who manages the room; rooms from before ownership existed have none
+	// and are managed by global admins only.
+	Owner string `json:",omitempty"`
+	// Moderators holds the usernames the owner has promoted.
+	Moderators map[string]bool `json:",omitempty"`
+	// PasswordHash protects joining when set, hashed like account passwords; PasswordSalt is
+	// only set on hashes from before Argon2id.
+	PasswordSalt string `json:",omitempty"`
+	PasswordHash string `json:",omitempty"`
+	InviteOnly   bool   `json:",omitempty"`
+	// Invites is keyed by hashToken(invite code).
+	Invites map[string]*inviteRecord `json:",omitempty"`
+	Bans    []banRecord              `json:",omitempty"`
+	// IdleTimeout, in seconds, makes the room ephemeral: it is deleted once nobody has been
+	// active in it for that long. LastActive covers activity not recorded on a member, such as
+	// creation and the last member leaving.
+	IdleTimeout int `json:",omitempty"`
+	LastActive  time.Time
+	// MaxMembers of 0 means no cap.
+	MaxMembers int  `json:",omitempty"`
+	Waitlist   bool `json:",omitempty"`
+	// Waiting is the queue of devices admitted to the room but not yet given a slot.
+	Waiting []waitingRecord `json:",omitempty"`
+	// Members is keyed by deviceKey; each member holds its address lease in OverlaySubnet.
+	Members map[string]*memberRecord
+	// Leases is only read from state files written before members carried their address.
+	Leases map[string]string `json:",omitempty"`
+}
+
+type inviteRecord struct {
+	CreatedBy string
+	ExpiresAt time.Time
+	MaxUses   int
+	Uses      int
+}
+
+func (inv *inviteRecord) usable(now time.Time) bool {
+	return now.Before(inv.ExpiresAt) && (inv.MaxUses == 0 || inv.Uses < inv.MaxUses)
+}
+
+// banRecord bars either a whole account (Username) or one of its devices (Username and
+// DeviceID) from a room. Device bans from before device IDs were per account have no Username
+// and match the ID under any account.
+type banRecord struct {
+	Username  string `json:",omitempty"`
+	DeviceID  string `json:",omitempty"`
+	BannedBy  string
+	ExpiresAt time.Time `json:",omitempty"`
+}
+
+func (b banRecord) active(now time.Time) bool {
+	return b.ExpiresAt.IsZero() || now.Before(b.ExpiresAt)
+}
+
+func (b banRecord) matches(username, deviceID string) bool {
+	if b.DeviceID == "" {
+		return b.Username == username
+	}
+	return b.DeviceID == deviceID && (b.Username == "" || b.Username == username)
+}
+
+type waitingRecord struct {
+	DeviceID string
+	Username string
+	QueuedAt time.Time
+}
+
+type memberRecord struct {
+	DeviceID  string
+	Username  string
+	VirtualIP string
+	JoinedAt  time.Time
+	LastSeen  time.Time
 }
 
 func NewServer() *Server {
@@ -154,13 +638,33 @@ func NewServer() *Server {
 
 // NewServerWithStorage loads state from disk when persistPath is non-empty and persists changes.
 func NewServerWithStorage(persistPath string) (*Server, error) {
+	pool, err := NewAddressPool(DefaultAddressPool, DefaultRoomPrefixLen)
+	if err != nil {
+		return nil, err
+	}
 	s := &Server{
 		mux:         http.NewServeMux(),
 		users:       map[string]userRecord{},
-		sessions:    map[string]string{},
-		deviceBags:  map[string]string{},
+		sessions:    map[string]*sessionRecord{},
+		devices:     map[string]*deviceRecord{},
 		rooms:       map[string]*roomRecord{},
+		tunnels:     map[uint32]TunnelSession{},
+		dataPorts:   map[Transport]int{},
+		pool:        pool,
+		roomLimit:   DefaultRoomLimit,
+		now:         time.Now,
 		persistPath: persistPath,
+
+		deviceTokens: map[string]string{},
+
+		passwordParams:  DefaultPasswordParams,
+		sessionIdle:     DefaultSessionIdleTimeout,
+		sessionMaxAge:   DefaultSessionMaxAge,
+		persistSessions: true,
+
+		loginLimits:         DefaultLoginLimits,
+		loginFailuresByIP:   map[string]*loginFailures{},
+		loginFailuresByUser: map[string]*loginFailures{},
 	}
 	s.registerRoutes()
 
@@ -171,8 +675,9 @@ func NewServerWithStorage(persistPath string) (*Server, error) {
 		// When persistence is enabled and no users exist yet, allow the first real registration
 		// to become the administrator instead of seeding a demo account.
 		if len(s.users) == 0 {
-			s.sessions = map[string]string{}
-			s.deviceBags = map[string]string{}
+			s.sessions = map[string]*sessionRecord{}
+			s.devices = map[string]*deviceRecord{}
+			s.deviceTokens = map[string]string{}
 		}
 	} else {
 		s.seedDemoUser()
@@ -189,22 +694,102 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	s.mux.ServeHTTP(w, r)
 }
 
+// SetDataPlanePort records the port of the data-plane listener for transport so tunnel
+// negotiation can advertise it to clients.
+func (s *Server) SetDataPlanePort(transport Transport, port int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dataPorts[transport] = port
+}
+
+// SetDataPlaneTLS records whether the TCP data-plane listener expects TLS.
+func (s *Server) SetDataPlaneTLS(enabled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dataTLS = enabled
+}
+
+// SetPasswordParams changes the Argon2id cost for passwords hashed from now on; existing
+// hashes are upgraded as their users log in.
+func (s *Server) SetPasswordParams(p PasswordParams) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.passwordParams = p
+	return nil
+}
+
+// SetRoomLimit caps how many rooms a non-admin user may own at once; 0 restricts room
+// creation to global admins.
+func (s *Server) SetRoomLimit(n int) error {
+	if n < 0 {
+		return fmt.Errorf("room limit must not be negative, got %d", n)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.roomLimit = n
+	return nil
+}
+
+// SetAddressPool changes the range new room subnets are allocated from. Existing rooms keep
+// their subnets, and new ones never overlap them.
+func (s *Server) SetAddressPool(pool string, prefixLen int) error {
+	p, err := NewAddressPool(pool, prefixLen)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pool = p
+	return nil
+}
+
+// LookupTunnelSession returns the data-plane session bound to peerID, if the device still holds one.
+func (s *Server) LookupTunnelSession(peerID uint32) (TunnelSession, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.tunnels[peerID]
+	return session, ok
+}
+
 func (s *Server) registerRoutes() {
 	s.mux.HandleFunc("/auth/register", s.handleRegister)
 	s.mux.HandleFunc("/auth/login", s.handleLogin)
 	s.mux.HandleFunc("/auth/refresh", s.handleRefresh)
+	s.mux.HandleFunc("/auth/logout", s.handleLogout)
+	s.mux.HandleFunc("/devices/list", s.handleListDevices)
+	s.mux.HandleFunc("/devices/rename", s.handleRenameDevice)
+	s.mux.HandleFunc("/devices/revoke", s.handleRevokeDevice)
 	s.mux.HandleFunc("/rooms", s.handleCreateRoom)
+	s.mux.HandleFunc("/rooms/list", s.handleListRooms)
+	s.mux.HandleFunc("/rooms/get", s.handleGetRoom)
+	s.mux.HandleFunc("/rooms/update", s.handleUpdateRoom)
+	s.mux.HandleFunc("/rooms/delete", s.handleDeleteRoom)
+	s.mux.HandleFunc("/rooms/role", s.handleRoomRoleUpdate)
+	s.mux.HandleFunc("/rooms/invite", s.handleCreateInvite)
+	s.mux.HandleFunc("/rooms/kick", s.handleKickMember)
+	s.mux.HandleFunc("/rooms/ban", s.handleBan)
+	s.mux.HandleFunc("/rooms/unban", s.handleUnban)
 	s.mux.HandleFunc("/rooms/join", s.handleJoinRoom)
+	s.mux.HandleFunc("/rooms/leave", s.handleLeaveRoom)
 	s.mux.HandleFunc("/rooms/keepalive", s.handleKeepalive)
 	s.mux.HandleFunc("/tunnel/bootstrap", s.handleTunnelBootstrap)
 	s.mux.HandleFunc("/admin/role", s.handleRoleUpdate)
+	s.mux.HandleFunc("/admin/sessions/revoke", s.handleRevokeSessions)
+	s.mux.HandleFunc("/admin/lockouts", s.handleListLockouts)
+	s.mux.HandleFunc("/admin/lockouts/clear", s.handleClearLockout)
 }
 
 func (s *Server) seedDemoUser() {
-	salt := randomSalt()
-	hash := hashPassword("password123", salt)
-	s.users["gamer"] = userRecord{Username: "gamer", Salt: salt, Hash: hash, Device: "demo-device", IsAdmin: true}
-	s.deviceBags["demo-device"] = "gamer"
+	hash, err := HashPassword("password123", s.passwordParams)
+	if err != nil {
+		return
+	}
+	s.users["gamer"] = userRecord{Username: "gamer", Hash: hash, IsAdmin: true}
+	now := s.now()
+	s.devices[deviceKey("gamer", "demo-device")] = &deviceRecord{ID: "demo-device", Username: "gamer", Name: "demo-device", CreatedAt: now, LastUsed: now}
 }
 
 func (s *Server) loadFromDisk() error {
@@ -213,12 +798,40 @@ func (s *Server) loadFromDisk() error {
 		return err
 	}
 	s.users = state.Users
-	if state.DeviceBags != nil {
-		s.deviceBags = state.DeviceBags
+	s.devices = state.Devices
+	// Older state files kept bearer tokens in plaintext; rewrite them right away rather than
+	// leaving usable credentials on disk until the next change.
+	migrated := false
+	if len(state.DeviceBags) > 0 {
+		migrateLegacyDevices(state.DeviceBags, s.users, s.devices)
+		migrated = true
 	}
+	migrated = rekeyDevices(s.devices) || migrated
+	s.indexDeviceTokensLocked()
 	if state.Rooms != nil {
 		s.rooms = state.Rooms
 	}
+	if state.Sessions != nil {
+		s.sessions = state.Sessions
+		migrated = rehashLegacyKeys(s.sessions) || migrated
+	}
+	for _, room := range s.rooms {
+		if room.Members == nil {
+			room.Members = map[string]*memberRecord{}
+		}
+		for deviceID, addr := range room.Leases {
+			if member, ok := room.Members[deviceID]; ok && member.VirtualIP == "" {
+				member.VirtualIP = addr
+			}
+		}
+		room.Leases = nil
+		migrated = room.rekeyMembers() || migrated
+		migrated = attributeDeviceBans(room, s.devices) || migrated
+		migrated = rehashLegacyKeys(room.Invites) || migrated
+	}
+	if migrated {
+		return s.persistLocked()
+	}
 	return nil
 }
 
@@ -226,7 +839,10 @@ func (s *Server) persistLocked() error {
 	if s.persistPath == "" {
 		return nil
 	}
-	state := persistentState{Users: s.users, DeviceBags: s.deviceBags, Rooms: s.rooms}
+	state := persistentState{Users: s.users, Devices: s.devices, Rooms: s.rooms}
+	if s.persistSessions {
+		state.Sessions = s.sessions
+	}
 	if err := os.MkdirAll(filepath.Dir(s.persistPath), 0o755); err != nil {
 		return err
 	}
@@ -255,26 +871,32 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Hash before taking the lock: Argon2id is deliberately slow.
+	s.mu.Lock()
+	params := s.passwordParams
+	s.mu.Unlock()
+	hash, err := HashPassword(req.Password, params)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if _, exists := s.users[req.Username]; exists {
 		writeError(w, http.StatusConflict, errors.New("user already exists"))
 		return
 	}
-	salt := randomSalt()
+	deviceToken := s.enrollDeviceLocked(req.Username, req.DeviceID, req.DeviceName, req.Platform)
 	isFirstUser := len(s.users) == 0
-	record := userRecord{Username: req.Username, Salt: salt, Hash: hashPassword(req.Password, salt), Device: req.DeviceID, IsAdmin: isFirstUser}
+	record := userRecord{Username: req.Username, Hash: hash, IsAdmin: isFirstUser}
 	s.users[req.Username] = record
-	s.deviceBags[req.DeviceID] = req.Username
-	sessionToken := newToken()
-	deviceToken := newToken()
-	s.sessions[sessionToken] = req.Username
-	s.deviceBags[deviceToken] = req.Username
+	sessionToken := s.issueSessionLocked(req.Username, req.DeviceID)
 	if err := s.persistLocked(); err != nil {
 		writeError(w, http.StatusInternalServerError, fmt.Errorf("persist: %w", err))
 		return
 	}
-	writeJSON(w, RegisterResponse{SessionToken: sessionToken, DeviceToken: deviceToken})
+	writeJSON(w, RegisterResponse{SessionToken: sessionToken, DeviceToken: deviceToken, DeviceID: req.DeviceID})
 }
 
 func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
@@ -287,22 +909,54 @@ func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, err)
 		return
 	}
+	ip := clientIP(r)
 	s.mu.Lock()
-	defer s.mu.Unlock()
+	now := s.now()
+	if wait, code := s.loginBlockedLocked(ip, req.Username, now); wait > 0 {
+		s.mu.Unlock()
+		writeThrottled(w, wait, code)
+		return
+	}
+	s.beginLoginAttemptLocked(ip, req.Username, now)
 	record, ok := s.users[req.Username]
-	if !ok || record.Hash != hashPassword(req.Password, record.Salt) {
+	params := s.passwordParams
+	s.mu.Unlock()
+
+	// Verification runs unlocked; unknown users still pay for a hash so response times do not
+	// reveal which usernames exist.
+	var valid, rehash bool
+	if ok {
+		valid, rehash = verifyPassword(req.Password, record.Hash, record.Salt, params)
+	} else {
+		_, _ = HashPassword(req.Password, params)
+	}
+	if !valid {
 		writeError(w, http.StatusUnauthorized, errors.New("invalid credentials"))
 		return
 	}
-	sessionToken := newToken()
-	deviceToken := newToken()
-	s.sessions[sessionToken] = req.Username
-	s.deviceBags[deviceToken] = req.Username
+	var upgraded string
+	if rehash {
+		upgraded, _ = HashPassword(req.Password, params)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.loginSucceededLocked(ip, req.Username)
+	// Skip the upgrade if the record changed while we were hashing.
+	if current, ok := s.users[req.Username]; ok && upgraded != "" && current.Hash == record.Hash {
+		current.Hash, current.Salt = upgraded, ""
+		s.users[req.Username] = current
+	}
+	if req.DeviceID == "" {
+		req.DeviceID = fmt.Sprintf("device-%s", newToken()[:6])
+	}
+	deviceToken := s.enrollDeviceLocked(req.Username, req.DeviceID, req.DeviceName, req.Platform)
+	sessionToken := s.issueSessionLocked(req.Username, req.DeviceID)
 	if err := s.persistLocked(); err != nil {
 		writeError(w, http.StatusInternalServerError, fmt.Errorf("persist: %w", err))
 		return
 	}
-	writeJSON(w, LoginResponse{SessionToken: sessionToken, DeviceToken: deviceToken})
+	writeJSON(w, LoginResponse{SessionToken: sessionToken, DeviceToken: deviceToken, DeviceID: req.DeviceID})
 }
 
 func (s *Server) handleRefresh(w http.ResponseWriter, r *http.Request) {
@@ -317,114 +971,986 @@ func (s *Server) handleRefresh(w http.ResponseWriter, r *http.Request) {
 	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	username, ok := s.deviceBags[req.DeviceToken]
+	device, ok := s.deviceForTokenLocked(req.DeviceToken)
 	if !ok {
 		writeError(w, http.StatusUnauthorized, errors.New("device token invalid"))
 		return
 	}
-	sessionToken := newToken()
-	s.sessions[sessionToken] = username
+	device.LastUsed = s.now()
+	sessionToken := s.issueSessionLocked(device.Username, device.ID)
+	if err := s.persistLocked(); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("persist: %w", err))
+		return
+	}
 	writeJSON(w, RefreshTokenResponse{SessionToken: sessionToken})
 }
 
-func (s *Server) handleCreateRoom(w http.ResponseWriter, r *http.Request) {
+func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
-	var req CreateRoomRequest
+	var req LogoutRequest
 	if err := decodeJSON(r, &req); err != nil {
 		writeError(w, http.StatusBadRequest, err)
 		return
 	}
-	if strings.TrimSpace(req.SessionToken) == "" {
-		writeError(w, http.StatusUnauthorized, errors.New("session token required"))
-		return
-	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	creator, ok := s.sessions[req.SessionToken]
+	username, ok := s.sessionUserLocked(req.SessionToken)
 	if !ok {
 		writeError(w, http.StatusUnauthorized, errors.New("session invalid"))
 		return
 	}
-	creatorRecord := s.users[creator]
-	if !creatorRecord.IsAdmin {
-		writeError(w, http.StatusForbidden, errors.New("admin privileges required"))
-		return
-	}
-	roomID := fmt.Sprintf("room-%d", len(s.rooms)+1)
-	subnet := fmt.Sprintf("10.0.%d.0/24", len(s.rooms)+1)
-	if req.MTU == 0 {
-		req.MTU = 1400
-	}
-	if req.PreferredTransport == "" {
-		req.PreferredTransport = TransportUDP
-	}
-	rec := &roomRecord{
-		ID:                 roomID,
-		Name:               req.Name,
-		PreferredTransport: req.PreferredTransport,
-		MTU:                req.MTU,
-		OverlaySubnet:      subnet,
-		KeepaliveInterval:  15,
-		Members:            map[string]string{},
-	}
-	s.rooms[roomID] = rec
+	delete(s.sessions, hashToken(req.SessionToken))
 	if err := s.persistLocked(); err != nil {
 		writeError(w, http.StatusInternalServerError, fmt.Errorf("persist: %w", err))
 		return
 	}
-	writeJSON(w, CreateRoomResponse{
-		RoomID:             roomID,
-		OverlaySubnet:      subnet,
-		PreferredTransport: rec.PreferredTransport,
-		MTU:                rec.MTU,
+	writeJSON(w, LogoutResponse{Username: username})
+}
+
+func (s *Server) handleListDevices(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var req ListDevicesRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	username, ok := s.sessionUserLocked(req.SessionToken)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, errors.New("session invalid"))
+		return
+	}
+	devices := []DeviceInfo{}
+	for _, device := range s.devices {
+		if device.Username == username {
+			devices = append(devices, device.info())
+		}
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].DeviceID < devices[j].DeviceID })
+	writeJSON(w, ListDevicesResponse{Devices: devices})
+}
+
+func (s *Server) handleRenameDevice(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var req RenameDeviceRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if err := validDeviceName(req.Name); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	device, ok := s.ownDeviceLocked(w, req.SessionToken, req.DeviceID)
+	if !ok {
+		return
+	}
+	device.Name = req.Name
+	if err := s.persistLocked(); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("persist: %w", err))
+		return
+	}
+	writeJSON(w, device.info())
+}
+
+func (s *Server) handleRevokeDevice(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var req RevokeDeviceRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	device, ok := s.ownDeviceLocked(w, req.SessionToken, req.DeviceID)
+	if !ok {
+		return
+	}
+	s.revokeDeviceLocked(device)
+	revoked := 0
+	for peerID, tunnel := range s.tunnels {
+		if tunnel.Username == device.Username && tunnel.DeviceID == device.ID {
+			delete(s.tunnels, peerID)
+			revoked++
+		}
+	}
+	sessions := s.revokeDeviceSessionsLocked(device.Username, device.ID)
+	if err := s.persistLocked(); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("persist: %w", err))
+		return
+	}
+	writeJSON(w, RevokeDeviceResponse{Device: device.info(), RevokedTunnels: revoked, RevokedSessions: sessions})
+}
+
+// ownDeviceLocked resolves a device belonging to the session's user, writing the error
+// response itself when either does not check out.
+func (s *Server) ownDeviceLocked(w http.ResponseWriter, sessionToken, deviceID string) (*deviceRecord, bool) {
+	username, ok := s.sessionUserLocked(sessionToken)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, errors.New("session invalid"))
+		return nil, false
+	}
+	device, ok := s.devices[deviceKey(username, deviceID)]
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("device not found"))
+		return nil, false
+	}
+	return device, true
+}
+
+func (s *Server) handleCreateRoom(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var req CreateRoomRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if strings.TrimSpace(req.SessionToken) == "" {
+		writeError(w, http.StatusUnauthorized, errors.New("session token required"))
+		return
+	}
+	transport, err := checkRoomSettings(req.PreferredTransport, req.MTU, 0, req.MaxMembers, req.IdleTimeoutSec)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if transport == "" {
+		transport = TransportUDP
+	}
+	if req.MTU == 0 {
+		req.MTU = 1400
+	}
+	var passwordHash string
+	if req.Password != "" {
+		var ok bool
+		if passwordHash, ok = s.hashRoomPassword(w, req.SessionToken, req.Password); !ok {
+			return
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	creator, ok := s.sessionUserLocked(req.SessionToken)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, errors.New("session invalid"))
+		return
+	}
+	creatorRecord := s.users[creator]
+	if !creatorRecord.IsAdmin && s.ownedRoomCountLocked(creator) >= s.roomLimit {
+		writeError(w, http.StatusForbidden, fmt.Errorf("room limit reached: non-admins may own at most %d rooms", s.roomLimit))
+		return
+	}
+	roomID := s.nextRoomIDLocked()
+	allocated, err := s.pool.AllocateSubnet(s.roomSubnetsLocked())
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	subnet := allocated.String()
+	rec := &roomRecord{
+		ID:                 roomID,
+		Name:               req.Name,
+		PreferredTransport: transport,
+		MTU:                req.MTU,
+		OverlaySubnet:      subnet,
+		KeepaliveInterval:  15,
+		Owner:              creator,
+		InviteOnly:         req.InviteOnly,
+		MaxMembers:         req.MaxMembers,
+		Waitlist:           req.Waitlist,
+		IdleTimeout:        req.IdleTimeoutSec,
+		PasswordHash:       passwordHash,
+		LastActive:         s.now(),
+		Members:            map[string]*memberRecord{},
+	}
+	s.rooms[roomID] = rec
+	if err := s.persistLocked(); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("persist: %w", err))
+		return
+	}
+	writeJSON(w, CreateRoomResponse{
+		RoomID:             roomID,
+		OverlaySubnet:      subnet,
+		PreferredTransport: rec.PreferredTransport,
+		MTU:                rec.MTU,
 	})
 }
 
-func (s *Server) handleRoleUpdate(w http.ResponseWriter, r *http.Request) {
+// checkRoomSettings validates the settings rooms are created and updated with. Zero values
+// pass, for the caller to fill in a default or keep the current setting. It returns the
+// transport normalized, or "" when none was given.
+func checkRoomSettings(transport Transport, mtu, keepaliveSec, maxMembers, idleTimeoutSec int) (Transport, error) {
+	if transport != "" {
+		normalized := NormalizeTransport(transport)
+		if normalized == "" {
+			return "", fmt.Errorf("unknown transport %q", transport)
+		}
+		transport = normalized
+	}
+	switch {
+	case mtu != 0 && (mtu < minRoomMTU || mtu > maxRoomMTU):
+		return "", fmt.Errorf("mtu must be between %d and %d", minRoomMTU, maxRoomMTU)
+	case keepaliveSec < 0 || keepaliveSec > MaxKeepaliveInterval:
+		return "", fmt.Errorf("keepalive interval must be between 1 and %d seconds", MaxKeepaliveInterval)
+	case maxMembers < 0:
+		return "", errors.New("max members must not be negative")
+	case idleTimeoutSec != 0 && idleTimeoutSec < minRoomIdleTimeout:
+		return "", fmt.Errorf("idle timeout must be 0 (never) or at least %d seconds", minRoomIdleTimeout)
+	}
+	return transport, nil
+}
+
+// nextRoomIDLocked returns an unused room ID. Counting from len(s.rooms) alone would reuse
+// the ID of a surviving room once an earlier one has been deleted.
+func (s *Server) nextRoomIDLocked() string {
+	for n := len(s.rooms) + 1; ; n++ {
+		id := fmt.Sprintf("room-%d", n)
+		if _, taken := s.rooms[id]; !taken {
+			return id
+		}
+	}
+}
+
+func (s *Server) handleUpdateRoom(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var req UpdateRoomRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	var passwordHash string
+	if req.Password != "" && !req.ClearPassword {
+		var ok bool
+		if passwordHash, ok = s.hashRoomPassword(w, req.SessionToken, req.Password); !ok {
+			return
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	username, ok := s.sessionUserLocked(req.SessionToken)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, errors.New("session invalid"))
+		return
+	}
+	room, ok := s.rooms[req.RoomID]
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("room not found"))
+		return
+	}
+	if !s.hasRoomRoleLocked(room, username, RoomRoleModerator) {
+		writeError(w, http.StatusForbidden, errors.New("room moderator privileges required"))
+		return
+	}
+	maxMembers, idleTimeout := 0, 0
+	if req.MaxMembers != nil {
+		maxMembers = *req.MaxMembers
+	}
+	if req.IdleTimeoutSec != nil {
+		idleTimeout = *req.IdleTimeoutSec
+	}
+	transport, err := checkRoomSettings(req.PreferredTransport, req.MTU, req.KeepaliveIntervalSec, maxMembers, idleTimeout)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if transport == "" {
+		transport = room.PreferredTransport
+	}
+	if name := strings.TrimSpace(req.Name); name != "" {
+		room.Name = name
+	}
+	room.PreferredTransport = transport
+	if req.MTU != 0 {
+		room.MTU = req.MTU
+	}
+	if req.KeepaliveIntervalSec != 0 {
+		room.KeepaliveInterval = req.KeepaliveIntervalSec
+	}
+	switch {
+	case req.ClearPassword:
+		room.PasswordSalt, room.PasswordHash = "", ""
+	case req.Password != "":
+		room.PasswordSalt, room.PasswordHash = "", passwordHash
+	}
+	if req.InviteOnly != nil {
+		room.InviteOnly = *req.InviteOnly
+	}
+	if req.MaxMembers != nil {
+		room.MaxMembers = *req.MaxMembers
+	}
+	if req.IdleTimeoutSec != nil {
+		room.IdleTimeout = *req.IdleTimeoutSec
+		room.LastActive = s.now()
+	}
+	if req.Waitlist != nil {
+		room.Waitlist = *req.Waitlist
+		if !room.Waitlist {
+			room.Waiting = nil
+		}
+	}
+	s.admitWaitingLocked(room)
+	if err := s.persistLocked(); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("persist: %w", err))
+		return
+	}
+	writeJSON(w, s.roomDetailLocked(room, username))
+}
+
+func (s *Server) handleDeleteRoom(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var req DeleteRoomRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	username, ok := s.sessionUserLocked(req.SessionToken)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, errors.New("session invalid"))
+		return
+	}
+	room, ok := s.rooms[req.RoomID]
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("room not found"))
+		return
+	}
+	if !s.hasRoomRoleLocked(room, username, RoomRoleOwner) {
+		writeError(w, http.StatusForbidden, errors.New("room owner privileges required"))
+		return
+	}
+	// Revoking the tunnel sessions disconnects members: the data plane drops frames from and
+	// to a peer as soon as its session no longer resolves. The room's subnet returns to the
+	// pool simply by the room no longer being listed.
+	disconnected := s.deleteRoomLocked(room)
+	if err := s.persistLocked(); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("persist: %w", err))
+		return
+	}
+	writeJSON(w, DeleteRoomResponse{RoomID: room.ID, DisconnectedDevices: disconnected})
+}
+
+// deleteRoomLocked removes the room and revokes its members' tunnels, returning their devices.
+func (s *Server) deleteRoomLocked(room *roomRecord) []string {
+	disconnected := make([]string, 0, len(room.Members))
+	for _, member := range room.Members {
+		disconnected = append(disconnected, member.DeviceID)
+		s.removeMemberLocked(room, member)
+	}
+	sort.Strings(disconnected)
+	delete(s.rooms, room.ID)
+	return disconnected
+}
+
+// StartJanitor deletes idle ephemeral rooms, expired sessions and stale login failure counts
+// every interval until the returned stop function is called.
+func (s *Server) StartJanitor(interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.pruneSessions()
+				s.pruneLoginFailures()
+				expired, err := s.ExpireIdleRooms()
+				if len(expired) > 0 {
+					log.Printf("expired idle rooms: %s", strings.Join(expired, ", "))
+				}
+				if err != nil {
+					log.Printf("persist after room expiry: %v", err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+// ExpireIdleRooms deletes every room with an idle timeout whose members have all been inactive
+// for at least that long, returning the deleted room IDs. Their subnets return to the pool.
+func (s *Server) ExpireIdleRooms() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	var expired []string
+	for _, room := range s.rooms {
+		if room.IdleTimeout <= 0 {
+			continue
+		}
+		last := room.lastActivity()
+		if last.IsZero() {
+			// Rooms from older state files start their idle clock now.
+			room.LastActive = now
+			continue
+		}
+		if now.Sub(last) >= time.Duration(room.IdleTimeout)*time.Second {
+			s.deleteRoomLocked(room)
+			expired = append(expired, room.ID)
+		}
+	}
+	if len(expired) == 0 {
+		return nil, nil
+	}
+	sort.Strings(expired)
+	return expired, s.persistLocked()
+}
+
+func (s *Server) handleRoomRoleUpdate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var req RoomRoleUpdateRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	switch req.Role {
+	case RoomRoleOwner, RoomRoleModerator, RoomRoleMember:
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unknown room role %q", req.Role))
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	actor, ok := s.sessionUserLocked(req.SessionToken)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, errors.New("session invalid"))
+		return
+	}
+	room, ok := s.rooms[req.RoomID]
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("room not found"))
+		return
+	}
+	if !s.hasRoomRoleLocked(room, actor, RoomRoleOwner) {
+		writeError(w, http.StatusForbidden, errors.New("room owner privileges required"))
+		return
+	}
+	if _, ok := s.users[req.TargetUser]; !ok {
+		writeError(w, http.StatusNotFound, errors.New("target user not found"))
+		return
+	}
+	if req.TargetUser == room.Owner && req.Role != RoomRoleOwner {
+		writeError(w, http.StatusBadRequest, errors.New("transfer ownership before demoting the owner"))
+		return
+	}
+	if room.Moderators == nil {
+		room.Moderators = map[string]bool{}
+	}
+	switch req.Role {
+	case RoomRoleOwner:
+		if room.Owner != "" && room.Owner != req.TargetUser {
+			room.Moderators[room.Owner] = true
+		}
+		delete(room.Moderators, req.TargetUser)
+		room.Owner = req.TargetUser
+	case RoomRoleModerator:
+		room.Moderators[req.TargetUser] = true
+	case RoomRoleMember:
+		delete(room.Moderators, req.TargetUser)
+	}
+	if err := s.persistLocked(); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("persist: %w", err))
+		return
+	}
+	writeJSON(w, RoomRoleUpdateResponse{RoomID: room.ID, Username: req.TargetUser, Role: room.roleOf(req.TargetUser)})
+}
+
+// hasRoomRoleLocked reports whether username holds at least role in room. Global admins
+// may manage every room.
+func (s *Server) hasRoomRoleLocked(room *roomRecord, username string, role RoomRole) bool {
+	if s.users[username].IsAdmin {
+		return true
+	}
+	return room.roleOf(username).rank() >= role.rank()
+}
+
+func (s *Server) ownedRoomCountLocked(username string) int {
+	count := 0
+	for _, room := range s.rooms {
+		if room.Owner == username {
+			count++
+		}
+	}
+	return count
+}
+
+func (s *Server) handleKickMember(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var req KickMemberRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	room, _, ok := s.roomForOwnerLocked(w, req.RoomID, req.SessionToken)
+	if !ok {
+		return
+	}
+	username, ok := deviceUserInRoom(w, room, req.Username, req.DeviceID)
+	if !ok {
+		return
+	}
+	member, ok := room.Members[deviceKey(username, req.DeviceID)]
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("device is not a member of this room"))
+		return
+	}
+	if member.Username == room.Owner {
+		writeError(w, http.StatusBadRequest, errors.New("the room owner cannot be kicked"))
+		return
+	}
+	s.removeMemberLocked(room, member)
+	s.admitWaitingLocked(room)
+	if err := s.persistLocked(); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("persist: %w", err))
+		return
+	}
+	writeJSON(w, KickMemberResponse{RoomID: room.ID, DeviceID: req.DeviceID})
+}
+
+func (s *Server) handleBan(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var req BanRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Username == "" && req.DeviceID == "" {
+		writeError(w, http.StatusBadRequest, errors.New("ban needs a username or device_id"))
+		return
+	}
+	if req.DurationSeconds < 0 {
+		writeError(w, http.StatusBadRequest, errors.New("ban duration must not be negative"))
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	room, actor, ok := s.roomForOwnerLocked(w, req.RoomID, req.SessionToken)
+	if !ok {
+		return
+	}
+	if req.Username == "" {
+		if req.Username, ok = deviceUserInRoom(w, room, "", req.DeviceID); !ok {
+			return
+		}
+	}
+	// Every ban names its account by now, so the owner is protected whether or not they are
+	// connected.
+	if req.Username == room.Owner {
+		writeError(w, http.StatusBadRequest, errors.New("the room owner cannot be banned"))
+		return
+	}
+	now := s.now()
+	ban := banRecord{Username: req.Username, DeviceID: req.DeviceID, BannedBy: actor}
+	if req.DurationSeconds > 0 {
+		ban.ExpiresAt = now.Add(time.Duration(req.DurationSeconds) * time.Second)
+	}
+	// Replace any earlier ban on the same target and drop lapsed ones while we are here.
+	bans := room.Bans[:0]
+	for _, existing := range room.Bans {
+		if existing.active(now) && (existing.Username != ban.Username || existing.DeviceID != ban.DeviceID) {
+			bans = append(bans, existing)
+		}
+	}
+	room.Bans = append(bans, ban)
+	if req.Username != "" {
+		delete(room.Moderators, req.Username)
+	}
+	removed := []string{}
+	for _, member := range room.Members {
+		if ban.matches(member.Username, member.DeviceID) {
+			removed = append(removed, member.DeviceID)
+			s.removeMemberLocked(room, member)
+		}
+	}
+	sort.Strings(removed)
+	waiting := room.Waiting[:0]
+	for _, entry := range room.Waiting {
+		if !ban.matches(entry.Username, entry.DeviceID) {
+			waiting = append(waiting, entry)
+		}
+	}
+	room.Waiting = waiting
+	s.admitWaitingLocked(room)
+	if err := s.persistLocked(); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("persist: %w", err))
+		return
+	}
+	writeJSON(w, BanResponse{
+		RoomID:         room.ID,
+		Username:       ban.Username,
+		DeviceID:       ban.DeviceID,
+		ExpiresAtUnix:  unixOrZero(ban.ExpiresAt),
+		RemovedDevices: removed,
+	})
+}
+
+func (s *Server) handleUnban(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var req UnbanRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	room, _, ok := s.roomForOwnerLocked(w, req.RoomID, req.SessionToken)
+	if !ok {
+		return
+	}
+	if req.Username == "" && req.DeviceID != "" {
+		users := map[string]bool{}
+		for _, ban := range room.Bans {
+			if ban.DeviceID == req.DeviceID {
+				users[ban.Username] = true
+			}
+		}
+		if len(users) > 1 {
+			writeError(w, http.StatusBadRequest, errors.New("several accounts have a ban on this device id; name the user"))
+			return
+		}
+		for username := range users {
+			req.Username = username
+		}
+	}
+	bans := room.Bans[:0]
+	lifted := false
+	for _, ban := range room.Bans {
+		if ban.Username == req.Username && ban.DeviceID == req.DeviceID {
+			lifted = true
+			continue
+		}
+		bans = append(bans, ban)
+	}
+	if !lifted {
+		writeError(w, http.StatusNotFound, errors.New("no such ban"))
+		return
+	}
+	room.Bans = bans
+	if err := s.persistLocked(); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("persist: %w", err))
+		return
+	}
+	writeJSON(w, BanResponse{RoomID: room.ID, Username: req.Username, DeviceID: req.DeviceID, RemovedDevices: []string{}})
+}
+
+// admitWaitingLocked moves queued devices into free slots, oldest first. Admitted devices get
+// their address now and pick up their session by joining again.
+func (s *Server) admitWaitingLocked(room *roomRecord) {
+	now := s.now()
+	for len(room.Waiting) > 0 && !room.full() {
+		next := room.Waiting[0]
+		if _, member := room.Members[deviceKey(next.Username, next.DeviceID)]; member || room.banned(next.Username, next.DeviceID, now) {
+			room.Waiting = room.Waiting[1:]
+			continue
+		}
+		virtualIP, err := s.allocateAddressLocked(room)
+		if err != nil {
+			return
+		}
+		room.Waiting = room.Waiting[1:]
+		room.Members[deviceKey(next.Username, next.DeviceID)] = &memberRecord{DeviceID: next.DeviceID, Username: next.Username, VirtualIP: virtualIP, JoinedAt: now}
+	}
+	if len(room.Waiting) == 0 {
+		room.Waiting = nil
+	}
+}
+
+// roomForOwnerLocked resolves the session and room for an owner-only operation, writing the
+// error response itself when either is missing or the caller lacks the rights.
+func (s *Server) roomForOwnerLocked(w http.ResponseWriter, roomID, sessionToken string) (*roomRecord, string, bool) {
+	username, ok := s.sessionUserLocked(sessionToken)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, errors.New("session invalid"))
+		return nil, "", false
+	}
+	room, ok := s.rooms[roomID]
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("room not found"))
+		return nil, "", false
+	}
+	if !s.hasRoomRoleLocked(room, username, RoomRoleOwner) {
+		writeError(w, http.StatusForbidden, errors.New("room owner privileges required"))
+		return nil, "", false
+	}
+	return room, username, true
+}
+
+func (s *Server) handleCreateInvite(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var req CreateInviteRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	ttl := time.Duration(req.TTLSeconds) * time.Second
+	if ttl == 0 {
+		ttl = DefaultInviteTTL
+	}
+	if ttl < 0 || ttl > maxInviteTTL || req.MaxUses < 0 {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invites last up to %s and need a non-negative use limit", maxInviteTTL))
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	username, ok := s.sessionUserLocked(req.SessionToken)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, errors.New("session invalid"))
+		return
+	}
+	room, ok := s.rooms[req.RoomID]
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("room not found"))
+		return
+	}
+	if !s.hasRoomRoleLocked(room, username, RoomRoleOwner) {
+		writeError(w, http.StatusForbidden, errors.New("room owner privileges required"))
+		return
+	}
+	now := s.now()
+	if room.Invites == nil {
+		room.Invites = map[string]*inviteRecord{}
+	}
+	for code, inv := range room.Invites {
+		if !inv.usable(now) {
+			delete(room.Invites, code)
+		}
+	}
+	code := newToken()
+	invite := &inviteRecord{CreatedBy: username, ExpiresAt: now.Add(ttl), MaxUses: req.MaxUses}
+	room.Invites[hashToken(code)] = invite
+	if err := s.persistLocked(); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("persist: %w", err))
+		return
+	}
+	writeJSON(w, CreateInviteResponse{RoomID: room.ID, Code: code, ExpiresAtUnix: invite.ExpiresAt.Unix(), MaxUses: invite.MaxUses})
+}
+
+// admitLocked decides whether username may add a device to room. Users who already hold a
+// role in the room and global admins are always admitted; everyone else needs a usable invite
+// code, or the password if the room has one and is not invite-only. checkedHash is what
+// checkRoomPassword returned; the password only counts if the room still has that hash. The
+// returned invite, if any, should be charged a use once the join succeeds.
+func (s *Server) admitLocked(room *roomRecord, username string, req JoinRoomRequest, checkedHash string, now time.Time) (*inviteRecord, error) {
+	if s.users[username].IsAdmin || room.roleOf(username) != "" {
+		return nil, nil
+	}
+	if req.InviteCode != "" {
+		invite, ok := room.Invites[hashToken(req.InviteCode)]
+		if !ok || !invite.usable(now) {
+			return nil, errors.New("invite code invalid or expired")
+		}
+		return invite, nil
+	}
+	if room.InviteOnly {
+		return nil, errors.New("room requires an invite code")
+	}
+	if room.PasswordHash != "" && room.PasswordHash != checkedHash {
+		return nil, errors.New("room password required or incorrect")
+	}
+	return nil, nil
+}
+
+// checkRoomPassword verifies a join's room password without holding s.mu: Argon2id is
+// deliberately slow and the data plane takes the same lock for every frame. It returns the
+// hash the password matched, or "" when it did not or admitLocked will not need it. Only
+// sessions that would be asked for the password get a hash computed.
+func (s *Server) checkRoomPassword(req JoinRoomRequest) string {
+	s.mu.Lock()
+	username, ok := s.sessionUserLocked(req.SessionToken)
+	room, found := s.rooms[req.RoomID]
+	if !ok || !found || req.InviteCode != "" || room.InviteOnly || room.PasswordHash == "" ||
+		s.users[username].IsAdmin || room.roleOf(username) != "" {
+		s.mu.Unlock()
+		return ""
+	}
+	hash, salt, params := room.PasswordHash, room.PasswordSalt, s.passwordParams
+	s.mu.Unlock()
+	if valid, _ := verifyPassword(req.Password, hash, salt, params); valid {
+		return hash
+	}
+	return ""
+}
+
+// canSeeRoomLocked hides invite-only rooms from users who have no role in them.
+func (s *Server) canSeeRoomLocked(room *roomRecord, username string) bool {
+	return !room.InviteOnly || s.users[username].IsAdmin || room.roleOf(username) != ""
+}
+
+func (s *Server) handleRoleUpdate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var req AdminRoleUpdateRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if strings.TrimSpace(req.SessionToken) == "" || strings.TrimSpace(req.TargetUser) == "" {
+		writeError(w, http.StatusBadRequest, errors.New("session_token and target_user are required"))
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	actorUser, ok := s.sessionUserLocked(req.SessionToken)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, errors.New("session invalid"))
+		return
+	}
+	actor := s.users[actorUser]
+	if !actor.IsAdmin {
+		writeError(w, http.StatusForbidden, errors.New("admin privileges required"))
+		return
+	}
+	target, ok := s.users[req.TargetUser]
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("target user not found"))
+		return
+	}
+	if !req.Grant && target.IsAdmin && s.adminCountLocked() == 1 {
+		writeError(w, http.StatusBadRequest, errors.New("cannot revoke the last administrator"))
+		return
+	}
+	target.IsAdmin = req.Grant
+	s.users[req.TargetUser] = target
+	if err := s.persistLocked(); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("persist: %w", err))
+		return
+	}
+	writeJSON(w, AdminRoleUpdateResponse{Username: target.Username, IsAdmin: target.IsAdmin})
+}
+
+func (s *Server) handleListLockouts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var req ListLockoutsRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	actor, ok := s.sessionUserLocked(req.SessionToken)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, errors.New("session invalid"))
+		return
+	}
+	if !s.users[actor].IsAdmin {
+		writeError(w, http.StatusForbidden, errors.New("admin privileges required"))
+		return
+	}
+	writeJSON(w, ListLockoutsResponse{Accounts: s.lockedAccountsLocked(s.now())})
+}
+
+func (s *Server) handleClearLockout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var req ClearLockoutRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	actor, ok := s.sessionUserLocked(req.SessionToken)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, errors.New("session invalid"))
+		return
+	}
+	if !s.users[actor].IsAdmin {
+		writeError(w, http.StatusForbidden, errors.New("admin privileges required"))
+		return
+	}
+	if _, ok := s.users[req.TargetUser]; !ok {
+		writeError(w, http.StatusNotFound, errors.New("target user not found"))
+		return
+	}
+	wasLocked := s.clearLoginFailuresLocked(req.TargetUser, s.now())
+	writeJSON(w, ClearLockoutResponse{Username: req.TargetUser, WasLocked: wasLocked})
+}
+
+func (s *Server) handleRevokeSessions(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
-	var req AdminRoleUpdateRequest
+	var req RevokeSessionsRequest
 	if err := decodeJSON(r, &req); err != nil {
 		writeError(w, http.StatusBadRequest, err)
 		return
 	}
-	if strings.TrimSpace(req.SessionToken) == "" || strings.TrimSpace(req.TargetUser) == "" {
-		writeError(w, http.StatusBadRequest, errors.New("session_token and target_user are required"))
-		return
-	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	actorUser, ok := s.sessions[req.SessionToken]
+	actor, ok := s.sessionUserLocked(req.SessionToken)
 	if !ok {
 		writeError(w, http.StatusUnauthorized, errors.New("session invalid"))
 		return
 	}
-	actor := s.users[actorUser]
-	if !actor.IsAdmin {
+	if req.TargetUser == "" {
+		req.TargetUser = actor
+	}
+	if req.TargetUser != actor && !s.users[actor].IsAdmin {
 		writeError(w, http.StatusForbidden, errors.New("admin privileges required"))
 		return
 	}
-	target, ok := s.users[req.TargetUser]
-	if !ok {
+	if _, ok := s.users[req.TargetUser]; !ok {
 		writeError(w, http.StatusNotFound, errors.New("target user not found"))
 		return
 	}
-	if !req.Grant && target.IsAdmin && s.adminCountLocked() == 1 {
-		writeError(w, http.StatusBadRequest, errors.New("cannot revoke the last administrator"))
-		return
-	}
-	target.IsAdmin = req.Grant
-	s.users[req.TargetUser] = target
+	revoked := s.revokeSessionsLocked(req.TargetUser)
 	if err := s.persistLocked(); err != nil {
 		writeError(w, http.StatusInternalServerError, fmt.Errorf("persist: %w", err))
 		return
 	}
-	writeJSON(w, AdminRoleUpdateResponse{Username: target.Username, IsAdmin: target.IsAdmin})
+	writeJSON(w, RevokeSessionsResponse{Username: req.TargetUser, Revoked: revoked})
 }
 
 func (s *Server) adminCountLocked() int {
@@ -437,6 +1963,259 @@ func (s *Server) adminCountLocked() int {
 	return count
 }
 
+func (s *Server) handleListRooms(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var req ListRoomsRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	username, ok := s.sessionUserLocked(req.SessionToken)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, errors.New("session invalid"))
+		return
+	}
+	rooms := make([]RoomSummary, 0, len(s.rooms))
+	for _, room := range s.rooms {
+		if !s.canSeeRoomLocked(room, username) {
+			continue
+		}
+		rooms = append(rooms, room.summary(username))
+	}
+	sort.Slice(rooms, func(i, j int) bool {
+		if rooms[i].Name != rooms[j].Name {
+			return rooms[i].Name < rooms[j].Name
+		}
+		return rooms[i].RoomID < rooms[j].RoomID
+	})
+	writeJSON(w, ListRoomsResponse{Rooms: rooms})
+}
+
+func (s *Server) handleGetRoom(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var req GetRoomRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	username, ok := s.sessionUserLocked(req.SessionToken)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, errors.New("session invalid"))
+		return
+	}
+	room, ok := s.rooms[req.RoomID]
+	if !ok || !s.canSeeRoomLocked(room, username) {
+		writeError(w, http.StatusNotFound, errors.New("room not found"))
+		return
+	}
+	writeJSON(w, s.roomDetailLocked(room, username))
+}
+
+// roomDetailLocked describes room and its member roster as seen by username.
+func (s *Server) roomDetailLocked(room *roomRecord, username string) RoomDetail {
+	members := make([]RoomMember, 0, len(room.Members))
+	for _, member := range room.Members {
+		members = append(members, RoomMember{
+			DeviceID:     member.DeviceID,
+			Username:     member.Username,
+			VirtualIP:    member.VirtualIP,
+			Role:         room.roleOf(member.Username),
+			JoinedAtUnix: unixOrZero(member.JoinedAt),
+			LastSeenUnix: unixOrZero(member.LastSeen),
+		})
+	}
+	sort.Slice(members, func(i, j int) bool {
+		a, errA := netip.ParseAddr(members[i].VirtualIP)
+		b, errB := netip.ParseAddr(members[j].VirtualIP)
+		if errA != nil || errB != nil || a == b {
+			return deviceKey(members[i].Username, members[i].DeviceID) < deviceKey(members[j].Username, members[j].DeviceID)
+		}
+		return a.Less(b)
+	})
+	detail := RoomDetail{
+		RoomSummary:          room.summary(username),
+		KeepaliveIntervalSec: room.KeepaliveInterval,
+		Members:              members,
+	}
+	if s.hasRoomRoleLocked(room, username, RoomRoleOwner) {
+		now := s.now()
+		for _, ban := range room.Bans {
+			if ban.active(now) {
+				detail.Bans = append(detail.Bans, RoomBan{Username: ban.Username, DeviceID: ban.DeviceID, BannedBy: ban.BannedBy, ExpiresAtUnix: unixOrZero(ban.ExpiresAt)})
+			}
+		}
+	}
+	return detail
+}
+
+// hashRoomPassword hashes a new room password without holding s.mu, as Argon2id is
+// deliberately slow. The session is checked first so anonymous requests cannot make the
+// server hash; callers still check it again under the lock.
+func (s *Server) hashRoomPassword(w http.ResponseWriter, sessionToken, password string) (string, bool) {
+	s.mu.Lock()
+	_, ok := s.sessionUserLocked(sessionToken)
+	params := s.passwordParams
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusUnauthorized, errors.New("session invalid"))
+		return "", false
+	}
+	hash, err := HashPassword(password, params)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return "", false
+	}
+	return hash, true
+}
+
+func (room *roomRecord) full() bool {
+	return room.MaxMembers > 0 && len(room.Members) >= room.MaxMembers
+}
+
+// waitingPosition returns the device's 1-based place in the waitlist.
+func (room *roomRecord) waitingPosition(username, deviceID string) (int, bool) {
+	for i, entry := range room.Waiting {
+		if entry.Username == username && entry.DeviceID == deviceID {
+			return i + 1, true
+		}
+	}
+	return 0, false
+}
+
+// lastActivity is the latest of the room's own activity mark and its members' last-seen times.
+func (room *roomRecord) lastActivity() time.Time {
+	last := room.LastActive
+	for _, member := range room.Members {
+		if member.LastSeen.After(last) {
+			last = member.LastSeen
+		}
+	}
+	return last
+}
+
+// banned reports whether an active ban covers the user or the device.
+func (room *roomRecord) banned(username, deviceID string, now time.Time) bool {
+	for _, ban := range room.Bans {
+		if ban.active(now) && ban.matches(username, deviceID) {
+			return true
+		}
+	}
+	return false
+}
+
+// roleOf returns username's role in the room, or "" if they have none.
+func (room *roomRecord) roleOf(username string) RoomRole {
+	switch {
+	case username == "":
+		return ""
+	case room.Owner == username:
+		return RoomRoleOwner
+	case room.Moderators[username]:
+		return RoomRoleModerator
+	case room.hasMember(username):
+		return RoomRoleMember
+	default:
+		return ""
+	}
+}
+
+func (room *roomRecord) hasMember(username string) bool {
+	for _, member := range room.Members {
+		if member.Username == username {
+			return true
+		}
+	}
+	return false
+}
+
+// rekeyMembers moves members saved under their bare device ID, before device IDs were per
+// account, to their deviceKey. It reports whether anything moved.
+func (room *roomRecord) rekeyMembers() bool {
+	moved := false
+	for key, member := range room.Members {
+		if member.DeviceID == "" {
+			member.DeviceID = key
+		}
+		if want := deviceKey(member.Username, member.DeviceID); key != want {
+			delete(room.Members, key)
+			room.Members[want] = member
+			moved = true
+		}
+	}
+	return moved
+}
+
+// deviceUserInRoom resolves the account behind a device named in an owner request. username
+// is returned as given when set; otherwise exactly one member or waiting device in the room
+// must have deviceID. It writes the error response itself when that does not hold.
+func deviceUserInRoom(w http.ResponseWriter, room *roomRecord, username, deviceID string) (string, bool) {
+	if username != "" {
+		return username, true
+	}
+	users := map[string]bool{}
+	for _, member := range room.Members {
+		if member.DeviceID == deviceID {
+			users[member.Username] = true
+		}
+	}
+	for _, entry := range room.Waiting {
+		if entry.DeviceID == deviceID {
+			users[entry.Username] = true
+		}
+	}
+	switch len(users) {
+	case 0:
+		writeError(w, http.StatusNotFound, errors.New("device is not in this room; name its user"))
+		return "", false
+	case 1:
+		for name := range users {
+			username = name
+		}
+		return username, true
+	default:
+		writeError(w, http.StatusBadRequest, errors.New("several accounts have a device with this id in the room; name the user"))
+		return "", false
+	}
+}
+
+// summary describes the room as seen by username.
+func (room *roomRecord) summary(username string) RoomSummary {
+	return RoomSummary{
+		RoomID:             room.ID,
+		Name:               room.Name,
+		PreferredTransport: room.PreferredTransport,
+		MTU:                room.MTU,
+		OverlaySubnet:      room.OverlaySubnet,
+		Owner:              room.Owner,
+		MemberCount:        len(room.Members),
+		HasPassword:        room.PasswordHash != "",
+		InviteOnly:         room.InviteOnly,
+		MaxMembers:         room.MaxMembers,
+		Waitlist:           room.Waitlist,
+		WaitingCount:       len(room.Waiting),
+		IdleTimeoutSec:     room.IdleTimeout,
+		IsMember:           room.hasMember(username),
+		Role:               room.roleOf(username),
+	}
+}
+
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
 func (s *Server) handleJoinRoom(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		w.WriteHeader(http.StatusMethodNotAllowed)
@@ -447,9 +2226,13 @@ func (s *Server) handleJoinRoom(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, err)
 		return
 	}
+	checkedHash := s.checkRoomPassword(req)
+
+	// The room and the caller's standing in it are looked up again: either may have changed
+	// while the password was being checked.
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	username, ok := s.sessions[req.SessionToken]
+	username, ok := s.sessionUserLocked(req.SessionToken)
 	if !ok {
 		writeError(w, http.StatusUnauthorized, errors.New("session invalid"))
 		return
@@ -459,22 +2242,226 @@ func (s *Server) handleJoinRoom(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusNotFound, errors.New("room not found"))
 		return
 	}
-	virtualIP := fmt.Sprintf("10.0.%d.%d", len(room.Members)+1, len(room.Members)+2)
-	sessionKey := newToken()
-	room.Members[req.DeviceID] = username
+	member, isMember := room.Members[deviceKey(username, req.DeviceID)]
+	if err := s.useDeviceLocked(username, req.DeviceID); err != nil {
+		writeError(w, http.StatusForbidden, err)
+		return
+	}
+	now := s.now()
+	if room.banned(username, req.DeviceID, now) {
+		writeError(w, http.StatusForbidden, errors.New("banned from this room"))
+		return
+	}
+	var invite *inviteRecord
+	if !isMember {
+		if position, waiting := room.waitingPosition(username, req.DeviceID); waiting {
+			writeResponse(w, http.StatusAccepted, JoinRoomResponse{Waitlisted: true, WaitlistPosition: position})
+			return
+		}
+		var err error
+		if invite, err = s.admitLocked(room, username, req, checkedHash, now); err != nil {
+			writeError(w, http.StatusForbidden, err)
+			return
+		}
+		if room.full() {
+			if !room.Waitlist {
+				writeErrorCode(w, http.StatusConflict, ErrorCodeRoomFull, fmt.Errorf("room is full (%d members)", room.MaxMembers))
+				return
+			}
+			room.Waiting = append(room.Waiting, waitingRecord{DeviceID: req.DeviceID, Username: username, QueuedAt: now})
+			if invite != nil {
+				invite.Uses++
+			}
+			if err := s.persistLocked(); err != nil {
+				writeError(w, http.StatusInternalServerError, fmt.Errorf("persist: %w", err))
+				return
+			}
+			writeResponse(w, http.StatusAccepted, JoinRoomResponse{Waitlisted: true, WaitlistPosition: len(room.Waiting)})
+			return
+		}
+		member = &memberRecord{DeviceID: req.DeviceID, Username: username, JoinedAt: now}
+	}
+	if member.VirtualIP == "" {
+		virtualIP, err := s.allocateAddressLocked(room)
+		if err != nil {
+			writeError(w, http.StatusServiceUnavailable, err)
+			return
+		}
+		member.VirtualIP = virtualIP
+	}
+	// Joining again hands back the session the device already holds, so a client that lost
+	// the response can retry safely; only an explicit rotation issues new key material.
+	tunnel, hasTunnel := s.tunnelForDeviceLocked(room.ID, username, req.DeviceID)
+	if !hasTunnel || req.RotateKey {
+		peerID, err := s.issueTunnelSessionLocked(room, req.DeviceID, username, member.VirtualIP, newToken())
+		if err != nil {
+			writeError(w, http.StatusServiceUnavailable, err)
+			return
+		}
+		tunnel = s.tunnels[peerID]
+	}
+	member.LastSeen = now
+	room.Members[deviceKey(username, req.DeviceID)] = member
+	if invite != nil {
+		invite.Uses++
+	}
 	if err := s.persistLocked(); err != nil {
 		writeError(w, http.StatusInternalServerError, fmt.Errorf("persist: %w", err))
 		return
 	}
 	writeJSON(w, JoinRoomResponse{
-		VirtualIP:              virtualIP,
-		SessionKey:             sessionKey,
+		VirtualIP:              member.VirtualIP,
+		SessionKey:             hex.EncodeToString(tunnel.Key),
+		PeerID:                 tunnel.PeerID,
 		Transport:              room.PreferredTransport,
 		KeepaliveIntervalSec:   room.KeepaliveInterval,
+		MTU:                    room.MTU,
 		OverlaySubnetReference: room.OverlaySubnet,
 	})
 }
 
+func (s *Server) handleLeaveRoom(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var req LeaveRoomRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	username, ok := s.sessionUserLocked(req.SessionToken)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, errors.New("session invalid"))
+		return
+	}
+	room, ok := s.rooms[req.RoomID]
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("room not found"))
+		return
+	}
+	if position, waiting := room.waitingPosition(username, req.DeviceID); waiting {
+		room.Waiting = append(room.Waiting[:position-1], room.Waiting[position:]...)
+	} else {
+		member, ok := room.Members[deviceKey(username, req.DeviceID)]
+		if !ok {
+			writeError(w, http.StatusNotFound, errors.New("device is not a member of this room"))
+			return
+		}
+		s.removeMemberLocked(room, member)
+		s.admitWaitingLocked(room)
+	}
+	if err := s.persistLocked(); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("persist: %w", err))
+		return
+	}
+	writeJSON(w, LeaveRoomResponse{RoomID: room.ID, DeviceID: req.DeviceID})
+}
+
+// removeMemberLocked drops the device from room, returning its address to the room's pool and
+// revoking its data-plane session so the gateway stops forwarding for it immediately.
+func (s *Server) removeMemberLocked(room *roomRecord, member *memberRecord) {
+	delete(room.Members, deviceKey(member.Username, member.DeviceID))
+	room.LastActive = s.now()
+	for id, tunnel := range s.tunnels {
+		if tunnel.RoomID == room.ID && tunnel.Username == member.Username && tunnel.DeviceID == member.DeviceID {
+			delete(s.tunnels, id)
+		}
+	}
+}
+
+// MarkTunnelSeen records data-plane activity for the member behind peerID. It is kept in
+// memory and saved with the next state change, so busy tunnels do not cause disk writes.
+func (s *Server) MarkTunnelSeen(peerID uint32, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tunnel, ok := s.tunnels[peerID]
+	if !ok {
+		return
+	}
+	room, ok := s.rooms[tunnel.RoomID]
+	if !ok {
+		return
+	}
+	if member, ok := room.Members[deviceKey(tunnel.Username, tunnel.DeviceID)]; ok && at.After(member.LastSeen) {
+		member.LastSeen = at
+	}
+}
+
+// roomSubnetsLocked lists the subnets held by existing rooms.
+func (s *Server) roomSubnetsLocked() []netip.Prefix {
+	subnets := make([]netip.Prefix, 0, len(s.rooms))
+	for _, room := range s.rooms {
+		if subnet, err := netip.ParsePrefix(room.OverlaySubnet); err == nil {
+			subnets = append(subnets, subnet)
+		}
+	}
+	return subnets
+}
+
+// allocateAddressLocked picks a free member address in room. The address belongs to the
+// member record from then on, so it stays stable until the device leaves.
+func (s *Server) allocateAddressLocked(room *roomRecord) (string, error) {
+	subnet, err := netip.ParsePrefix(room.OverlaySubnet)
+	if err != nil {
+		return "", fmt.Errorf("room subnet: %w", err)
+	}
+	used := make(map[netip.Addr]bool, len(room.Members))
+	for _, member := range room.Members {
+		if addr, err := netip.ParseAddr(member.VirtualIP); err == nil {
+			used[addr] = true
+		}
+	}
+	addr, err := AllocateHost(subnet, used)
+	if err != nil {
+		return "", err
+	}
+	return addr.String(), nil
+}
+
+// issueTunnelSessionLocked replaces any data-plane session the device holds in the room with a
+// fresh one and returns its peer ID.
+func (s *Server) issueTunnelSessionLocked(room *roomRecord, deviceID, username, virtualIP, sessionKey string) (uint32, error) {
+	key, err := DecodeSessionKey(sessionKey)
+	if err != nil {
+		return 0, err
+	}
+	for id, existing := range s.tunnels {
+		if existing.RoomID == room.ID && existing.Username == username && existing.DeviceID == deviceID {
+			delete(s.tunnels, id)
+		}
+	}
+	peerID, ok := s.nextFreePeerIDLocked()
+	if !ok {
+		return 0, errors.New("no tunnel peer ids available")
+	}
+	s.tunnels[peerID] = TunnelSession{
+		PeerID:    peerID,
+		RoomID:    room.ID,
+		DeviceID:  deviceID,
+		Username:  username,
+		VirtualIP: virtualIP,
+		Subnet:    room.OverlaySubnet,
+		Key:       key,
+	}
+	return peerID, nil
+}
+
+func (s *Server) nextFreePeerIDLocked() (uint32, bool) {
+	for i := 0; i < maxPeerID; i++ {
+		s.nextPeerID++
+		if s.nextPeerID > maxPeerID {
+			s.nextPeerID = 1
+		}
+		if _, taken := s.tunnels[s.nextPeerID]; !taken {
+			return s.nextPeerID, true
+		}
+	}
+	return 0, false
+}
+
 func (s *Server) handleKeepalive(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		w.WriteHeader(http.StatusMethodNotAllowed)
@@ -503,29 +2490,85 @@ func (s *Server) handleTunnelBootstrap(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, err)
 		return
 	}
+	clientKey, err := DecodeEphemeralKey(req.EphemeralKey)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	cipher := req.CipherSuite
+	if cipher == "" {
+		cipher = CipherSuiteAES256GCM
+	}
+	if cipher = ValidateCipherSuite(cipher); cipher == "" {
+		writeError(w, http.StatusBadRequest, errors.New("unsupported cipher suite"))
+		return
+	}
+	serverKey, err := GenerateEphemeralKey()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("ephemeral key: %w", err))
+		return
+	}
+	shared, err := serverKey.ECDH(clientKey)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("x25519: %w", err))
+		return
+	}
+
 	s.mu.Lock()
+	defer s.mu.Unlock()
+	username, ok := s.sessionUserLocked(req.SessionToken)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, errors.New("session invalid"))
+		return
+	}
 	room, ok := s.rooms[req.RoomID]
-	s.mu.Unlock()
 	if !ok {
 		writeError(w, http.StatusNotFound, errors.New("room not found"))
 		return
 	}
-	transport := req.Transport
-	if transport == "" {
-		transport = room.PreferredTransport
+	tunnel, ok := s.tunnelForDeviceLocked(room.ID, username, req.DeviceID)
+	member, isMember := room.Members[deviceKey(username, req.DeviceID)]
+	if !ok || !isMember {
+		writeError(w, http.StatusForbidden, errors.New("device has not joined this room"))
+		return
 	}
-	cipher := req.CipherSuite
-	if cipher == "" {
-		cipher = CipherSuiteAES256GCM
+	transport := room.PreferredTransport
+	if req.Transport != "" {
+		transport = NormalizeTransport(req.Transport)
 	}
+	if transport == "" {
+		writeError(w, http.StatusBadRequest, errors.New("unsupported transport"))
+		return
+	}
+	tunnel.CipherSuite = cipher
+	tunnel.SharedSecret = shared
+	tunnel.OfferKey = clientKey.Bytes()
+	tunnel.AnswerKey = serverKey.PublicKey().Bytes()
+	s.tunnels[tunnel.PeerID] = tunnel
+	member.LastSeen = s.now()
+
 	answer := TunnelAnswer{
 		Transport:    transport,
 		CipherSuite:  cipher,
-		EphemeralKey: req.EphemeralKey,
+		EphemeralKey: EncodeEphemeralKey(serverKey.PublicKey()),
+		DataPort:     s.dataPorts[transport],
 	}
+	if transport == TransportUDP {
+		answer.FallbackPort = s.dataPorts[TransportTCP]
+	}
+	answer.DataTLS = s.dataTLS && (transport == TransportTCP || answer.FallbackPort != 0)
 	writeJSON(w, answer)
 }
 
+func (s *Server) tunnelForDeviceLocked(roomID, username, deviceID string) (TunnelSession, bool) {
+	for _, tunnel := range s.tunnels {
+		if tunnel.RoomID == roomID && tunnel.Username == username && tunnel.DeviceID == deviceID {
+			return tunnel, true
+		}
+	}
+	return TunnelSession{}, false
+}
+
 func decodeJSON(r *http.Request, target any) error {
 	defer r.Body.Close()
 	return json.NewDecoder(r.Body).Decode(target)
@@ -535,6 +2578,11 @@ func writeError(w http.ResponseWriter, status int, err error) {
 	writeResponse(w, status, map[string]string{"error": err.Error()})
 }
 
+// writeErrorCode adds a machine-readable code for errors clients are expected to handle.
+func writeErrorCode(w http.ResponseWriter, status int, code string, err error) {
+	writeResponse(w, status, map[string]string{"error": err.Error(), "code": code})
+}
+
 func writeJSON(w http.ResponseWriter, body any) {
 	writeResponse(w, http.StatusOK, body)
 }
@@ -551,17 +2599,6 @@ func newToken() string {
 	return hex.EncodeToString(buf)
 }
 
-func randomSalt() string {
-	buf := make([]byte, 8)
-	_, _ = rand.Read(buf)
-	return base64.StdEncoding.EncodeToString(buf)
-}
-
-func hashPassword(password, salt string) string {
-	sum := sha256.Sum256([]byte(salt + ":" + password))
-	return base64.StdEncoding.EncodeToString(sum[:])
-}
-
 func NormalizeTransport(t Transport) Transport {
 	switch strings.ToLower(string(t)) {
 	case string(TransportUDP):
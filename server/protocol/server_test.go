@@ -5,7 +5,11 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
+	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -25,6 +29,11 @@ func newTestRigWithPath(t *testing.T, dataPath string) *testRig {
 	if err != nil {
 		t.Fatalf("server init: %v", err)
 	}
+	return newTestRigForServer(t, s)
+}
+
+func newTestRigForServer(t *testing.T, s *Server) *testRig {
+	t.Helper()
 	serverTLS, clientTLS, err := GenerateTLSConfigs()
 	if err != nil {
 		t.Fatalf("tls: %v", err)
@@ -61,12 +70,23 @@ func postJSON(t *testing.T, client *http.Client, url string, reqBody any, respBo
 	return resp
 }
 
+// enrollDevices logs username in from each device, as a client does before joining rooms
+// from it.
+func (r *testRig) enrollDevices(t *testing.T, username, password string, deviceIDs ...string) {
+	t.Helper()
+	for _, id := range deviceIDs {
+		if resp := postJSON(t, r.client, r.server.URL+"/auth/login", LoginRequest{Username: username, Password: password, DeviceID: id}, nil); resp.StatusCode != http.StatusOK {
+			t.Fatalf("enroll %s for %s: %d", id, username, resp.StatusCode)
+		}
+	}
+}
+
 func TestLoginCreateJoinFlow(t *testing.T) {
 	rig := newTestRig(t)
 	defer rig.close()
 
 	var loginResp LoginResponse
-	postJSON(t, rig.client, rig.server.URL+"/auth/login", LoginRequest{Username: "gamer", Password: "password123"}, &loginResp)
+	postJSON(t, rig.client, rig.server.URL+"/auth/login", LoginRequest{Username: "gamer", Password: "password123", DeviceID: "device-1"}, &loginResp)
 	if loginResp.SessionToken == "" || loginResp.DeviceToken == "" {
 		t.Fatalf("expected tokens to be issued")
 	}
@@ -91,22 +111,53 @@ func TestLoginCreateJoinFlow(t *testing.T) {
 }
 
 func TestTunnelNegotiationSelectsTransport(t *testing.T) {
-	rig := newTestRig(t)
+	s := NewServer()
+	rig := newTestRigForServer(t, s)
 	defer rig.close()
 
 	var loginResp LoginResponse
-	postJSON(t, rig.client, rig.server.URL+"/auth/login", LoginRequest{Username: "gamer", Password: "password123"}, &loginResp)
+	postJSON(t, rig.client, rig.server.URL+"/auth/login", LoginRequest{Username: "gamer", Password: "password123", DeviceID: "device-1"}, &loginResp)
 
 	var roomResp CreateRoomResponse
 	postJSON(t, rig.client, rig.server.URL+"/rooms", CreateRoomRequest{Name: "pvp", PreferredTransport: TransportUDP, SessionToken: loginResp.SessionToken}, &roomResp)
 
+	var joinResp JoinRoomResponse
+	postJSON(t, rig.client, rig.server.URL+"/rooms/join", JoinRoomRequest{RoomID: roomResp.RoomID, DeviceID: "device-1", SessionToken: loginResp.SessionToken}, &joinResp)
+
+	clientKey, err := GenerateEphemeralKey()
+	if err != nil {
+		t.Fatalf("ephemeral key: %v", err)
+	}
+
 	// UDP path
-	offer := TunnelOffer{RoomID: roomResp.RoomID, Transport: TransportUDP, CipherSuite: CipherSuiteAES256GCM, EphemeralKey: "client-ephemeral"}
+	offer := TunnelOffer{
+		RoomID:       roomResp.RoomID,
+		DeviceID:     "device-1",
+		SessionToken: loginResp.SessionToken,
+		Transport:    TransportUDP,
+		CipherSuite:  CipherSuiteAES256GCM,
+		EphemeralKey: EncodeEphemeralKey(clientKey.PublicKey()),
+	}
 	var answer TunnelAnswer
 	postJSON(t, rig.client, rig.server.URL+"/tunnel/bootstrap", offer, &answer)
 	if answer.Transport != TransportUDP || answer.CipherSuite != CipherSuiteAES256GCM {
 		t.Fatalf("unexpected negotiation result: %+v", answer)
 	}
+	if answer.EphemeralKey == "" || answer.EphemeralKey == offer.EphemeralKey {
+		t.Fatalf("server must answer with its own ephemeral key, got %q", answer.EphemeralKey)
+	}
+	serverKey, err := DecodeEphemeralKey(answer.EphemeralKey)
+	if err != nil {
+		t.Fatalf("decode server key: %v", err)
+	}
+	shared, err := clientKey.ECDH(serverKey)
+	if err != nil {
+		t.Fatalf("shared secret: %v", err)
+	}
+	session, ok := s.LookupTunnelSession(joinResp.PeerID)
+	if !ok || !bytes.Equal(session.SharedSecret, shared) {
+		t.Fatalf("client and server disagree on the shared secret")
+	}
 
 	// TCP fallback path
 	offer.Transport = TransportTCP
@@ -120,6 +171,41 @@ func TestTunnelNegotiationSelectsTransport(t *testing.T) {
 	}
 }
 
+func TestTunnelBootstrapRequiresMembership(t *testing.T) {
+	rig := newTestRig(t)
+	defer rig.close()
+
+	var adminLogin LoginResponse
+	postJSON(t, rig.client, rig.server.URL+"/auth/login", LoginRequest{Username: "gamer", Password: "password123", DeviceID: "admin-pc"}, &adminLogin)
+	var roomResp CreateRoomResponse
+	postJSON(t, rig.client, rig.server.URL+"/rooms", CreateRoomRequest{Name: "private", SessionToken: adminLogin.SessionToken}, &roomResp)
+	var joinResp JoinRoomResponse
+	postJSON(t, rig.client, rig.server.URL+"/rooms/join", JoinRoomRequest{RoomID: roomResp.RoomID, DeviceID: "admin-pc", SessionToken: adminLogin.SessionToken}, &joinResp)
+
+	var regResp RegisterResponse
+	postJSON(t, rig.client, rig.server.URL+"/auth/register", RegisterRequest{Username: "outsider", Password: "pw"}, &regResp)
+
+	clientKey, _ := GenerateEphemeralKey()
+	offer := TunnelOffer{RoomID: roomResp.RoomID, DeviceID: "admin-pc", SessionToken: regResp.SessionToken, EphemeralKey: EncodeEphemeralKey(clientKey.PublicKey())}
+	resp := postJSON(t, rig.client, rig.server.URL+"/tunnel/bootstrap", offer, nil)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected forbidden for another user's device, got %d", resp.StatusCode)
+	}
+
+	offer.SessionToken = ""
+	resp = postJSON(t, rig.client, rig.server.URL+"/tunnel/bootstrap", offer, nil)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected unauthorized without a session, got %d", resp.StatusCode)
+	}
+
+	offer.SessionToken = adminLogin.SessionToken
+	offer.EphemeralKey = "client-ephemeral"
+	resp = postJSON(t, rig.client, rig.server.URL+"/tunnel/bootstrap", offer, nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected bad request for a malformed ephemeral key, got %d", resp.StatusCode)
+	}
+}
+
 func TestKeepaliveEcho(t *testing.T) {
 	rig := newTestRig(t)
 	defer rig.close()
@@ -187,23 +273,110 @@ func TestFirstRegisteredUserIsAdmin(t *testing.T) {
 	}
 }
 
-func TestNonAdminCannotCreateRoom(t *testing.T) {
-	rig := newTestRig(t)
+func TestNonAdminRoomCreationIsBounded(t *testing.T) {
+	s := NewServer()
+	if err := s.SetRoomLimit(1); err != nil {
+		t.Fatalf("set room limit: %v", err)
+	}
+	rig := newTestRigForServer(t, s)
 	defer rig.close()
 
 	var regResp RegisterResponse
 	postJSON(t, rig.client, rig.server.URL+"/auth/register", RegisterRequest{Username: "member", Password: "pw"}, &regResp)
 
-	resp := postJSON(t, rig.client, rig.server.URL+"/rooms", CreateRoomRequest{Name: "restricted", SessionToken: regResp.SessionToken}, &CreateRoomResponse{})
+	var roomResp CreateRoomResponse
+	resp := postJSON(t, rig.client, rig.server.URL+"/rooms", CreateRoomRequest{Name: "mine", SessionToken: regResp.SessionToken}, &roomResp)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected non-admin to create a room within the limit, got %d", resp.StatusCode)
+	}
+	var detail RoomDetail
+	postJSON(t, rig.client, rig.server.URL+"/rooms/get", GetRoomRequest{RoomID: roomResp.RoomID, SessionToken: regResp.SessionToken}, &detail)
+	if detail.Owner != "member" || detail.Role != RoomRoleOwner {
+		t.Fatalf("creator should own the room: %+v", detail.RoomSummary)
+	}
+
+	resp = postJSON(t, rig.client, rig.server.URL+"/rooms", CreateRoomRequest{Name: "another", SessionToken: regResp.SessionToken}, nil)
 	if resp.StatusCode != http.StatusForbidden {
-		t.Fatalf("expected forbidden for non-admin, got %d", resp.StatusCode)
+		t.Fatalf("expected forbidden beyond the room limit, got %d", resp.StatusCode)
+	}
+
+	var loginResp LoginResponse
+	postJSON(t, rig.client, rig.server.URL+"/auth/login", LoginRequest{Username: "gamer", Password: "password123"}, &loginResp)
+	for i := 0; i < 2; i++ {
+		resp = postJSON(t, rig.client, rig.server.URL+"/rooms", CreateRoomRequest{Name: "admin", SessionToken: loginResp.SessionToken}, nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("admins should not be bound by the room limit, got %d", resp.StatusCode)
+		}
 	}
 }
 
-func TestAdminCanGrantAndRevoke(t *testing.T) {
+func TestRoomRolesGovernManagement(t *testing.T) {
 	rig := newTestRig(t)
 	defer rig.close()
 
+	var owner, mod, other RegisterResponse
+	postJSON(t, rig.client, rig.server.URL+"/auth/register", RegisterRequest{Username: "owner", Password: "pw"}, &owner)
+	postJSON(t, rig.client, rig.server.URL+"/auth/register", RegisterRequest{Username: "mod", Password: "pw"}, &mod)
+	postJSON(t, rig.client, rig.server.URL+"/auth/register", RegisterRequest{Username: "other", Password: "pw"}, &other)
+	var roomResp CreateRoomResponse
+	postJSON(t, rig.client, rig.server.URL+"/rooms", CreateRoomRequest{Name: "lan", SessionToken: owner.SessionToken}, &roomResp)
+
+	update := func(token string) int {
+		return postJSON(t, rig.client, rig.server.URL+"/rooms/update", UpdateRoomRequest{RoomID: roomResp.RoomID, MTU: 1300, SessionToken: token}, nil).StatusCode
+	}
+	setRole := func(token, target string, role RoomRole) int {
+		return postJSON(t, rig.client, rig.server.URL+"/rooms/role", RoomRoleUpdateRequest{RoomID: roomResp.RoomID, TargetUser: target, Role: role, SessionToken: token}, nil).StatusCode
+	}
+
+	if status := update(mod.SessionToken); status != http.StatusForbidden {
+		t.Fatalf("expected forbidden update before promotion, got %d", status)
+	}
+	if status := setRole(mod.SessionToken, "mod", RoomRoleModerator); status != http.StatusForbidden {
+		t.Fatalf("users must not promote themselves, got %d", status)
+	}
+	if status := setRole(owner.SessionToken, "mod", RoomRoleModerator); status != http.StatusOK {
+		t.Fatalf("owner could not promote a moderator: %d", status)
+	}
+	if status := update(mod.SessionToken); status != http.StatusOK {
+		t.Fatalf("moderator could not update room: %d", status)
+	}
+	if status := setRole(mod.SessionToken, "other", RoomRoleModerator); status != http.StatusForbidden {
+		t.Fatalf("moderators must not assign roles, got %d", status)
+	}
+	resp := postJSON(t, rig.client, rig.server.URL+"/rooms/delete", DeleteRoomRequest{RoomID: roomResp.RoomID, SessionToken: mod.SessionToken}, nil)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("moderators must not delete rooms, got %d", resp.StatusCode)
+	}
+	if status := setRole(owner.SessionToken, "owner", RoomRoleMember); status != http.StatusBadRequest {
+		t.Fatalf("owner must transfer before stepping down, got %d", status)
+	}
+
+	if status := setRole(owner.SessionToken, "other", RoomRoleOwner); status != http.StatusOK {
+		t.Fatalf("ownership transfer failed: %d", status)
+	}
+	var detail RoomDetail
+	postJSON(t, rig.client, rig.server.URL+"/rooms/get", GetRoomRequest{RoomID: roomResp.RoomID, SessionToken: owner.SessionToken}, &detail)
+	if detail.Owner != "other" || detail.Role != RoomRoleModerator {
+		t.Fatalf("previous owner should become a moderator: %+v", detail.RoomSummary)
+	}
+
+	var admin LoginResponse
+	postJSON(t, rig.client, rig.server.URL+"/auth/login", LoginRequest{Username: "gamer", Password: "password123"}, &admin)
+	resp = postJSON(t, rig.client, rig.server.URL+"/rooms/delete", DeleteRoomRequest{RoomID: roomResp.RoomID, SessionToken: admin.SessionToken}, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("global admin should be able to delete any room, got %d", resp.StatusCode)
+	}
+}
+
+func TestAdminCanGrantAndRevoke(t *testing.T) {
+	s := NewServer()
+	// With no room allowance, creating rooms depends on admin rights alone.
+	if err := s.SetRoomLimit(0); err != nil {
+		t.Fatalf("set room limit: %v", err)
+	}
+	rig := newTestRigForServer(t, s)
+	defer rig.close()
+
 	var adminLogin LoginResponse
 	postJSON(t, rig.client, rig.server.URL+"/auth/login", LoginRequest{Username: "gamer", Password: "password123"}, &adminLogin)
 
@@ -234,3 +407,1347 @@ func TestAdminCanGrantAndRevoke(t *testing.T) {
 		t.Fatalf("expected revoked admin to be blocked, got %d", resp.StatusCode)
 	}
 }
+
+func TestJoinIssuesTunnelSession(t *testing.T) {
+	s := NewServer()
+	rig := newTestRigForServer(t, s)
+	defer rig.close()
+
+	var loginResp LoginResponse
+	postJSON(t, rig.client, rig.server.URL+"/auth/login", LoginRequest{Username: "gamer", Password: "password123", DeviceID: "pc"}, &loginResp)
+
+	var roomResp CreateRoomResponse
+	postJSON(t, rig.client, rig.server.URL+"/rooms", CreateRoomRequest{Name: "lan", SessionToken: loginResp.SessionToken}, &roomResp)
+
+	var first JoinRoomResponse
+	postJSON(t, rig.client, rig.server.URL+"/rooms/join", JoinRoomRequest{RoomID: roomResp.RoomID, DeviceID: "pc", SessionToken: loginResp.SessionToken}, &first)
+	session, ok := s.LookupTunnelSession(first.PeerID)
+	if !ok {
+		t.Fatalf("expected tunnel session for peer %d", first.PeerID)
+	}
+	if session.RoomID != roomResp.RoomID || session.DeviceID != "pc" || session.VirtualIP != first.VirtualIP {
+		t.Fatalf("unexpected tunnel session: %+v", session)
+	}
+
+	var second JoinRoomResponse
+	postJSON(t, rig.client, rig.server.URL+"/rooms/join", JoinRoomRequest{RoomID: roomResp.RoomID, DeviceID: "pc", SessionToken: loginResp.SessionToken}, &second)
+	if _, ok := s.LookupTunnelSession(first.PeerID); ok && first.PeerID != second.PeerID {
+		t.Fatalf("rejoining should retire the previous tunnel session")
+	}
+	if _, ok := s.LookupTunnelSession(second.PeerID); !ok {
+		t.Fatalf("expected tunnel session for rejoined peer")
+	}
+}
+
+func TestJoinLeasesStableAddressInsideRoomSubnet(t *testing.T) {
+	dataPath := filepath.Join(t.TempDir(), "state.json")
+	s, err := NewServerWithStorage(dataPath)
+	if err != nil {
+		t.Fatalf("server init: %v", err)
+	}
+	if err := s.SetAddressPool("10.77.0.0/23", 24); err != nil {
+		t.Fatalf("address pool: %v", err)
+	}
+	rig := newTestRigForServer(t, s)
+	defer rig.close()
+
+	var regResp RegisterResponse
+	postJSON(t, rig.client, rig.server.URL+"/auth/register", RegisterRequest{Username: "host", Password: "pw", DeviceID: "pc"}, &regResp)
+	rig.enrollDevices(t, "host", "pw", "laptop")
+
+	var rooms []CreateRoomResponse
+	for _, name := range []string{"a", "b"} {
+		var roomResp CreateRoomResponse
+		postJSON(t, rig.client, rig.server.URL+"/rooms", CreateRoomRequest{Name: name, SessionToken: regResp.SessionToken}, &roomResp)
+		rooms = append(rooms, roomResp)
+	}
+	if rooms[0].OverlaySubnet != "10.77.0.0/24" || rooms[1].OverlaySubnet != "10.77.1.0/24" {
+		t.Fatalf("unexpected subnets %s and %s", rooms[0].OverlaySubnet, rooms[1].OverlaySubnet)
+	}
+	resp := postJSON(t, rig.client, rig.server.URL+"/rooms", CreateRoomRequest{Name: "c", SessionToken: regResp.SessionToken}, nil)
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected exhausted pool to be reported, got %d", resp.StatusCode)
+	}
+
+	join := func(rig *testRig, session, roomID, deviceID string) JoinRoomResponse {
+		var joinResp JoinRoomResponse
+		postJSON(t, rig.client, rig.server.URL+"/rooms/join", JoinRoomRequest{RoomID: roomID, DeviceID: deviceID, SessionToken: session}, &joinResp)
+		return joinResp
+	}
+	first := join(rig, regResp.SessionToken, rooms[0].RoomID, "pc")
+	second := join(rig, regResp.SessionToken, rooms[0].RoomID, "laptop")
+	subnet := netip.MustParsePrefix(rooms[0].OverlaySubnet)
+	for _, j := range []JoinRoomResponse{first, second} {
+		if !subnet.Contains(netip.MustParseAddr(j.VirtualIP)) {
+			t.Fatalf("address %s outside room subnet %s", j.VirtualIP, subnet)
+		}
+	}
+	if first.VirtualIP == second.VirtualIP {
+		t.Fatalf("two devices share %s", first.VirtualIP)
+	}
+	if again := join(rig, regResp.SessionToken, rooms[0].RoomID, "pc"); again.VirtualIP != first.VirtualIP {
+		t.Fatalf("rejoin moved device from %s to %s", first.VirtualIP, again.VirtualIP)
+	}
+	if other := join(rig, regResp.SessionToken, rooms[1].RoomID, "pc"); !netip.MustParsePrefix(rooms[1].OverlaySubnet).Contains(netip.MustParseAddr(other.VirtualIP)) {
+		t.Fatalf("address %s outside second room's subnet", other.VirtualIP)
+	}
+
+	rig.close()
+	restarted := newTestRigWithPath(t, dataPath)
+	defer restarted.close()
+	var loginResp LoginResponse
+	postJSON(t, restarted.client, restarted.server.URL+"/auth/login", LoginRequest{Username: "host", Password: "pw"}, &loginResp)
+	if afterRestart := join(restarted, loginResp.SessionToken, rooms[0].RoomID, "laptop"); afterRestart.VirtualIP != second.VirtualIP {
+		t.Fatalf("lease lost across restart: %s, want %s", afterRestart.VirtualIP, second.VirtualIP)
+	}
+}
+
+func TestJoinIsIdempotentPerDevice(t *testing.T) {
+	s := NewServer()
+	rig := newTestRigForServer(t, s)
+	defer rig.close()
+
+	var loginResp LoginResponse
+	postJSON(t, rig.client, rig.server.URL+"/auth/login", LoginRequest{Username: "gamer", Password: "password123", DeviceID: "pc"}, &loginResp)
+	var roomResp CreateRoomResponse
+	postJSON(t, rig.client, rig.server.URL+"/rooms", CreateRoomRequest{Name: "lan", SessionToken: loginResp.SessionToken}, &roomResp)
+	joinReq := JoinRoomRequest{RoomID: roomResp.RoomID, DeviceID: "pc", SessionToken: loginResp.SessionToken}
+
+	var first, second JoinRoomResponse
+	postJSON(t, rig.client, rig.server.URL+"/rooms/join", joinReq, &first)
+	postJSON(t, rig.client, rig.server.URL+"/rooms/join", joinReq, &second)
+	if second != first {
+		t.Fatalf("repeated join changed the membership: %+v then %+v", first, second)
+	}
+
+	joinReq.RotateKey = true
+	var rotated JoinRoomResponse
+	postJSON(t, rig.client, rig.server.URL+"/rooms/join", joinReq, &rotated)
+	if rotated.SessionKey == first.SessionKey || rotated.PeerID == first.PeerID {
+		t.Fatalf("rotation should issue a new session: %+v", rotated)
+	}
+	if rotated.VirtualIP != first.VirtualIP {
+		t.Fatalf("rotation moved the device from %s to %s", first.VirtualIP, rotated.VirtualIP)
+	}
+	if _, ok := s.LookupTunnelSession(first.PeerID); ok {
+		t.Fatalf("rotated-out session should be revoked")
+	}
+
+	s.mu.Lock()
+	member := *s.rooms[roomResp.RoomID].Members[deviceKey("gamer", "pc")]
+	s.mu.Unlock()
+	if member.Username != "gamer" || member.VirtualIP != first.VirtualIP || member.JoinedAt.IsZero() || member.LastSeen.Before(member.JoinedAt) {
+		t.Fatalf("unexpected membership record: %+v", member)
+	}
+	later := member.LastSeen.Add(time.Minute)
+	s.MarkTunnelSeen(rotated.PeerID, later)
+	s.mu.Lock()
+	seen := s.rooms[roomResp.RoomID].Members[deviceKey("gamer", "pc")].LastSeen
+	s.mu.Unlock()
+	if !seen.Equal(later) {
+		t.Fatalf("data-plane activity not recorded: %s", seen)
+	}
+
+	// Another account's device of the same ID is a separate member.
+	var regResp RegisterResponse
+	postJSON(t, rig.client, rig.server.URL+"/auth/register", RegisterRequest{Username: "other", Password: "pw", DeviceID: "pc"}, &regResp)
+	var theirs JoinRoomResponse
+	resp := postJSON(t, rig.client, rig.server.URL+"/rooms/join", JoinRoomRequest{RoomID: roomResp.RoomID, DeviceID: "pc", SessionToken: regResp.SessionToken}, &theirs)
+	if resp.StatusCode != http.StatusOK || theirs.VirtualIP == rotated.VirtualIP || theirs.PeerID == rotated.PeerID {
+		t.Fatalf("another account's pc should join separately, got %d %+v", resp.StatusCode, theirs)
+	}
+	if _, ok := s.LookupTunnelSession(rotated.PeerID); !ok {
+		t.Fatalf("another account's join revoked gamer's session")
+	}
+}
+
+func TestLeaveReleasesAddressAndSession(t *testing.T) {
+	s := NewServer()
+	rig := newTestRigForServer(t, s)
+	defer rig.close()
+
+	var loginResp LoginResponse
+	postJSON(t, rig.client, rig.server.URL+"/auth/login", LoginRequest{Username: "gamer", Password: "password123", DeviceID: "pc"}, &loginResp)
+	rig.enrollDevices(t, "gamer", "password123", "laptop")
+	var roomResp CreateRoomResponse
+	postJSON(t, rig.client, rig.server.URL+"/rooms", CreateRoomRequest{Name: "lan", SessionToken: loginResp.SessionToken}, &roomResp)
+
+	var pc JoinRoomResponse
+	postJSON(t, rig.client, rig.server.URL+"/rooms/join", JoinRoomRequest{RoomID: roomResp.RoomID, DeviceID: "pc", SessionToken: loginResp.SessionToken}, &pc)
+
+	leave := LeaveRoomRequest{RoomID: roomResp.RoomID, DeviceID: "pc", SessionToken: loginResp.SessionToken}
+	var leaveResp LeaveRoomResponse
+	resp := postJSON(t, rig.client, rig.server.URL+"/rooms/leave", leave, &leaveResp)
+	if resp.StatusCode != http.StatusOK || leaveResp.DeviceID != "pc" {
+		t.Fatalf("leave failed: %d %+v", resp.StatusCode, leaveResp)
+	}
+	if _, ok := s.LookupTunnelSession(pc.PeerID); ok {
+		t.Fatalf("tunnel session should be revoked on leave")
+	}
+	resp = postJSON(t, rig.client, rig.server.URL+"/rooms/leave", leave, nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected not found when leaving twice, got %d", resp.StatusCode)
+	}
+
+	var laptop JoinRoomResponse
+	postJSON(t, rig.client, rig.server.URL+"/rooms/join", JoinRoomRequest{RoomID: roomResp.RoomID, DeviceID: "laptop", SessionToken: loginResp.SessionToken}, &laptop)
+	if laptop.VirtualIP != pc.VirtualIP {
+		t.Fatalf("released address %s was not reused, got %s", pc.VirtualIP, laptop.VirtualIP)
+	}
+}
+
+func TestListAndGetRooms(t *testing.T) {
+	rig := newTestRig(t)
+	defer rig.close()
+
+	var loginResp LoginResponse
+	postJSON(t, rig.client, rig.server.URL+"/auth/login", LoginRequest{Username: "gamer", Password: "password123", DeviceID: "pc"}, &loginResp)
+	var lan, raid CreateRoomResponse
+	postJSON(t, rig.client, rig.server.URL+"/rooms", CreateRoomRequest{Name: "lan", SessionToken: loginResp.SessionToken}, &lan)
+	postJSON(t, rig.client, rig.server.URL+"/rooms", CreateRoomRequest{Name: "raid", PreferredTransport: TransportTCP, MTU: 1300, SessionToken: loginResp.SessionToken}, &raid)
+	var joinResp JoinRoomResponse
+	postJSON(t, rig.client, rig.server.URL+"/rooms/join", JoinRoomRequest{RoomID: lan.RoomID, DeviceID: "pc", SessionToken: loginResp.SessionToken}, &joinResp)
+
+	var listResp ListRoomsResponse
+	resp := postJSON(t, rig.client, rig.server.URL+"/rooms/list", ListRoomsRequest{SessionToken: loginResp.SessionToken}, &listResp)
+	if resp.StatusCode != http.StatusOK || len(listResp.Rooms) != 2 {
+		t.Fatalf("list failed: %d %+v", resp.StatusCode, listResp)
+	}
+	first, second := listResp.Rooms[0], listResp.Rooms[1]
+	if first.Name != "lan" || first.MemberCount != 1 || !first.IsMember {
+		t.Fatalf("unexpected lan summary %+v", first)
+	}
+	if second.Name != "raid" || second.PreferredTransport != TransportTCP || second.MTU != 1300 || second.MemberCount != 0 || second.IsMember {
+		t.Fatalf("unexpected raid summary %+v", second)
+	}
+
+	var detail RoomDetail
+	resp = postJSON(t, rig.client, rig.server.URL+"/rooms/get", GetRoomRequest{RoomID: lan.RoomID, SessionToken: loginResp.SessionToken}, &detail)
+	if resp.StatusCode != http.StatusOK || detail.RoomID != lan.RoomID || len(detail.Members) != 1 {
+		t.Fatalf("get failed: %d %+v", resp.StatusCode, detail)
+	}
+	member := detail.Members[0]
+	if member.DeviceID != "pc" || member.Username != "gamer" || member.VirtualIP != joinResp.VirtualIP || member.JoinedAtUnix == 0 {
+		t.Fatalf("unexpected roster entry %+v", member)
+	}
+
+	resp = postJSON(t, rig.client, rig.server.URL+"/rooms/get", GetRoomRequest{RoomID: "missing", SessionToken: loginResp.SessionToken}, nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected not found for unknown room, got %d", resp.StatusCode)
+	}
+	resp = postJSON(t, rig.client, rig.server.URL+"/rooms/list", ListRoomsRequest{SessionToken: "bogus"}, nil)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected unauthorized list without session, got %d", resp.StatusCode)
+	}
+}
+
+func TestUpdateRoomSettings(t *testing.T) {
+	rig := newTestRig(t)
+	defer rig.close()
+
+	var loginResp LoginResponse
+	postJSON(t, rig.client, rig.server.URL+"/auth/login", LoginRequest{Username: "gamer", Password: "password123", DeviceID: "pc"}, &loginResp)
+	var roomResp CreateRoomResponse
+	postJSON(t, rig.client, rig.server.URL+"/rooms", CreateRoomRequest{Name: "lan", SessionToken: loginResp.SessionToken}, &roomResp)
+
+	var detail RoomDetail
+	update := UpdateRoomRequest{RoomID: roomResp.RoomID, Name: "raid", PreferredTransport: TransportTCP, MTU: 1300, KeepaliveIntervalSec: 25, SessionToken: loginResp.SessionToken}
+	resp := postJSON(t, rig.client, rig.server.URL+"/rooms/update", update, &detail)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("update failed: %d", resp.StatusCode)
+	}
+	if detail.Name != "raid" || detail.PreferredTransport != TransportTCP || detail.MTU != 1300 || detail.KeepaliveIntervalSec != 25 {
+		t.Fatalf("settings not applied: %+v", detail)
+	}
+
+	resp = postJSON(t, rig.client, rig.server.URL+"/rooms/update", UpdateRoomRequest{RoomID: roomResp.RoomID, MTU: 1200, SessionToken: loginResp.SessionToken}, &detail)
+	if resp.StatusCode != http.StatusOK || detail.MTU != 1200 || detail.Name != "raid" || detail.KeepaliveIntervalSec != 25 {
+		t.Fatalf("partial update should keep other settings: %d %+v", resp.StatusCode, detail)
+	}
+	var joinResp JoinRoomResponse
+	postJSON(t, rig.client, rig.server.URL+"/rooms/join", JoinRoomRequest{RoomID: roomResp.RoomID, DeviceID: "pc", SessionToken: loginResp.SessionToken}, &joinResp)
+	if joinResp.MTU != 1200 || joinResp.KeepaliveIntervalSec != 25 || joinResp.Transport != TransportTCP {
+		t.Fatalf("join should hand out the updated settings: %+v", joinResp)
+	}
+
+	for _, bad := range []UpdateRoomRequest{
+		{RoomID: roomResp.RoomID, PreferredTransport: "quic"},
+		{RoomID: roomResp.RoomID, MTU: 9000},
+		{RoomID: roomResp.RoomID, KeepaliveIntervalSec: 3600},
+	} {
+		bad.SessionToken = loginResp.SessionToken
+		resp = postJSON(t, rig.client, rig.server.URL+"/rooms/update", bad, nil)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected bad request for %+v, got %d", bad, resp.StatusCode)
+		}
+	}
+
+	var regResp LoginResponse
+	postJSON(t, rig.client, rig.server.URL+"/auth/register", RegisterRequest{Username: "friend", Password: "hunter22", DeviceID: "laptop"}, &regResp)
+	resp = postJSON(t, rig.client, rig.server.URL+"/rooms/update", UpdateRoomRequest{RoomID: roomResp.RoomID, Name: "mine", SessionToken: regResp.SessionToken}, nil)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected non-admin update to be forbidden, got %d", resp.StatusCode)
+	}
+}
+
+func TestCreateRoomValidatesSettings(t *testing.T) {
+	rig := newTestRig(t)
+	defer rig.close()
+
+	var loginResp LoginResponse
+	postJSON(t, rig.client, rig.server.URL+"/auth/login", LoginRequest{Username: "gamer", Password: "password123", DeviceID: "pc"}, &loginResp)
+	for _, bad := range []CreateRoomRequest{
+		{Name: "bad", PreferredTransport: "quic"},
+		{Name: "bad", MTU: 9000},
+		{Name: "bad", MTU: 100},
+		{Name: "bad", MaxMembers: -1},
+		{Name: "bad", IdleTimeoutSec: 10},
+	} {
+		bad.SessionToken = loginResp.SessionToken
+		if resp := postJSON(t, rig.client, rig.server.URL+"/rooms", bad, nil); resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected bad request for %+v, got %d", bad, resp.StatusCode)
+		}
+	}
+
+	var roomResp CreateRoomResponse
+	postJSON(t, rig.client, rig.server.URL+"/rooms", CreateRoomRequest{Name: "lan", PreferredTransport: "TCP", MTU: 1500, SessionToken: loginResp.SessionToken}, &roomResp)
+	if roomResp.PreferredTransport != TransportTCP || roomResp.MTU != 1500 {
+		t.Fatalf("create should normalize the transport and keep a valid mtu: %+v", roomResp)
+	}
+	var rooms ListRoomsResponse
+	postJSON(t, rig.client, rig.server.URL+"/rooms/list", ListRoomsRequest{SessionToken: loginResp.SessionToken}, &rooms)
+	if len(rooms.Rooms) != 1 {
+		t.Fatalf("rejected creates should not leave rooms behind: %+v", rooms.Rooms)
+	}
+}
+
+func TestDeleteRoomDisconnectsMembersAndReleasesSubnet(t *testing.T) {
+	s := NewServer()
+	rig := newTestRigForServer(t, s)
+	defer rig.close()
+
+	var loginResp LoginResponse
+	postJSON(t, rig.client, rig.server.URL+"/auth/login", LoginRequest{Username: "gamer", Password: "password123", DeviceID: "pc"}, &loginResp)
+	var first, second CreateRoomResponse
+	postJSON(t, rig.client, rig.server.URL+"/rooms", CreateRoomRequest{Name: "lan", SessionToken: loginResp.SessionToken}, &first)
+	postJSON(t, rig.client, rig.server.URL+"/rooms", CreateRoomRequest{Name: "raid", SessionToken: loginResp.SessionToken}, &second)
+	var joinResp JoinRoomResponse
+	postJSON(t, rig.client, rig.server.URL+"/rooms/join", JoinRoomRequest{RoomID: first.RoomID, DeviceID: "pc", SessionToken: loginResp.SessionToken}, &joinResp)
+
+	var deleteResp DeleteRoomResponse
+	resp := postJSON(t, rig.client, rig.server.URL+"/rooms/delete", DeleteRoomRequest{RoomID: first.RoomID, SessionToken: loginResp.SessionToken}, &deleteResp)
+	if resp.StatusCode != http.StatusOK || len(deleteResp.DisconnectedDevices) != 1 || deleteResp.DisconnectedDevices[0] != "pc" {
+		t.Fatalf("delete failed: %d %+v", resp.StatusCode, deleteResp)
+	}
+	if _, ok := s.LookupTunnelSession(joinResp.PeerID); ok {
+		t.Fatalf("tunnel session should be revoked with the room")
+	}
+	resp = postJSON(t, rig.client, rig.server.URL+"/rooms/join", JoinRoomRequest{RoomID: first.RoomID, DeviceID: "pc", SessionToken: loginResp.SessionToken}, nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected deleted room to be gone, got %d", resp.StatusCode)
+	}
+
+	var third CreateRoomResponse
+	postJSON(t, rig.client, rig.server.URL+"/rooms", CreateRoomRequest{Name: "again", SessionToken: loginResp.SessionToken}, &third)
+	if third.OverlaySubnet != first.OverlaySubnet {
+		t.Fatalf("released subnet %s was not reused, got %s", first.OverlaySubnet, third.OverlaySubnet)
+	}
+	if third.RoomID == second.RoomID {
+		t.Fatalf("new room reused the ID of surviving room %s", second.RoomID)
+	}
+}
+
+func TestRoomPasswordGuardsJoin(t *testing.T) {
+	rig := newTestRig(t)
+	defer rig.close()
+
+	var owner, friend RegisterResponse
+	postJSON(t, rig.client, rig.server.URL+"/auth/register", RegisterRequest{Username: "owner", Password: "pw", DeviceID: "pc"}, &owner)
+	postJSON(t, rig.client, rig.server.URL+"/auth/register", RegisterRequest{Username: "friend", Password: "pw", DeviceID: "laptop"}, &friend)
+	rig.enrollDevices(t, "friend", "pw", "phone")
+	var roomResp CreateRoomResponse
+	postJSON(t, rig.client, rig.server.URL+"/rooms", CreateRoomRequest{Name: "lan", Password: "sesame", SessionToken: owner.SessionToken}, &roomResp)
+
+	join := JoinRoomRequest{RoomID: roomResp.RoomID, DeviceID: "laptop", SessionToken: friend.SessionToken}
+	if resp := postJSON(t, rig.client, rig.server.URL+"/rooms/join", join, nil); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected forbidden without password, got %d", resp.StatusCode)
+	}
+	join.Password = "wrong"
+	if resp := postJSON(t, rig.client, rig.server.URL+"/rooms/join", join, nil); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected forbidden with wrong password, got %d", resp.StatusCode)
+	}
+	join.Password = "sesame"
+	if resp := postJSON(t, rig.client, rig.server.URL+"/rooms/join", join, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("join with password failed: %d", resp.StatusCode)
+	}
+	// A second device of an admitted user needs no password.
+	if resp := postJSON(t, rig.client, rig.server.URL+"/rooms/join", JoinRoomRequest{RoomID: roomResp.RoomID, DeviceID: "phone", SessionToken: friend.SessionToken}, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("member's second device was refused: %d", resp.StatusCode)
+	}
+	if resp := postJSON(t, rig.client, rig.server.URL+"/rooms/join", JoinRoomRequest{RoomID: roomResp.RoomID, DeviceID: "pc", SessionToken: owner.SessionToken}, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("owner was refused from own room: %d", resp.StatusCode)
+	}
+
+	var detail RoomDetail
+	postJSON(t, rig.client, rig.server.URL+"/rooms/update", UpdateRoomRequest{RoomID: roomResp.RoomID, ClearPassword: true, SessionToken: owner.SessionToken}, &detail)
+	if detail.HasPassword {
+		t.Fatalf("password should be cleared: %+v", detail.RoomSummary)
+	}
+}
+
+func TestInviteCodesAdmitToInviteOnlyRoom(t *testing.T) {
+	s := NewServer()
+	now := time.Unix(1_700_000_000, 0)
+	s.now = func() time.Time { return now }
+	rig := newTestRigForServer(t, s)
+	defer rig.close()
+
+	var owner, a, b, c RegisterResponse
+	postJSON(t, rig.client, rig.server.URL+"/auth/register", RegisterRequest{Username: "owner", Password: "pw"}, &owner)
+	postJSON(t, rig.client, rig.server.URL+"/auth/register", RegisterRequest{Username: "a", Password: "pw", DeviceID: "a"}, &a)
+	postJSON(t, rig.client, rig.server.URL+"/auth/register", RegisterRequest{Username: "b", Password: "pw", DeviceID: "b"}, &b)
+	postJSON(t, rig.client, rig.server.URL+"/auth/register", RegisterRequest{Username: "c", Password: "pw", DeviceID: "c"}, &c)
+	var roomResp CreateRoomResponse
+	postJSON(t, rig.client, rig.server.URL+"/rooms", CreateRoomRequest{Name: "secret", InviteOnly: true, SessionToken: owner.SessionToken}, &roomResp)
+
+	var listResp ListRoomsResponse
+	postJSON(t, rig.client, rig.server.URL+"/rooms/list", ListRoomsRequest{SessionToken: a.SessionToken}, &listResp)
+	if len(listResp.Rooms) != 0 {
+		t.Fatalf("invite-only room should be hidden from outsiders: %+v", listResp.Rooms)
+	}
+	if resp := postJSON(t, rig.client, rig.server.URL+"/rooms/get", GetRoomRequest{RoomID: roomResp.RoomID, SessionToken: a.SessionToken}, nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected hidden room to be not found, got %d", resp.StatusCode)
+	}
+	if resp := postJSON(t, rig.client, rig.server.URL+"/rooms/join", JoinRoomRequest{RoomID: roomResp.RoomID, DeviceID: "a", SessionToken: a.SessionToken}, nil); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected forbidden join without invite, got %d", resp.StatusCode)
+	}
+	if resp := postJSON(t, rig.client, rig.server.URL+"/rooms/invite", CreateInviteRequest{RoomID: roomResp.RoomID, SessionToken: a.SessionToken}, nil); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("only the owner may create invites, got %d", resp.StatusCode)
+	}
+
+	var invite CreateInviteResponse
+	postJSON(t, rig.client, rig.server.URL+"/rooms/invite", CreateInviteRequest{RoomID: roomResp.RoomID, TTLSeconds: 3600, MaxUses: 1, SessionToken: owner.SessionToken}, &invite)
+	if invite.Code == "" || invite.ExpiresAtUnix != now.Add(time.Hour).Unix() {
+		t.Fatalf("unexpected invite %+v", invite)
+	}
+	join := func(token, device, code string) int {
+		req := JoinRoomRequest{RoomID: roomResp.RoomID, DeviceID: device, InviteCode: code, SessionToken: token}
+		return postJSON(t, rig.client, rig.server.URL+"/rooms/join", req, nil).StatusCode
+	}
+	if status := join(a.SessionToken, "a", invite.Code); status != http.StatusOK {
+		t.Fatalf("join with invite failed: %d", status)
+	}
+	if status := join(b.SessionToken, "b", invite.Code); status != http.StatusForbidden {
+		t.Fatalf("single-use invite was accepted twice: %d", status)
+	}
+	postJSON(t, rig.client, rig.server.URL+"/rooms/list", ListRoomsRequest{SessionToken: a.SessionToken}, &listResp)
+	if len(listResp.Rooms) != 1 {
+		t.Fatalf("invited member should see the room: %+v", listResp.Rooms)
+	}
+
+	postJSON(t, rig.client, rig.server.URL+"/rooms/invite", CreateInviteRequest{RoomID: roomResp.RoomID, TTLSeconds: 60, SessionToken: owner.SessionToken}, &invite)
+	if status := join(b.SessionToken, "b", invite.Code); status != http.StatusOK {
+		t.Fatalf("join with fresh invite failed: %d", status)
+	}
+	now = now.Add(2 * time.Minute)
+	if status := join(c.SessionToken, "c", invite.Code); status != http.StatusForbidden {
+		t.Fatalf("expired invite was accepted: %d", status)
+	}
+}
+
+func TestKickRevokesSessionButAllowsRejoin(t *testing.T) {
+	s := NewServer()
+	rig := newTestRigForServer(t, s)
+	defer rig.close()
+
+	var owner, friend RegisterResponse
+	postJSON(t, rig.client, rig.server.URL+"/auth/register", RegisterRequest{Username: "owner", Password: "pw"}, &owner)
+	postJSON(t, rig.client, rig.server.URL+"/auth/register", RegisterRequest{Username: "friend", Password: "pw", DeviceID: "laptop"}, &friend)
+	var roomResp CreateRoomResponse
+	postJSON(t, rig.client, rig.server.URL+"/rooms", CreateRoomRequest{Name: "lan", SessionToken: owner.SessionToken}, &roomResp)
+	var joinResp JoinRoomResponse
+	join := JoinRoomRequest{RoomID: roomResp.RoomID, DeviceID: "laptop", SessionToken: friend.SessionToken}
+	postJSON(t, rig.client, rig.server.URL+"/rooms/join", join, &joinResp)
+
+	kick := KickMemberRequest{RoomID: roomResp.RoomID, DeviceID: "laptop", SessionToken: friend.SessionToken}
+	if resp := postJSON(t, rig.client, rig.server.URL+"/rooms/kick", kick, nil); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("members must not kick, got %d", resp.StatusCode)
+	}
+	kick.SessionToken = owner.SessionToken
+	if resp := postJSON(t, rig.client, rig.server.URL+"/rooms/kick", kick, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("kick failed: %d", resp.StatusCode)
+	}
+	if _, ok := s.LookupTunnelSession(joinResp.PeerID); ok {
+		t.Fatalf("kicked device kept its tunnel session")
+	}
+	if resp := postJSON(t, rig.client, rig.server.URL+"/rooms/join", join, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("kicked device could not rejoin: %d", resp.StatusCode)
+	}
+}
+
+func TestBanByUserAndDevice(t *testing.T) {
+	s := NewServer()
+	now := time.Unix(1_700_000_000, 0)
+	s.now = func() time.Time { return now }
+	rig := newTestRigForServer(t, s)
+	defer rig.close()
+
+	var owner, griefer, other RegisterResponse
+	postJSON(t, rig.client, rig.server.URL+"/auth/register", RegisterRequest{Username: "owner", Password: "pw"}, &owner)
+	postJSON(t, rig.client, rig.server.URL+"/auth/register", RegisterRequest{Username: "griefer", Password: "pw", DeviceID: "pc"}, &griefer)
+	postJSON(t, rig.client, rig.server.URL+"/auth/register", RegisterRequest{Username: "other", Password: "pw", DeviceID: "shared-pc"}, &other)
+	rig.enrollDevices(t, "griefer", "pw", "phone", "new-device")
+	var roomResp CreateRoomResponse
+	postJSON(t, rig.client, rig.server.URL+"/rooms", CreateRoomRequest{Name: "lan", SessionToken: owner.SessionToken}, &roomResp)
+	join := func(token, device string) (JoinRoomResponse, int) {
+		var resp JoinRoomResponse
+		status := postJSON(t, rig.client, rig.server.URL+"/rooms/join", JoinRoomRequest{RoomID: roomResp.RoomID, DeviceID: device, SessionToken: token}, &resp).StatusCode
+		return resp, status
+	}
+	pc, _ := join(griefer.SessionToken, "pc")
+	join(griefer.SessionToken, "phone")
+
+	var banResp BanResponse
+	ban := BanRequest{RoomID: roomResp.RoomID, Username: "griefer", DurationSeconds: 600, SessionToken: owner.SessionToken}
+	if resp := postJSON(t, rig.client, rig.server.URL+"/rooms/ban", ban, &banResp); resp.StatusCode != http.StatusOK {
+		t.Fatalf("ban failed: %d", resp.StatusCode)
+	}
+	if len(banResp.RemovedDevices) != 2 || banResp.ExpiresAtUnix != now.Add(10*time.Minute).Unix() {
+		t.Fatalf("unexpected ban response %+v", banResp)
+	}
+	if _, ok := s.LookupTunnelSession(pc.PeerID); ok {
+		t.Fatalf("banned user kept a tunnel session")
+	}
+	if _, status := join(griefer.SessionToken, "new-device"); status != http.StatusForbidden {
+		t.Fatalf("banned user joined from a new device: %d", status)
+	}
+	now = now.Add(11 * time.Minute)
+	if _, status := join(griefer.SessionToken, "pc"); status != http.StatusOK {
+		t.Fatalf("ban did not expire: %d", status)
+	}
+
+	// A device ban without a username is aimed at the account whose device is in the room.
+	join(other.SessionToken, "shared-pc")
+	deviceBan := BanRequest{RoomID: roomResp.RoomID, DeviceID: "shared-pc", SessionToken: owner.SessionToken}
+	if resp := postJSON(t, rig.client, rig.server.URL+"/rooms/ban", deviceBan, &banResp); resp.StatusCode != http.StatusOK || banResp.Username != "other" {
+		t.Fatalf("device ban failed: %d %+v", resp.StatusCode, banResp)
+	}
+	if _, status := join(other.SessionToken, "shared-pc"); status != http.StatusForbidden {
+		t.Fatalf("banned device rejoined: %d", status)
+	}
+	var detail RoomDetail
+	postJSON(t, rig.client, rig.server.URL+"/rooms/get", GetRoomRequest{RoomID: roomResp.RoomID, SessionToken: owner.SessionToken}, &detail)
+	if len(detail.Bans) != 1 || detail.Bans[0].DeviceID != "shared-pc" || detail.Bans[0].Username != "other" || detail.Bans[0].ExpiresAtUnix != 0 {
+		t.Fatalf("owner should see the active device ban: %+v", detail.Bans)
+	}
+	unban := UnbanRequest{RoomID: roomResp.RoomID, DeviceID: "shared-pc", SessionToken: owner.SessionToken}
+	if resp := postJSON(t, rig.client, rig.server.URL+"/rooms/unban", unban, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("unban failed: %d", resp.StatusCode)
+	}
+	if _, status := join(other.SessionToken, "shared-pc"); status != http.StatusOK {
+		t.Fatalf("unbanned device could not join: %d", status)
+	}
+
+	ownerBan := BanRequest{RoomID: roomResp.RoomID, Username: "owner", SessionToken: owner.SessionToken}
+	if resp := postJSON(t, rig.client, rig.server.URL+"/rooms/ban", ownerBan, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("owner must not be bannable, got %d", resp.StatusCode)
+	}
+	// The owner has not joined from their device, so it is not a member, but it is still theirs.
+	ownerDeviceBan := BanRequest{RoomID: roomResp.RoomID, Username: "owner", DeviceID: owner.DeviceID, SessionToken: owner.SessionToken}
+	if resp := postJSON(t, rig.client, rig.server.URL+"/rooms/ban", ownerDeviceBan, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("owner's offline device must not be bannable, got %d", resp.StatusCode)
+	}
+	if _, status := join(owner.SessionToken, owner.DeviceID); status != http.StatusOK {
+		t.Fatalf("owner was locked out of their own room: %d", status)
+	}
+}
+
+func TestFullRoomRejectsJoinWithCode(t *testing.T) {
+	rig := newTestRig(t)
+	defer rig.close()
+
+	var loginResp LoginResponse
+	postJSON(t, rig.client, rig.server.URL+"/auth/login", LoginRequest{Username: "gamer", Password: "password123"}, &loginResp)
+	rig.enrollDevices(t, "gamer", "password123", "a", "b", "c")
+	var roomResp CreateRoomResponse
+	postJSON(t, rig.client, rig.server.URL+"/rooms", CreateRoomRequest{Name: "duo", MaxMembers: 2, SessionToken: loginResp.SessionToken}, &roomResp)
+	for _, device := range []string{"a", "b"} {
+		if resp := postJSON(t, rig.client, rig.server.URL+"/rooms/join", JoinRoomRequest{RoomID: roomResp.RoomID, DeviceID: device, SessionToken: loginResp.SessionToken}, nil); resp.StatusCode != http.StatusOK {
+			t.Fatalf("join %s failed: %d", device, resp.StatusCode)
+		}
+	}
+	var errBody map[string]string
+	resp := postJSON(t, rig.client, rig.server.URL+"/rooms/join", JoinRoomRequest{RoomID: roomResp.RoomID, DeviceID: "c", SessionToken: loginResp.SessionToken}, &errBody)
+	if resp.StatusCode != http.StatusConflict || errBody["code"] != ErrorCodeRoomFull {
+		t.Fatalf("expected room_full conflict, got %d %v", resp.StatusCode, errBody)
+	}
+	// Members already in the room can still rejoin.
+	if resp := postJSON(t, rig.client, rig.server.URL+"/rooms/join", JoinRoomRequest{RoomID: roomResp.RoomID, DeviceID: "a", SessionToken: loginResp.SessionToken}, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("existing member could not rejoin a full room: %d", resp.StatusCode)
+	}
+}
+
+func TestWaitlistAdmitsNextDeviceWhenSlotFrees(t *testing.T) {
+	rig := newTestRig(t)
+	defer rig.close()
+
+	var loginResp LoginResponse
+	postJSON(t, rig.client, rig.server.URL+"/auth/login", LoginRequest{Username: "gamer", Password: "password123"}, &loginResp)
+	rig.enrollDevices(t, "gamer", "password123", "first", "second", "third")
+	var roomResp CreateRoomResponse
+	postJSON(t, rig.client, rig.server.URL+"/rooms", CreateRoomRequest{Name: "solo", MaxMembers: 1, Waitlist: true, SessionToken: loginResp.SessionToken}, &roomResp)
+	join := func(device string) (JoinRoomResponse, int) {
+		var resp JoinRoomResponse
+		status := postJSON(t, rig.client, rig.server.URL+"/rooms/join", JoinRoomRequest{RoomID: roomResp.RoomID, DeviceID: device, SessionToken: loginResp.SessionToken}, &resp).StatusCode
+		return resp, status
+	}
+	first, _ := join("first")
+	second, status := join("second")
+	if status != http.StatusAccepted || !second.Waitlisted || second.WaitlistPosition != 1 || second.SessionKey != "" {
+		t.Fatalf("expected second device to be queued: %d %+v", status, second)
+	}
+	third, _ := join("third")
+	if third.WaitlistPosition != 2 {
+		t.Fatalf("expected third device at position 2, got %+v", third)
+	}
+	if again, _ := join("second"); again.WaitlistPosition != 1 {
+		t.Fatalf("rejoining while queued should report the same position, got %+v", again)
+	}
+
+	postJSON(t, rig.client, rig.server.URL+"/rooms/leave", LeaveRoomRequest{RoomID: roomResp.RoomID, DeviceID: "first", SessionToken: loginResp.SessionToken}, nil)
+	admitted, status := join("second")
+	if status != http.StatusOK || admitted.Waitlisted || admitted.SessionKey == "" {
+		t.Fatalf("second device was not admitted after a slot freed: %d %+v", status, admitted)
+	}
+	if admitted.VirtualIP != first.VirtualIP {
+		t.Fatalf("admitted device should take the freed address %s, got %s", first.VirtualIP, admitted.VirtualIP)
+	}
+	if queued, _ := join("third"); queued.WaitlistPosition != 1 {
+		t.Fatalf("third device should move up the queue, got %+v", queued)
+	}
+
+	var detail RoomDetail
+	two := 2
+	postJSON(t, rig.client, rig.server.URL+"/rooms/update", UpdateRoomRequest{RoomID: roomResp.RoomID, MaxMembers: &two, SessionToken: loginResp.SessionToken}, &detail)
+	if detail.MemberCount != 2 || detail.WaitingCount != 0 {
+		t.Fatalf("raising the cap should admit the queue: %+v", detail.RoomSummary)
+	}
+}
+
+func TestIdleEphemeralRoomsExpire(t *testing.T) {
+	s := NewServer()
+	now := time.Unix(1_700_000_000, 0)
+	s.now = func() time.Time { return now }
+	rig := newTestRigForServer(t, s)
+	defer rig.close()
+
+	var loginResp LoginResponse
+	postJSON(t, rig.client, rig.server.URL+"/auth/login", LoginRequest{Username: "gamer", Password: "password123", DeviceID: "pc"}, &loginResp)
+	var evening, permanent CreateRoomResponse
+	postJSON(t, rig.client, rig.server.URL+"/rooms", CreateRoomRequest{Name: "evening", IdleTimeoutSec: 3600, SessionToken: loginResp.SessionToken}, &evening)
+	postJSON(t, rig.client, rig.server.URL+"/rooms", CreateRoomRequest{Name: "permanent", SessionToken: loginResp.SessionToken}, &permanent)
+	var joinResp JoinRoomResponse
+	postJSON(t, rig.client, rig.server.URL+"/rooms/join", JoinRoomRequest{RoomID: evening.RoomID, DeviceID: "pc", SessionToken: loginResp.SessionToken}, &joinResp)
+
+	// Tunnel traffic keeps the room alive past its timeout.
+	now = now.Add(50 * time.Minute)
+	s.MarkTunnelSeen(joinResp.PeerID, now)
+	now = now.Add(50 * time.Minute)
+	if expired, err := s.ExpireIdleRooms(); err != nil || len(expired) != 0 {
+		t.Fatalf("active room expired: %v %v", expired, err)
+	}
+
+	now = now.Add(11 * time.Minute)
+	expired, err := s.ExpireIdleRooms()
+	if err != nil || len(expired) != 1 || expired[0] != evening.RoomID {
+		t.Fatalf("expected %s to expire, got %v %v", evening.RoomID, expired, err)
+	}
+	if _, ok := s.LookupTunnelSession(joinResp.PeerID); ok {
+		t.Fatalf("expired room kept its tunnel sessions")
+	}
+	var listResp ListRoomsResponse
+	postJSON(t, rig.client, rig.server.URL+"/rooms/list", ListRoomsRequest{SessionToken: loginResp.SessionToken}, &listResp)
+	if len(listResp.Rooms) != 1 || listResp.Rooms[0].RoomID != permanent.RoomID {
+		t.Fatalf("only the permanent room should remain: %+v", listResp.Rooms)
+	}
+	var again CreateRoomResponse
+	postJSON(t, rig.client, rig.server.URL+"/rooms", CreateRoomRequest{Name: "again", SessionToken: loginResp.SessionToken}, &again)
+	if again.OverlaySubnet != evening.OverlaySubnet {
+		t.Fatalf("expired room's subnet %s was not reclaimed, got %s", evening.OverlaySubnet, again.OverlaySubnet)
+	}
+}
+
+func TestRoomIdleTimeoutHasMinimum(t *testing.T) {
+	rig := newTestRig(t)
+	defer rig.close()
+
+	var loginResp LoginResponse
+	postJSON(t, rig.client, rig.server.URL+"/auth/login", LoginRequest{Username: "gamer", Password: "password123"}, &loginResp)
+	// Tunnel activity reaches the control plane only every 30 seconds, so shorter timeouts
+	// could expire rooms that are in use.
+	for _, idle := range []int{-1, 1, 29, 59} {
+		resp := postJSON(t, rig.client, rig.server.URL+"/rooms", CreateRoomRequest{Name: "short", IdleTimeoutSec: idle, SessionToken: loginResp.SessionToken}, nil)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("create with idle timeout %d: expected bad request, got %d", idle, resp.StatusCode)
+		}
+	}
+	var roomResp CreateRoomResponse
+	resp := postJSON(t, rig.client, rig.server.URL+"/rooms", CreateRoomRequest{Name: "minute", IdleTimeoutSec: 60, SessionToken: loginResp.SessionToken}, &roomResp)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("create with the minimum idle timeout failed: %d", resp.StatusCode)
+	}
+
+	for _, idle := range []int{1, 59} {
+		resp = postJSON(t, rig.client, rig.server.URL+"/rooms/update", UpdateRoomRequest{RoomID: roomResp.RoomID, IdleTimeoutSec: &idle, SessionToken: loginResp.SessionToken}, nil)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("update to idle timeout %d: expected bad request, got %d", idle, resp.StatusCode)
+		}
+	}
+	permanent := 0
+	var detail RoomDetail
+	resp = postJSON(t, rig.client, rig.server.URL+"/rooms/update", UpdateRoomRequest{RoomID: roomResp.RoomID, IdleTimeoutSec: &permanent, SessionToken: loginResp.SessionToken}, &detail)
+	if resp.StatusCode != http.StatusOK || detail.IdleTimeoutSec != 0 {
+		t.Fatalf("clearing the idle timeout failed: %d %+v", resp.StatusCode, detail)
+	}
+}
+
+func TestJanitorExpiresRoomsInBackground(t *testing.T) {
+	s := NewServer()
+	var mu sync.Mutex
+	now := time.Unix(1_700_000_000, 0)
+	s.now = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	rig := newTestRigForServer(t, s)
+	defer rig.close()
+
+	var loginResp LoginResponse
+	postJSON(t, rig.client, rig.server.URL+"/auth/login", LoginRequest{Username: "gamer", Password: "password123"}, &loginResp)
+	var roomResp CreateRoomResponse
+	postJSON(t, rig.client, rig.server.URL+"/rooms", CreateRoomRequest{Name: "brief", IdleTimeoutSec: 60, SessionToken: loginResp.SessionToken}, &roomResp)
+
+	stop := s.StartJanitor(5 * time.Millisecond)
+	defer stop()
+	mu.Lock()
+	now = now.Add(2 * time.Minute)
+	mu.Unlock()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		var listResp ListRoomsResponse
+		postJSON(t, rig.client, rig.server.URL+"/rooms/list", ListRoomsRequest{SessionToken: loginResp.SessionToken}, &listResp)
+		if len(listResp.Rooms) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("janitor did not expire the idle room")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLoadsLegacyMembership(t *testing.T) {
+	dataPath := filepath.Join(t.TempDir(), "state.json")
+	legacy := `{"users":{},"device_bags":{},"rooms":{"room-1":{"ID":"room-1","OverlaySubnet":"10.0.1.0/24",` +
+		`"KeepaliveInterval":15,"Members":{"pc":"gamer","laptop":"gamer"},"Leases":{"laptop":"10.0.1.7"}}}}`
+	if err := os.WriteFile(dataPath, []byte(legacy), 0o600); err != nil {
+		t.Fatalf("write state: %v", err)
+	}
+	s, err := NewServerWithStorage(dataPath)
+	if err != nil {
+		t.Fatalf("load legacy state: %v", err)
+	}
+	room := s.rooms["room-1"]
+	pc, laptop := room.Members[deviceKey("gamer", "pc")], room.Members[deviceKey("gamer", "laptop")]
+	if pc == nil || laptop == nil || pc.DeviceID != "pc" || laptop.VirtualIP != "10.0.1.7" || room.Leases != nil {
+		t.Fatalf("legacy membership not migrated: %+v", room)
+	}
+}
+
+func TestLegacyPasswordIsRehashedOnLogin(t *testing.T) {
+	dataPath := filepath.Join(t.TempDir(), "state.json")
+	legacy := `{"users":{"old":{"Username":"old","Salt":"c2FsdHNhbHQ=","Hash":"` + legacyPasswordHash("letmein", "c2FsdHNhbHQ=") +
+		`","Device":"pc","IsAdmin":true}},"device_bags":{},"rooms":{}}`
+	if err := os.WriteFile(dataPath, []byte(legacy), 0o600); err != nil {
+		t.Fatalf("write state: %v", err)
+	}
+	rig := newTestRigWithPath(t, dataPath)
+	defer rig.close()
+
+	if resp := postJSON(t, rig.client, rig.server.URL+"/auth/login", LoginRequest{Username: "old", Password: "wrong"}, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected wrong password to fail, got %d", resp.StatusCode)
+	}
+	if resp := postJSON(t, rig.client, rig.server.URL+"/auth/login", LoginRequest{Username: "old", Password: "letmein"}, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("legacy login failed: %d", resp.StatusCode)
+	}
+	state, err := loadState(dataPath)
+	if err != nil {
+		t.Fatalf("load state: %v", err)
+	}
+	upgraded := state.Users["old"]
+	if !strings.HasPrefix(upgraded.Hash, "$argon2id$") || upgraded.Salt != "" {
+		t.Fatalf("legacy hash was not upgraded: %+v", upgraded)
+	}
+	if resp := postJSON(t, rig.client, rig.server.URL+"/auth/login", LoginRequest{Username: "old", Password: "letmein"}, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("login after rehash failed: %d", resp.StatusCode)
+	}
+}
+
+func TestSessionsExpireWhenIdleOrTooOld(t *testing.T) {
+	s := NewServer()
+	now := time.Unix(1_700_000_000, 0)
+	s.now = func() time.Time { return now }
+	if err := s.SetSessionLifetime(time.Hour, 3*time.Hour); err != nil {
+		t.Fatalf("set session lifetime: %v", err)
+	}
+	rig := newTestRigForServer(t, s)
+	defer rig.close()
+
+	list := func(token string) int {
+		return postJSON(t, rig.client, rig.server.URL+"/rooms/list", ListRoomsRequest{SessionToken: token}, nil).StatusCode
+	}
+	var idle, busy LoginResponse
+	postJSON(t, rig.client, rig.server.URL+"/auth/login", LoginRequest{Username: "gamer", Password: "password123"}, &idle)
+	postJSON(t, rig.client, rig.server.URL+"/auth/login", LoginRequest{Username: "gamer", Password: "password123"}, &busy)
+
+	for i := 0; i < 2; i++ {
+		now = now.Add(50 * time.Minute)
+		if status := list(busy.SessionToken); status != http.StatusOK {
+			t.Fatalf("session in use expired early: %d", status)
+		}
+	}
+	if status := list(idle.SessionToken); status != http.StatusUnauthorized {
+		t.Fatalf("idle session should have expired, got %d", status)
+	}
+	now = now.Add(50 * time.Minute)
+	if status := list(busy.SessionToken); status != http.StatusOK {
+		t.Fatalf("session in use expired early: %d", status)
+	}
+	now = now.Add(40 * time.Minute)
+	if status := list(busy.SessionToken); status != http.StatusUnauthorized {
+		t.Fatalf("session past its max age should have expired, got %d", status)
+	}
+}
+
+func TestLogoutAndRevokeSessions(t *testing.T) {
+	rig := newTestRig(t)
+	defer rig.close()
+
+	list := func(token string) int {
+		return postJSON(t, rig.client, rig.server.URL+"/rooms/list", ListRoomsRequest{SessionToken: token}, nil).StatusCode
+	}
+	var admin LoginResponse
+	postJSON(t, rig.client, rig.server.URL+"/auth/login", LoginRequest{Username: "gamer", Password: "password123"}, &admin)
+	var victim RegisterResponse
+	postJSON(t, rig.client, rig.server.URL+"/auth/register", RegisterRequest{Username: "victim", Password: "pw"}, &victim)
+	var second LoginResponse
+	postJSON(t, rig.client, rig.server.URL+"/auth/login", LoginRequest{Username: "victim", Password: "pw"}, &second)
+
+	var logoutResp LogoutResponse
+	if resp := postJSON(t, rig.client, rig.server.URL+"/auth/logout", LogoutRequest{SessionToken: second.SessionToken}, &logoutResp); resp.StatusCode != http.StatusOK || logoutResp.Username != "victim" {
+		t.Fatalf("logout failed: %d %+v", resp.StatusCode, logoutResp)
+	}
+	if status := list(second.SessionToken); status != http.StatusUnauthorized {
+		t.Fatalf("logged out session still works: %d", status)
+	}
+	if status := list(victim.SessionToken); status != http.StatusOK {
+		t.Fatalf("logout ended another session: %d", status)
+	}
+
+	if resp := postJSON(t, rig.client, rig.server.URL+"/admin/sessions/revoke", RevokeSessionsRequest{SessionToken: victim.SessionToken, TargetUser: "gamer"}, nil); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("non-admin revoked another user's sessions: %d", resp.StatusCode)
+	}
+	var revokeResp RevokeSessionsResponse
+	postJSON(t, rig.client, rig.server.URL+"/admin/sessions/revoke", RevokeSessionsRequest{SessionToken: admin.SessionToken, TargetUser: "victim"}, &revokeResp)
+	if revokeResp.Revoked != 1 {
+		t.Fatalf("expected one session revoked, got %+v", revokeResp)
+	}
+	if status := list(victim.SessionToken); status != http.StatusUnauthorized {
+		t.Fatalf("revoked session still works: %d", status)
+	}
+	if status := list(admin.SessionToken); status != http.StatusOK {
+		t.Fatalf("revoking another user ended the admin's session: %d", status)
+	}
+}
+
+func TestSessionsSurviveRestartWhenPersisted(t *testing.T) {
+	dataPath := filepath.Join(t.TempDir(), "state.json")
+	rig := newTestRigWithPath(t, dataPath)
+	var regResp RegisterResponse
+	postJSON(t, rig.client, rig.server.URL+"/auth/register", RegisterRequest{Username: "nova", Password: "warp123"}, &regResp)
+	rig.close()
+
+	restarted := newTestRigWithPath(t, dataPath)
+	if resp := postJSON(t, restarted.client, restarted.server.URL+"/rooms/list", ListRoomsRequest{SessionToken: regResp.SessionToken}, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("persisted session rejected after restart: %d", resp.StatusCode)
+	}
+	restarted.close()
+
+	s, err := NewServerWithStorage(dataPath)
+	if err != nil {
+		t.Fatalf("server init: %v", err)
+	}
+	if err := s.SetSessionPersistence(false); err != nil {
+		t.Fatalf("disable session persistence: %v", err)
+	}
+	ephemeral := newTestRigForServer(t, s)
+	if resp := postJSON(t, ephemeral.client, ephemeral.server.URL+"/rooms/list", ListRoomsRequest{SessionToken: regResp.SessionToken}, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("sessions should not be restored with persistence off, got %d", resp.StatusCode)
+	}
+	ephemeral.close()
+	state, err := loadState(dataPath)
+	if err != nil {
+		t.Fatalf("load state: %v", err)
+	}
+	if len(state.Sessions) != 0 {
+		t.Fatalf("disabling persistence left %d sessions in the data file", len(state.Sessions))
+	}
+
+	// Turning persistence back on must not resurrect the sessions saved before.
+	reenabled := newTestRigWithPath(t, dataPath)
+	defer reenabled.close()
+	if resp := postJSON(t, reenabled.client, reenabled.server.URL+"/rooms/list", ListRoomsRequest{SessionToken: regResp.SessionToken}, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("session came back after persistence was re-enabled, got %d", resp.StatusCode)
+	}
+}
+
+func TestDevicesCanBeListedRenamedAndRevoked(t *testing.T) {
+	s := NewServer()
+	rig := newTestRigForServer(t, s)
+	defer rig.close()
+
+	var admin LoginResponse
+	postJSON(t, rig.client, rig.server.URL+"/auth/login", LoginRequest{Username: "gamer", Password: "password123"}, &admin)
+	var room CreateRoomResponse
+	postJSON(t, rig.client, rig.server.URL+"/rooms", CreateRoomRequest{Name: "lan", SessionToken: admin.SessionToken}, &room)
+
+	var pc RegisterResponse
+	postJSON(t, rig.client, rig.server.URL+"/auth/register", RegisterRequest{Username: "nova", Password: "warp123", DeviceID: "nova-pc"}, &pc)
+	var laptop LoginResponse
+	postJSON(t, rig.client, rig.server.URL+"/auth/login", LoginRequest{Username: "nova", Password: "warp123", DeviceID: "nova-laptop", DeviceName: "Laptop", Platform: "linux"}, &laptop)
+	if laptop.DeviceID != "nova-laptop" {
+		t.Fatalf("login enrolled the wrong device: %+v", laptop)
+	}
+
+	var devices ListDevicesResponse
+	postJSON(t, rig.client, rig.server.URL+"/devices/list", ListDevicesRequest{SessionToken: pc.SessionToken}, &devices)
+	if len(devices.Devices) != 2 || devices.Devices[0].DeviceID != "nova-laptop" || devices.Devices[0].Name != "Laptop" || devices.Devices[0].Platform != "linux" {
+		t.Fatalf("unexpected device list: %+v", devices.Devices)
+	}
+
+	var renamed DeviceInfo
+	postJSON(t, rig.client, rig.server.URL+"/devices/rename", RenameDeviceRequest{SessionToken: pc.SessionToken, DeviceID: "nova-pc", Name: "Desktop"}, &renamed)
+	if renamed.Name != "Desktop" {
+		t.Fatalf("rename not applied: %+v", renamed)
+	}
+	if resp := postJSON(t, rig.client, rig.server.URL+"/devices/rename", RenameDeviceRequest{SessionToken: admin.SessionToken, DeviceID: "nova-pc", Name: "mine"}, nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("renamed another user's device: %d", resp.StatusCode)
+	}
+
+	var join JoinRoomResponse
+	postJSON(t, rig.client, rig.server.URL+"/rooms/join", JoinRoomRequest{RoomID: room.RoomID, DeviceID: "nova-laptop", SessionToken: pc.SessionToken}, &join)
+	var revoked RevokeDeviceResponse
+	postJSON(t, rig.client, rig.server.URL+"/devices/revoke", RevokeDeviceRequest{SessionToken: pc.SessionToken, DeviceID: "nova-laptop"}, &revoked)
+	if !revoked.Device.Revoked || revoked.RevokedTunnels != 1 || revoked.RevokedSessions != 1 {
+		t.Fatalf("unexpected revoke response: %+v", revoked)
+	}
+	if resp := postJSON(t, rig.client, rig.server.URL+"/rooms/list", ListRoomsRequest{SessionToken: laptop.SessionToken}, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("revoked device's session still works: %d", resp.StatusCode)
+	}
+	if resp := postJSON(t, rig.client, rig.server.URL+"/rooms/list", ListRoomsRequest{SessionToken: pc.SessionToken}, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("revoking one device ended another's session: %d", resp.StatusCode)
+	}
+	if _, ok := s.LookupTunnelSession(join.PeerID); ok {
+		t.Fatalf("revoked device kept its tunnel session")
+	}
+	if resp := postJSON(t, rig.client, rig.server.URL+"/auth/refresh", RefreshTokenRequest{DeviceToken: laptop.DeviceToken}, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("revoked device token still refreshes: %d", resp.StatusCode)
+	}
+	if resp := postJSON(t, rig.client, rig.server.URL+"/rooms/join", JoinRoomRequest{RoomID: room.RoomID, DeviceID: "nova-laptop", SessionToken: pc.SessionToken}, nil); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("revoked device rejoined: %d", resp.StatusCode)
+	}
+	if resp := postJSON(t, rig.client, rig.server.URL+"/auth/refresh", RefreshTokenRequest{DeviceToken: pc.DeviceToken}, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("revoking one device affected another: %d", resp.StatusCode)
+	}
+
+	var again LoginResponse
+	postJSON(t, rig.client, rig.server.URL+"/auth/login", LoginRequest{Username: "nova", Password: "warp123", DeviceID: "nova-laptop"}, &again)
+	if resp := postJSON(t, rig.client, rig.server.URL+"/auth/refresh", RefreshTokenRequest{DeviceToken: again.DeviceToken}, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("re-enrolled device cannot refresh: %d", resp.StatusCode)
+	}
+	// Logging in from a device again replaces its refresh token.
+	rig.enrollDevices(t, "nova", "warp123", "nova-pc")
+	if resp := postJSON(t, rig.client, rig.server.URL+"/auth/refresh", RefreshTokenRequest{DeviceToken: pc.DeviceToken}, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("replaced device token still refreshes: %d", resp.StatusCode)
+	}
+}
+
+func TestDeviceIDsAreScopedToTheirAccount(t *testing.T) {
+	rig := newTestRig(t)
+	defer rig.close()
+
+	var nova, rex RegisterResponse
+	postJSON(t, rig.client, rig.server.URL+"/auth/register", RegisterRequest{Username: "nova", Password: "warp123", DeviceID: "device-1"}, &nova)
+	if resp := postJSON(t, rig.client, rig.server.URL+"/auth/register", RegisterRequest{Username: "rex", Password: "woof", DeviceID: "device-1"}, &rex); resp.StatusCode != http.StatusOK {
+		t.Fatalf("a device ID used by another account blocked registration: %d", resp.StatusCode)
+	}
+	var revoked RevokeDeviceResponse
+	postJSON(t, rig.client, rig.server.URL+"/devices/revoke", RevokeDeviceRequest{SessionToken: nova.SessionToken, DeviceID: "device-1"}, &revoked)
+	if !revoked.Device.Revoked {
+		t.Fatalf("revoke failed: %+v", revoked)
+	}
+	if resp := postJSON(t, rig.client, rig.server.URL+"/auth/refresh", RefreshTokenRequest{DeviceToken: rex.DeviceToken}, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("revoking one account's device affected another's: %d", resp.StatusCode)
+	}
+
+	var room CreateRoomResponse
+	postJSON(t, rig.client, rig.server.URL+"/rooms", CreateRoomRequest{Name: "lan", SessionToken: rex.SessionToken}, &room)
+	if resp := postJSON(t, rig.client, rig.server.URL+"/rooms/join", JoinRoomRequest{RoomID: room.RoomID, DeviceID: "never-enrolled", SessionToken: rex.SessionToken}, nil); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("joined from a device that was never enrolled: %d", resp.StatusCode)
+	}
+	if resp := postJSON(t, rig.client, rig.server.URL+"/rooms/join", JoinRoomRequest{RoomID: room.RoomID, DeviceID: "device-1", SessionToken: rex.SessionToken}, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("enrolled device could not join: %d", resp.StatusCode)
+	}
+}
+
+func TestDevicesSavedByBareIDAreRekeyed(t *testing.T) {
+	dataPath := filepath.Join(t.TempDir(), "state.json")
+	session := "00112233445566778899aabbccddeeff"
+	now := time.Now().UTC().Format(time.RFC3339)
+	saved := `{"users":{"old":{"Username":"old","Hash":"x"},"rival":{"Username":"rival","Hash":"x"}},` +
+		`"devices":{"pc":{"ID":"pc","Username":"old","Name":"pc","CreatedAt":"` + now + `","LastUsed":"` + now + `"},` +
+		`"tab":{"ID":"tab","Username":"rival","Name":"tab","CreatedAt":"` + now + `","LastUsed":"` + now + `"}},` +
+		`"rooms":{"room-1":{"ID":"room-1","OverlaySubnet":"10.0.1.0/24","KeepaliveInterval":15,"Owner":"old",` +
+		`"Bans":[{"DeviceID":"tab","BannedBy":"old"}]}},` +
+		`"sessions":{"` + hashToken(session) + `":{"Username":"old","IssuedAt":"` + now + `","LastUsed":"` + now + `"}}}`
+	if err := os.WriteFile(dataPath, []byte(saved), 0o600); err != nil {
+		t.Fatalf("write state: %v", err)
+	}
+	s, err := NewServerWithStorage(dataPath)
+	if err != nil {
+		t.Fatalf("load state: %v", err)
+	}
+	rig := newTestRigForServer(t, s)
+	defer rig.close()
+
+	if resp := postJSON(t, rig.client, rig.server.URL+"/rooms/join", JoinRoomRequest{RoomID: "room-1", DeviceID: "pc", SessionToken: session}, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("device saved under its bare ID was lost: %d", resp.StatusCode)
+	}
+	s.mu.Lock()
+	ban := s.rooms["room-1"].Bans[0]
+	s.mu.Unlock()
+	if ban.Username != "rival" || ban.DeviceID != "tab" {
+		t.Fatalf("device ban from before per-account IDs was not attributed: %+v", ban)
+	}
+}
+
+func TestRoomsTellApartDevicesOfDifferentAccounts(t *testing.T) {
+	s := NewServer()
+	rig := newTestRigForServer(t, s)
+	defer rig.close()
+
+	var owner, alice, bob RegisterResponse
+	postJSON(t, rig.client, rig.server.URL+"/auth/register", RegisterRequest{Username: "owner", Password: "pw"}, &owner)
+	postJSON(t, rig.client, rig.server.URL+"/auth/register", RegisterRequest{Username: "alice", Password: "pw", DeviceID: "pc"}, &alice)
+	postJSON(t, rig.client, rig.server.URL+"/auth/register", RegisterRequest{Username: "bob", Password: "pw", DeviceID: "pc"}, &bob)
+	var roomResp CreateRoomResponse
+	postJSON(t, rig.client, rig.server.URL+"/rooms", CreateRoomRequest{Name: "lan", SessionToken: owner.SessionToken}, &roomResp)
+	join := func(token string) (JoinRoomResponse, int) {
+		var resp JoinRoomResponse
+		status := postJSON(t, rig.client, rig.server.URL+"/rooms/join", JoinRoomRequest{RoomID: roomResp.RoomID, DeviceID: "pc", SessionToken: token}, &resp).StatusCode
+		return resp, status
+	}
+
+	alicePC, status := join(alice.SessionToken)
+	if status != http.StatusOK {
+		t.Fatalf("alice could not join: %d", status)
+	}
+	bobPC, status := join(bob.SessionToken)
+	if status != http.StatusOK || bobPC.VirtualIP == alicePC.VirtualIP {
+		t.Fatalf("bob's pc collided with alice's: %d %+v", status, bobPC)
+	}
+	for user, token := range map[string]string{"alice": alice.SessionToken, "bob": bob.SessionToken} {
+		clientKey, err := GenerateEphemeralKey()
+		if err != nil {
+			t.Fatalf("ephemeral key: %v", err)
+		}
+		offer := TunnelOffer{RoomID: roomResp.RoomID, DeviceID: "pc", SessionToken: token, EphemeralKey: EncodeEphemeralKey(clientKey.PublicKey())}
+		if resp := postJSON(t, rig.client, rig.server.URL+"/tunnel/bootstrap", offer, nil); resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s could not bootstrap: %d", user, resp.StatusCode)
+		}
+	}
+	if tunnel, _ := s.LookupTunnelSession(alicePC.PeerID); tunnel.Username != "alice" || !tunnel.Bootstrapped() {
+		t.Fatalf("alice's tunnel was mixed up with bob's: %+v", tunnel)
+	}
+
+	kick := KickMemberRequest{RoomID: roomResp.RoomID, DeviceID: "pc", SessionToken: owner.SessionToken}
+	if resp := postJSON(t, rig.client, rig.server.URL+"/rooms/kick", kick, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("kicking an ambiguous device id should ask for the user, got %d", resp.StatusCode)
+	}
+	ban := BanRequest{RoomID: roomResp.RoomID, DeviceID: "pc", SessionToken: owner.SessionToken}
+	if resp := postJSON(t, rig.client, rig.server.URL+"/rooms/ban", ban, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("banning an ambiguous device id should ask for the user, got %d", resp.StatusCode)
+	}
+	ban.Username = "bob"
+	var banResp BanResponse
+	if resp := postJSON(t, rig.client, rig.server.URL+"/rooms/ban", ban, &banResp); resp.StatusCode != http.StatusOK || len(banResp.RemovedDevices) != 1 {
+		t.Fatalf("ban on bob's pc failed: %d %+v", resp.StatusCode, banResp)
+	}
+	if _, ok := s.LookupTunnelSession(bobPC.PeerID); ok {
+		t.Fatalf("bob's banned pc kept its tunnel")
+	}
+	if _, ok := s.LookupTunnelSession(alicePC.PeerID); !ok {
+		t.Fatalf("banning bob's pc dropped alice's")
+	}
+	if _, status := join(bob.SessionToken); status != http.StatusForbidden {
+		t.Fatalf("bob's banned pc rejoined: %d", status)
+	}
+	if again, status := join(alice.SessionToken); status != http.StatusOK || again.PeerID != alicePC.PeerID {
+		t.Fatalf("alice's pc was caught by bob's ban: %d", status)
+	}
+
+	// With bob's pc gone the device id is no longer ambiguous.
+	kick.Username = ""
+	if resp := postJSON(t, rig.client, rig.server.URL+"/rooms/kick", kick, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("kick failed: %d", resp.StatusCode)
+	}
+	if _, ok := s.LookupTunnelSession(alicePC.PeerID); ok {
+		t.Fatalf("kicked pc kept its tunnel")
+	}
+	unban := UnbanRequest{RoomID: roomResp.RoomID, DeviceID: "pc", SessionToken: owner.SessionToken}
+	if resp := postJSON(t, rig.client, rig.server.URL+"/rooms/unban", unban, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("unban failed: %d", resp.StatusCode)
+	}
+	if _, status := join(bob.SessionToken); status != http.StatusOK {
+		t.Fatalf("bob's unbanned pc could not join: %d", status)
+	}
+}
+
+func TestLegacyDeviceTokensAreMigrated(t *testing.T) {
+	dataPath := filepath.Join(t.TempDir(), "state.json")
+	token := "0123456789abcdef0123456789abcdef"
+	legacy := `{"users":{"old":{"Username":"old","Hash":"x","Device":"pc"}},` +
+		`"device_bags":{"pc":"old","` + token + `":"old"},"rooms":{}}`
+	if err := os.WriteFile(dataPath, []byte(legacy), 0o600); err != nil {
+		t.Fatalf("write state: %v", err)
+	}
+	rig := newTestRigWithPath(t, dataPath)
+	defer rig.close()
+
+	var refreshed RefreshTokenResponse
+	if resp := postJSON(t, rig.client, rig.server.URL+"/auth/refresh", RefreshTokenRequest{DeviceToken: token}, &refreshed); resp.StatusCode != http.StatusOK {
+		t.Fatalf("legacy device token rejected: %d", resp.StatusCode)
+	}
+	var devices ListDevicesResponse
+	postJSON(t, rig.client, rig.server.URL+"/devices/list", ListDevicesRequest{SessionToken: refreshed.SessionToken}, &devices)
+	if len(devices.Devices) != 1 || devices.Devices[0].DeviceID != "pc" {
+		t.Fatalf("legacy device not migrated: %+v", devices.Devices)
+	}
+	raw, err := os.ReadFile(dataPath)
+	if err != nil {
+		t.Fatalf("read state: %v", err)
+	}
+	if strings.Contains(string(raw), "device_bags") || strings.Contains(string(raw), token) {
+		t.Fatalf("legacy device tokens still stored in plain text:\n%s", raw)
+	}
+}
+
+func TestLegacyTokensOfUserWithTwoDevicesAreKept(t *testing.T) {
+	dataPath := filepath.Join(t.TempDir(), "state.json")
+	// The registered device ID happens to look like a token.
+	hexDevice := "abcdefabcdefabcdefabcdefabcdef01"
+	first, second := "0123456789abcdef0123456789abcdef", "fedcba9876543210fedcba9876543210"
+	soloToken := "00000000000000000000000000000001"
+	legacy := `{"users":{"old":{"Username":"old","Hash":"x","Device":"` + hexDevice + `"},"solo":{"Username":"solo","Hash":"x","Device":"pc"}},` +
+		`"device_bags":{"` + hexDevice + `":"old","tablet":"old","` + first + `":"old","` + second + `":"old","pc":"solo","` + soloToken + `":"solo"},"rooms":{}}`
+	if err := os.WriteFile(dataPath, []byte(legacy), 0o600); err != nil {
+		t.Fatalf("write state: %v", err)
+	}
+	rig := newTestRigWithPath(t, dataPath)
+	defer rig.close()
+
+	listDevices := func(token string) []DeviceInfo {
+		var refreshed RefreshTokenResponse
+		if resp := postJSON(t, rig.client, rig.server.URL+"/auth/refresh", RefreshTokenRequest{DeviceToken: token}, &refreshed); resp.StatusCode != http.StatusOK {
+			t.Fatalf("legacy device token %s rejected: %d", token, resp.StatusCode)
+		}
+		var devices ListDevicesResponse
+		postJSON(t, rig.client, rig.server.URL+"/devices/list", ListDevicesRequest{SessionToken: refreshed.SessionToken}, &devices)
+		return devices.Devices
+	}
+	devices := listDevices(first)
+	listDevices(second)
+	ids := []string{}
+	for _, device := range devices {
+		ids = append(ids, device.DeviceID)
+	}
+	if len(ids) != 4 || ids[0] != hexDevice || ids[3] != "tablet" || !strings.HasPrefix(ids[1], "legacy-") || !strings.HasPrefix(ids[2], "legacy-") {
+		t.Fatalf("expected both devices plus one record per unpaired token, got %v", ids)
+	}
+	if solo := listDevices(soloToken); len(solo) != 1 || solo[0].DeviceID != "pc" {
+		t.Fatalf("a lone token should stay with its user's lone device: %+v", solo)
+	}
+}
+
+func TestStateFileHoldsNoUsableTokens(t *testing.T) {
+	dataPath := filepath.Join(t.TempDir(), "state.json")
+	rig := newTestRigWithPath(t, dataPath)
+	var owner RegisterResponse
+	postJSON(t, rig.client, rig.server.URL+"/auth/register", RegisterRequest{Username: "nova", Password: "warp123"}, &owner)
+	var room CreateRoomResponse
+	postJSON(t, rig.client, rig.server.URL+"/rooms", CreateRoomRequest{Name: "secret", InviteOnly: true, SessionToken: owner.SessionToken}, &room)
+	var invite CreateInviteResponse
+	postJSON(t, rig.client, rig.server.URL+"/rooms/invite", CreateInviteRequest{RoomID: room.RoomID, SessionToken: owner.SessionToken}, &invite)
+	rig.close()
+
+	raw, err := os.ReadFile(dataPath)
+	if err != nil {
+		t.Fatalf("read state: %v", err)
+	}
+	for _, token := range []string{owner.SessionToken, owner.DeviceToken, invite.Code} {
+		if strings.Contains(string(raw), token) {
+			t.Fatalf("state file contains token %s:\n%s", token, raw)
+		}
+	}
+	restarted := newTestRigWithPath(t, dataPath)
+	defer restarted.close()
+	if resp := postJSON(t, restarted.client, restarted.server.URL+"/auth/refresh", RefreshTokenRequest{DeviceToken: owner.DeviceToken}, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("device token rejected after restart: %d", resp.StatusCode)
+	}
+	var guest RegisterResponse
+	postJSON(t, restarted.client, restarted.server.URL+"/auth/register", RegisterRequest{Username: "rex", Password: "woof", DeviceID: "rex-pc"}, &guest)
+	if resp := postJSON(t, restarted.client, restarted.server.URL+"/rooms/join", JoinRoomRequest{RoomID: room.RoomID, DeviceID: "rex-pc", SessionToken: guest.SessionToken, InviteCode: invite.Code}, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("invite code rejected after restart: %d", resp.StatusCode)
+	}
+}
+
+func TestLegacyPlaintextTokensAreHashedOnLoad(t *testing.T) {
+	dataPath := filepath.Join(t.TempDir(), "state.json")
+	session := "00112233445566778899aabbccddeeff"
+	code := "ffeeddccbbaa99887766554433221100"
+	now := time.Now().UTC().Format(time.RFC3339)
+	expires := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	legacy := `{"users":{"old":{"Username":"old","Hash":"x"}},"devices":{},` +
+		`"rooms":{"room-1":{"ID":"room-1","OverlaySubnet":"10.0.1.0/24","KeepaliveInterval":15,"Owner":"old","InviteOnly":true,` +
+		`"Invites":{"` + code + `":{"CreatedBy":"old","ExpiresAt":"` + expires + `"}}}},` +
+		`"sessions":{"` + session + `":{"Username":"old","IssuedAt":"` + now + `","LastUsed":"` + now + `"}}}`
+	if err := os.WriteFile(dataPath, []byte(legacy), 0o600); err != nil {
+		t.Fatalf("write state: %v", err)
+	}
+	rig := newTestRigWithPath(t, dataPath)
+	defer rig.close()
+
+	raw, err := os.ReadFile(dataPath)
+	if err != nil {
+		t.Fatalf("read state: %v", err)
+	}
+	if strings.Contains(string(raw), session) || strings.Contains(string(raw), code) {
+		t.Fatalf("plaintext tokens still on disk after load:\n%s", raw)
+	}
+	if resp := postJSON(t, rig.client, rig.server.URL+"/rooms/list", ListRoomsRequest{SessionToken: session}, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("migrated session rejected: %d", resp.StatusCode)
+	}
+	var guest RegisterResponse
+	postJSON(t, rig.client, rig.server.URL+"/auth/register", RegisterRequest{Username: "rex", Password: "woof", DeviceID: "rex-pc"}, &guest)
+	if resp := postJSON(t, rig.client, rig.server.URL+"/rooms/join", JoinRoomRequest{RoomID: "room-1", DeviceID: "rex-pc", SessionToken: guest.SessionToken, InviteCode: code}, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("migrated invite code rejected: %d", resp.StatusCode)
+	}
+}
+
+func newThrottledServer(t *testing.T, limits LoginLimits) (*Server, *time.Time) {
+	t.Helper()
+	s := NewServer()
+	now := time.Unix(1_700_000_000, 0)
+	s.now = func() time.Time { return now }
+	if err := s.SetLoginLimits(limits); err != nil {
+		t.Fatalf("set login limits: %v", err)
+	}
+	if err := s.SetPasswordParams(PasswordParams{Memory: 64, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}); err != nil {
+		t.Fatalf("set password params: %v", err)
+	}
+	return s, &now
+}
+
+func TestLoginBackoffAndLockout(t *testing.T) {
+	s, now := newThrottledServer(t, LoginLimits{
+		UserFreeAttempts: 2, IPFreeAttempts: 3, BaseDelay: time.Second, MaxDelay: time.Minute,
+		LockoutThreshold: 4, LockoutDuration: 10 * time.Minute, ResetAfter: time.Hour,
+	})
+	rig := newTestRigForServer(t, s)
+	defer rig.close()
+
+	var admin LoginResponse
+	postJSON(t, rig.client, rig.server.URL+"/auth/login", LoginRequest{Username: "gamer", Password: "password123"}, &admin)
+	var nova RegisterResponse
+	postJSON(t, rig.client, rig.server.URL+"/auth/register", RegisterRequest{Username: "nova", Password: "warp123"}, &nova)
+
+	login := func(password string) (int, string, string) {
+		var body map[string]string
+		resp := postJSON(t, rig.client, rig.server.URL+"/auth/login", LoginRequest{Username: "nova", Password: password}, &body)
+		return resp.StatusCode, body["code"], resp.Header.Get("Retry-After")
+	}
+	for i := 0; i < 3; i++ {
+		if status, _, _ := login("guess"); status != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: expected 401, got %d", i+1, status)
+		}
+	}
+	if status, code, retry := login("warp123"); status != http.StatusTooManyRequests || code != ErrorCodeRateLimited || retry != "1" {
+		t.Fatalf("expected backoff after free attempts, got %d %q retry=%q", status, code, retry)
+	}
+	*now = now.Add(time.Second)
+	if status, _, _ := login("guess"); status != http.StatusUnauthorized {
+		t.Fatalf("attempt after backoff should be checked, got %d", status)
+	}
+	if status, code, retry := login("warp123"); status != http.StatusTooManyRequests || code != ErrorCodeAccountLocked || retry != "600" {
+		t.Fatalf("expected account lockout, got %d %q retry=%q", status, code, retry)
+	}
+
+	if resp := postJSON(t, rig.client, rig.server.URL+"/admin/lockouts", ListLockoutsRequest{SessionToken: nova.SessionToken}, nil); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("non-admin listed lockouts: %d", resp.StatusCode)
+	}
+	var lockouts ListLockoutsResponse
+	postJSON(t, rig.client, rig.server.URL+"/admin/lockouts", ListLockoutsRequest{SessionToken: admin.SessionToken}, &lockouts)
+	if len(lockouts.Accounts) != 1 || lockouts.Accounts[0].Username != "nova" || lockouts.Accounts[0].FailedAttempts != 4 {
+		t.Fatalf("unexpected lockouts: %+v", lockouts.Accounts)
+	}
+	var cleared ClearLockoutResponse
+	postJSON(t, rig.client, rig.server.URL+"/admin/lockouts/clear", ClearLockoutRequest{SessionToken: admin.SessionToken, TargetUser: "nova"}, &cleared)
+	if !cleared.WasLocked {
+		t.Fatalf("expected lockout to be cleared: %+v", cleared)
+	}
+	// The guesses also put the address into backoff; the unlock lifts that as well.
+	if status, _, _ := login("warp123"); status != http.StatusOK {
+		t.Fatalf("login after unlock failed: %d", status)
+	}
+}
+
+func TestLoginThrottledPerAddress(t *testing.T) {
+	s, now := newThrottledServer(t, LoginLimits{
+		UserFreeAttempts: 5, IPFreeAttempts: 3, BaseDelay: time.Second, MaxDelay: time.Minute,
+		LockoutThreshold: 10, LockoutDuration: 10 * time.Minute, ResetAfter: time.Hour,
+	})
+	rig := newTestRigForServer(t, s)
+	defer rig.close()
+
+	for _, user := range []string{"a", "b", "c", "d"} {
+		if resp := postJSON(t, rig.client, rig.server.URL+"/auth/login", LoginRequest{Username: user, Password: "guess"}, nil); resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("expected 401 for %s, got %d", user, resp.StatusCode)
+		}
+	}
+	if resp := postJSON(t, rig.client, rig.server.URL+"/auth/login", LoginRequest{Username: "gamer", Password: "password123"}, nil); resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("address should be throttled across usernames, got %d", resp.StatusCode)
+	}
+	*now = now.Add(time.Second)
+	for i := 0; i < 2; i++ {
+		if resp := postJSON(t, rig.client, rig.server.URL+"/auth/login", LoginRequest{Username: "gamer", Password: "password123"}, nil); resp.StatusCode != http.StatusOK {
+			t.Fatalf("login %d after backoff failed: %d", i+1, resp.StatusCode)
+		}
+	}
+	*now = now.Add(time.Hour)
+	s.pruneLoginFailures()
+	if len(s.loginFailuresByIP) != 0 || len(s.loginFailuresByUser) != 0 {
+		t.Fatalf("stale login failures not pruned: %v %v", s.loginFailuresByIP, s.loginFailuresByUser)
+	}
+}
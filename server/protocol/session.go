@@ -0,0 +1,113 @@
+package protocol
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	// DefaultSessionIdleTimeout ends a session that has not been used for this long.
+	DefaultSessionIdleTimeout = 24 * time.Hour
+	// DefaultSessionMaxAge ends every session this long after it was issued, however busy.
+	DefaultSessionMaxAge = 7 * 24 * time.Hour
+)
+
+type sessionRecord struct {
+	Username string
+	// DeviceID is the device the session was issued to, so revoking the device ends it.
+	DeviceID string `json:",omitempty"`
+	IssuedAt time.Time
+	// LastUsed is refreshed on every authenticated request but only written to disk with the
+	// next state change, so after a restart sessions may expire a little early, never late.
+	LastUsed time.Time
+}
+
+func (r *sessionRecord) expired(now time.Time, idle, maxAge time.Duration) bool {
+	return now.Sub(r.LastUsed) >= idle || now.Sub(r.IssuedAt) >= maxAge
+}
+
+// SetSessionLifetime sets how long sessions survive without use and in total.
+func (s *Server) SetSessionLifetime(idle, maxAge time.Duration) error {
+	if idle <= 0 || maxAge <= 0 {
+		return errors.New("session idle timeout and max age must be positive")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessionIdle, s.sessionMaxAge = idle, maxAge
+	return nil
+}
+
+// SetSessionPersistence controls whether sessions are saved with the rest of the state so
+// they survive restarts. Turning it off also drops any sessions loaded from disk and rewrites
+// the data file without them, so they cannot come back if persistence is enabled again.
+func (s *Server) SetSessionPersistence(enabled bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.persistSessions = enabled
+	if enabled {
+		return nil
+	}
+	s.sessions = map[string]*sessionRecord{}
+	return s.persistLocked()
+}
+
+func (s *Server) issueSessionLocked(username, deviceID string) string {
+	token := newToken()
+	now := s.now()
+	s.sessions[hashToken(token)] = &sessionRecord{Username: username, DeviceID: deviceID, IssuedAt: now, LastUsed: now}
+	return token
+}
+
+// sessionUserLocked resolves a session token to its user, discarding it if it has expired and
+// otherwise marking it used.
+func (s *Server) sessionUserLocked(token string) (string, bool) {
+	key := hashToken(token)
+	session, ok := s.sessions[key]
+	if !ok {
+		return "", false
+	}
+	now := s.now()
+	if session.expired(now, s.sessionIdle, s.sessionMaxAge) {
+		delete(s.sessions, key)
+		return "", false
+	}
+	session.LastUsed = now
+	return session.Username, true
+}
+
+// revokeSessionsLocked ends every session of username and returns how many there were.
+func (s *Server) revokeSessionsLocked(username string) int {
+	revoked := 0
+	for key, session := range s.sessions {
+		if session.Username == username {
+			delete(s.sessions, key)
+			revoked++
+		}
+	}
+	return revoked
+}
+
+// revokeDeviceSessionsLocked ends the sessions issued to one of username's devices and returns
+// how many there were.
+func (s *Server) revokeDeviceSessionsLocked(username, deviceID string) int {
+	revoked := 0
+	for key, session := range s.sessions {
+		if session.Username == username && session.DeviceID == deviceID {
+			delete(s.sessions, key)
+			revoked++
+		}
+	}
+	return revoked
+}
+
+// pruneSessions drops expired sessions that were never presented again.
+func (s *Server) pruneSessions() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	for key, session := range s.sessions {
+		if session.expired(now, s.sessionIdle, s.sessionMaxAge) {
+			delete(s.sessions, key)
+		}
+	}
+}
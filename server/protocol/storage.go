@@ -9,16 +9,20 @@ import (
 )
 
 type persistentState struct {
-	Users      map[string]userRecord  `json:"users"`
-	DeviceBags map[string]string      `json:"device_bags"`
+	Users   map[string]userRecord    `json:"users"`
+	Devices map[string]*deviceRecord `json:"devices"`
+	// DeviceBags is only read from state files written before the device registry.
+	DeviceBags map[string]string      `json:"device_bags,omitempty"`
 	Rooms      map[string]*roomRecord `json:"rooms"`
+	// Sessions is only written when session persistence is enabled.
+	Sessions map[string]*sessionRecord `json:"sessions,omitempty"`
 }
 
 func loadState(path string) (persistentState, error) {
 	state := persistentState{
-		Users:      map[string]userRecord{},
-		DeviceBags: map[string]string{},
-		Rooms:      map[string]*roomRecord{},
+		Users:   map[string]userRecord{},
+		Devices: map[string]*deviceRecord{},
+		Rooms:   map[string]*roomRecord{},
 	}
 	data, err := os.ReadFile(path)
 	if errors.Is(err, os.ErrNotExist) {
@@ -33,8 +37,8 @@ func loadState(path string) (persistentState, error) {
 	if state.Users == nil {
 		state.Users = map[string]userRecord{}
 	}
-	if state.DeviceBags == nil {
-		state.DeviceBags = map[string]string{}
+	if state.Devices == nil {
+		state.Devices = map[string]*deviceRecord{}
 	}
 	if state.Rooms == nil {
 		state.Rooms = map[string]*roomRecord{}
@@ -59,3 +63,14 @@ func saveState(path string, state persistentState) error {
 	}
 	return nil
 }
+
+// UnmarshalJSON also accepts the bare username that older state files stored per member.
+func (m *memberRecord) UnmarshalJSON(data []byte) error {
+	var username string
+	if err := json.Unmarshal(data, &username); err == nil {
+		*m = memberRecord{Username: username}
+		return nil
+	}
+	type plain memberRecord
+	return json.Unmarshal(data, (*plain)(m))
+}
@@ -0,0 +1,33 @@
+package protocol
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+)
+
+// Bearer tokens (sessions, device refresh tokens, invite codes) are only stored as hashes, so
+// the state file holds nothing a client could present. They are random, so a plain SHA-256
+// suffices.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// legacyTokenPattern matches the tokens newToken issues, which older state files stored as-is;
+// their hashes are twice as long, so the two cannot be confused.
+var legacyTokenPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// rehashLegacyKeys re-keys entries stored under a plaintext token by the token's hash and
+// reports whether it changed anything.
+func rehashLegacyKeys[V any](m map[string]V) bool {
+	changed := false
+	for key, value := range m {
+		if legacyTokenPattern.MatchString(key) {
+			delete(m, key)
+			m[hashToken(key)] = value
+			changed = true
+		}
+	}
+	return changed
+}